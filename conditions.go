@@ -0,0 +1,114 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+
+	samplev1alpha1 "k8s.io/sample-controller/pkg/apis/samplecontroller/v1alpha1"
+)
+
+// getVMCondition returns the condition of the given type, or nil if the
+// status has none.
+func getVMCondition(status *samplev1alpha1.VMStatus, condType samplev1alpha1.VMConditionType) *samplev1alpha1.VMCondition {
+	for i := range status.Conditions {
+		if status.Conditions[i].Type == condType {
+			return &status.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// setVMCondition adds or replaces the condition of the same type. The
+// transition time is only bumped when the condition status changes, so
+// repeating a condition does not cause a status write.
+func setVMCondition(status *samplev1alpha1.VMStatus, cond samplev1alpha1.VMCondition) {
+	existing := getVMCondition(status, cond.Type)
+	if existing == nil {
+		cond.LastTransitionTime = metav1.Now()
+		status.Conditions = append(status.Conditions, cond)
+		return
+	}
+
+	if existing.Status != cond.Status {
+		cond.LastTransitionTime = metav1.Now()
+	} else {
+		cond.LastTransitionTime = existing.LastTransitionTime
+	}
+	*existing = cond
+}
+
+// removeVMCondition removes the condition of the given type.
+func removeVMCondition(status *samplev1alpha1.VMStatus, condType samplev1alpha1.VMConditionType) {
+	var conditions []samplev1alpha1.VMCondition
+	for _, c := range status.Conditions {
+		if c.Type != condType {
+			conditions = append(conditions, c)
+		}
+	}
+	status.Conditions = conditions
+}
+
+// Phases of a VM, as counted in the metrics.
+const (
+	vmPhasePending  = "Pending"
+	vmPhaseRunning  = "Running"
+	vmPhaseFailed   = "Failed"
+	vmPhaseDeleting = "Deleting"
+)
+
+// vmPhase sums up the state of a VM: being deleted, with a problem reported
+// in its conditions, with a server, or still waiting for one.
+func vmPhase(vm *samplev1alpha1.VM) string {
+	if vm.DeletionTimestamp != nil {
+		return vmPhaseDeleting
+	}
+	for _, cond := range vm.Status.Conditions {
+		if cond.Status == corev1.ConditionTrue {
+			return vmPhaseFailed
+		}
+	}
+	if vm.Status.VMID != "" {
+		return vmPhaseRunning
+	}
+	return vmPhasePending
+}
+
+// countVMsByPhase returns the number of VMs in the lister in each phase,
+// including the phases no VM is in.
+func (c *Controller) countVMsByPhase() map[string]int {
+	counts := map[string]int{
+		vmPhasePending:  0,
+		vmPhaseRunning:  0,
+		vmPhaseFailed:   0,
+		vmPhaseDeleting: 0,
+	}
+	vms, err := c.vmsLister.List(labels.Everything())
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("error listing VMs: %v", err))
+		return counts
+	}
+	for _, vm := range vms {
+		counts[vmPhase(vm)]++
+	}
+	return counts
+}
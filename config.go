@@ -0,0 +1,204 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog"
+
+	"k8s.io/sample-controller/pkg/config"
+	"k8s.io/sample-controller/pkg/signals"
+)
+
+// configCheckPeriod is how often the configuration file is checked for
+// changes.
+const configCheckPeriod = 10 * time.Second
+
+// bindFlags defines the flags overriding the fields of c on fs, defaulting
+// to the values in c.
+func bindFlags(fs *flag.FlagSet, c *config.ControllerConfiguration) {
+	fs.Var(listValue{&c.Scope.Namespaces}, "namespaces", "Comma-separated namespaces to watch VMs in, all of them if empty")
+	fs.StringVar(&c.Scope.LabelSelector, "labelSelector", c.Scope.LabelSelector, "Only watch the VMs matching this label selector, so that several controllers can share a cluster")
+	fs.StringVar(&c.Cloud.APIServer, "cloudAPIServer", c.Cloud.APIServer, "The address of cloud API server address")
+	fs.StringVar(&c.Cloud.ClusterID, "clusterID", c.Cloud.ClusterID, "The ID of this cluster, recorded on every cloud server the controller owns")
+	fs.StringVar(&c.Orphans.Policy, "orphanPolicy", c.Orphans.Policy, "What to do with cloud servers owned by this cluster whose VM is gone: Report, Delete, or empty to not look for them")
+	fs.DurationVar(&c.Orphans.ScanPeriod.Duration, "orphanScanPeriod", c.Orphans.ScanPeriod.Duration, "How often to look for orphaned cloud servers")
+	fs.DurationVar(&c.Orphans.GracePeriod.Duration, "orphanGracePeriod", c.Orphans.GracePeriod.Duration, "How long a server must stay orphaned before it is deleted with orphanPolicy=Delete")
+	fs.DurationVar(&c.StatusPoll.Interval.Duration, "statusPollInterval", c.StatusPoll.Interval.Duration, "How often to refresh the guest metrics of all VMs, 0 to never refresh them")
+	fs.Float64Var(&c.StatusPoll.Jitter, "statusPollJitter", c.StatusPoll.Jitter, "Up to this fraction of statusPollInterval is added to each poll interval")
+	fs.IntVar(&c.StatusPoll.CPUUtilizationThreshold, "cpuUtilizationThreshold", c.StatusPoll.CPUUtilizationThreshold, "The smallest change in CPU utilization written to the status of a VM")
+	fs.DurationVar(&c.ShutdownTimeout.Duration, "shutdownTimeout", c.ShutdownTimeout.Duration, "How long to wait on shutdown for the syncs in flight and the events to be written, before cancelling them. Keep it under the termination grace period of the pod")
+	fs.DurationVar(&c.Health.CloudCheckInterval.Duration, "cloudCheckInterval", c.Health.CloudCheckInterval.Duration, "How often the readiness probe checks the cloud answers, in between the last result is reported")
+	fs.DurationVar(&c.Health.WorkerStuckTimeout.Duration, "workerStuckTimeout", c.Health.WorkerStuckTimeout.Duration, "How long VMs may stay queued without any worker taking or finishing one before the liveness probe fails. Keep it over the longest sync")
+	fs.StringVar(&c.Metrics.Address, "metricsAddress", c.Metrics.Address, "The address to serve Prometheus metrics, the /leader status and the /healthz and /readyz probes on, empty to not serve them")
+	fs.StringVar(&c.Metrics.CustomMetricsAddress, "customMetricsAddress", c.Metrics.CustomMetricsAddress, "The address to serve the custom.metrics.k8s.io API on, empty to not serve it")
+	fs.StringVar(&c.Metrics.CustomMetricsCertFile, "customMetricsCertFile", c.Metrics.CustomMetricsCertFile, "The serving certificate of the custom metrics API")
+	fs.StringVar(&c.Metrics.CustomMetricsKeyFile, "customMetricsKeyFile", c.Metrics.CustomMetricsKeyFile, "The key of the serving certificate of the custom metrics API")
+	fs.StringVar(&c.Metrics.CustomMetricsClientCAFile, "customMetricsClientCAFile", c.Metrics.CustomMetricsClientCAFile, "If set, only clients with a certificate signed by this CA, such as the aggregator, may use the custom metrics API")
+	fs.StringVar(&c.Webhook.Address, "webhookAddress", c.Webhook.Address, "The address to serve the admission webhook rejecting edits of spec.name on, empty to not serve it")
+	fs.StringVar(&c.Webhook.CertFile, "webhookCertFile", c.Webhook.CertFile, "The serving certificate of the admission webhook")
+	fs.StringVar(&c.Webhook.KeyFile, "webhookKeyFile", c.Webhook.KeyFile, "The key of the serving certificate of the admission webhook")
+	fs.BoolVar(&c.LeaderElection.LeaderElect, "leaderElect", c.LeaderElection.LeaderElect, "Elect a leader among the replicas to run the controller, disable for a single replica")
+	fs.StringVar(&c.LeaderElection.LockName, "leaderElectLockName", c.LeaderElection.LockName, "The name of the object the leader election lock is held on")
+	fs.StringVar(&c.LeaderElection.LockNamespace, "leaderElectNamespace", c.LeaderElection.LockNamespace, "The namespace of the leader election lock, defaults to POD_NAMESPACE or kube-system")
+	fs.StringVar(&c.LeaderElection.LockType, "leaderElectLockType", c.LeaderElection.LockType, "The kind of object the leader election lock is held on: Lease, ConfigMap or Endpoints")
+	fs.StringVar(&c.LeaderElection.Identity, "leaderElectIdentity", c.LeaderElection.Identity, "The identity of this replica in the leader election, defaults to POD_NAME or the host name")
+	fs.DurationVar(&c.LeaderElection.LeaseDuration.Duration, "leaderElectLeaseDuration", c.LeaderElection.LeaseDuration.Duration, "How long other replicas wait before taking over from a leader that stopped renewing")
+	fs.DurationVar(&c.LeaderElection.RenewDeadline.Duration, "leaderElectRenewDeadline", c.LeaderElection.RenewDeadline.Duration, "How long the leader keeps retrying to renew before giving up leadership")
+	fs.DurationVar(&c.LeaderElection.RetryPeriod.Duration, "leaderElectRetryPeriod", c.LeaderElection.RetryPeriod.Duration, "How long to wait between attempts to acquire or renew the lease")
+	fs.BoolVar(&c.Sharding.Enabled, "shard", c.Sharding.Enabled, "Share the VMs among all replicas, each reconciling those it owns, instead of electing a leader to reconcile them all")
+	fs.StringVar(&c.Sharding.Group, "shardGroup", c.Sharding.Group, "The name of the group of replicas sharing the VMs, and of their Leases")
+	fs.StringVar(&c.Sharding.Namespace, "shardNamespace", c.Sharding.Namespace, "The namespace of the Leases of the replicas sharing the VMs, defaults to POD_NAMESPACE or kube-system")
+	fs.StringVar(&c.Sharding.Identity, "shardIdentity", c.Sharding.Identity, "The identity of this replica among those sharing the VMs, defaults to POD_NAME or the host name")
+	fs.DurationVar(&c.Sharding.LeaseDuration.Duration, "shardLeaseDuration", c.Sharding.LeaseDuration.Duration, "How long a replica that stopped renewing its Lease keeps its share of the VMs")
+	fs.DurationVar(&c.Sharding.RenewPeriod.Duration, "shardRenewPeriod", c.Sharding.RenewPeriod.Duration, "How often replicas renew their Lease and look for others joining or leaving")
+	fs.StringVar(&c.NameChangePolicy, "nameChangePolicy", c.NameChangePolicy, "What to do when spec.name of a VM is edited: Immutable rejects the change, Rename renames the cloud server")
+}
+
+// listValue is a flag holding a comma-separated list.
+type listValue struct {
+	list *[]string
+}
+
+func (v listValue) String() string {
+	if v.list == nil {
+		return ""
+	}
+	return strings.Join(*v.list, ",")
+}
+
+func (v listValue) Set(value string) error {
+	*v.list = nil
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*v.list = append(*v.list, item)
+		}
+	}
+	return nil
+}
+
+// loadConfig returns the configuration in configFile, or the defaults
+// without one, with the flags given on the command line applied on top.
+func loadConfig() (*config.ControllerConfiguration, error) {
+	c := config.Default()
+	if configFile != "" {
+		var err error
+		if c, err = config.Load(configFile); err != nil {
+			return nil, err
+		}
+	}
+
+	overrides := flag.NewFlagSet("overrides", flag.ContinueOnError)
+	bindFlags(overrides, c)
+	var err error
+	flag.Visit(func(f *flag.Flag) {
+		if err == nil && overrides.Lookup(f.Name) != nil {
+			err = overrides.Set(f.Name, f.Value.String())
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c, c.Validate()
+}
+
+// configStore holds the configuration in effect. Only its reloadable fields
+// change once started.
+type configStore struct {
+	lock   sync.Mutex
+	config *config.ControllerConfiguration
+}
+
+func newConfigStore(c *config.ControllerConfiguration) *configStore {
+	return &configStore{config: c}
+}
+
+func (s *configStore) get() *config.ControllerConfiguration {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.config
+}
+
+// reload loads the configuration again, and applies its reloadable fields
+// to the controllers. An invalid configuration is not applied at all.
+func (s *configStore) reload(controllers *lifecycle) {
+	next, err := loadConfig()
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("error reloading the configuration, keeping the current one: %v", err))
+		return
+	}
+
+	s.lock.Lock()
+	reloaded, ignored := config.Reload(s.config, next)
+	s.config = reloaded
+	s.lock.Unlock()
+
+	if len(ignored) > 0 {
+		klog.Warningf("Changes to %s only take effect on restart", strings.Join(ignored, ", "))
+	}
+	controllers.reconfigure(controllerSettings(reloaded))
+	klog.Info("Reloaded the configuration")
+}
+
+// watchConfig reloads the configuration on SIGHUP, or when the file changes,
+// until stopCh is closed.
+func watchConfig(s *configStore, controllers *lifecycle, stopCh <-chan struct{}) {
+	reload := signals.SetupReloadHandler()
+	var changed <-chan struct{}
+	if configFile != "" {
+		changed = config.Watch(configFile, configCheckPeriod, stopCh)
+	}
+	go func() {
+		for {
+			select {
+			case <-reload:
+			case <-changed:
+			case <-stopCh:
+				return
+			}
+			s.reload(controllers)
+		}
+	}()
+}
+
+// controllerSettings returns the settings of the controller in c.
+func controllerSettings(c *config.ControllerConfiguration) settings {
+	return settings{
+		nameChangePolicy:        nameChangePolicy(c.NameChangePolicy),
+		resyncInterval:          c.VMResync.Duration,
+		cpuUtilizationThreshold: c.StatusPoll.CPUUtilizationThreshold,
+		shutdownTimeout:         c.ShutdownTimeout.Duration,
+	}
+}
+
+// rateLimiter returns how VMs that failed to sync are retried: after an
+// exponential per-VM delay, and no faster than the overall limit.
+func rateLimiter(c *config.ControllerConfiguration) workqueue.RateLimiter {
+	r := c.RateLimits
+	return workqueue.NewMaxOfRateLimiter(
+		workqueue.NewItemExponentialFailureRateLimiter(r.BaseDelay.Duration, r.MaxDelay.Duration),
+		&workqueue.BucketRateLimiter{Limiter: rate.NewLimiter(rate.Limit(r.QPS), r.Burst)},
+	)
+}
@@ -0,0 +1,80 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReloadConfig(t *testing.T) {
+	f := newFixture(t)
+	defer f.cloud.Close()
+	l, built := newTestLifecycle(f)
+
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(file string) { configFile = file }(configFile)
+	configFile = filepath.Join(dir, "config.yaml")
+	write := func(content string) {
+		content = "apiVersion: config.samplecontroller.k8s.io/v1alpha1\nkind: ControllerConfiguration\ncloud:\n  apiServer: " +
+			f.cloud.URL + "\n" + content
+		if err := ioutil.WriteFile(configFile, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("workers: 4\n")
+	conf, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newConfigStore(conf)
+	l.start()
+	defer l.stop()
+
+	write("workers: 8\nvmResync: 2m\nnameChangePolicy: Rename\n")
+	s.reload(l)
+	if settings := l.current().currentSettings(); settings.resyncInterval != 2*time.Minute || settings.nameChangePolicy != nameChangeRename {
+		t.Errorf("expected the running controller to be reconfigured, got %+v", settings)
+	}
+	if s.get().Workers != 4 {
+		t.Errorf("expected the workers to change only on restart, got %d", s.get().Workers)
+	}
+
+	write("workers: 0\nvmResync: 3m\n")
+	s.reload(l)
+	if s.get().VMResync.Duration != 2*time.Minute {
+		t.Errorf("expected an invalid configuration not to be applied, got %v", s.get().VMResync.Duration)
+	}
+
+	// Controllers built later get the reloaded settings too.
+	l.stop()
+	l.start()
+	if len(*built) != 2 {
+		t.Fatalf("expected a second controller, got %d", len(*built))
+	}
+	if settings := (*built)[1].currentSettings(); settings.resyncInterval != 2*time.Minute {
+		t.Errorf("expected the new controller to be reconfigured, got %+v", settings)
+	}
+}
@@ -17,23 +17,31 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"fmt"
+	"sync"
 	"time"
 
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/scheme"
 	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
 	"k8s.io/client-go/util/workqueue"
 	"k8s.io/klog"
 
 	samplev1alpha1 "k8s.io/sample-controller/pkg/apis/samplecontroller/v1alpha1"
 	vmctl "k8s.io/sample-controller/pkg/cloud"
+	"k8s.io/sample-controller/pkg/gc"
 	clientset "k8s.io/sample-controller/pkg/generated/clientset/versioned"
 	samplescheme "k8s.io/sample-controller/pkg/generated/clientset/versioned/scheme"
 	informers "k8s.io/sample-controller/pkg/generated/informers/externalversions/samplecontroller/v1alpha1"
@@ -50,6 +58,62 @@ const (
 	// MessageResourceSynced is the message used for an Event fired when a VM
 	// is synced successfully
 	MessageResourceSynced = "VM synced successfully"
+
+	// ErrDeleteServer is used as part of the Event 'reason' when the cloud
+	// server of a VM being deleted could not be removed
+	ErrDeleteServer = "ErrDeleteServer"
+
+	// ErrReleaseServer is used as part of the Event 'reason' when the cloud
+	// server of a VM being deleted could not be detached or retained
+	ErrReleaseServer = "ErrReleaseServer"
+
+	// ErrIDMismatch is used as part of the Event 'reason' when the server
+	// recorded for a VM no longer carries the VM's name
+	ErrIDMismatch = "ErrIDMismatch"
+
+	// ErrNameImmutable is used as part of the Event 'reason' when spec.name
+	// of a VM was changed while names are immutable
+	ErrNameImmutable = "ErrNameImmutable"
+
+	// ErrConflict is used as part of the Event 'reason' when the server a
+	// VM refers to is not owned by it
+	ErrConflict = "ErrConflict"
+
+	// SuccessAdopted is used as part of the Event 'reason' when an existing
+	// server is adopted by a VM
+	SuccessAdopted = "Adopted"
+)
+
+// nameChangePolicy decides how the controller reacts to an edited spec.name.
+type nameChangePolicy string
+
+const (
+	// nameChangeImmutable has the admission webhook reject the edit. An
+	// edit made without the webhook, or before the policy was reloaded, is
+	// reported and the server keeps its old name.
+	nameChangeImmutable nameChangePolicy = "Immutable"
+	// nameChangeRename renames the server in place.
+	nameChangeRename nameChangePolicy = "Rename"
+)
+
+// vmFinalizer is set on every VM the controller manages. It keeps the VM
+// around after deletion until its cloud server is confirmed gone, so servers
+// are not leaked while the controller is down or not leading.
+const vmFinalizer = "samplecontroller.k8s.io/vm-protection"
+
+const (
+	// defaultResyncInterval is how long a successfully synced VM waits
+	// before it is queued again to check it against the cloud.
+	defaultResyncInterval = 30 * time.Second
+
+	// defaultStatusPollInterval is how often the status poller refreshes
+	// the CPU utilization of all VMs.
+	defaultStatusPollInterval = 30 * time.Second
+
+	// defaultShutdownTimeout is how long a stopped controller waits for its
+	// work to finish. It leaves time to release the lease within the default
+	// termination grace period of pods.
+	defaultShutdownTimeout = 20 * time.Second
 )
 
 // Controller is the controller implementation for VM resources
@@ -74,14 +138,89 @@ type Controller struct {
 
 	cloud   vmctl.Cloud
 	metrics *metrics.Metrics
+
+	// orphans, if set, is run alongside the workers to find servers whose
+	// VM is gone.
+	orphans *gc.Collector
+
+	// clusterID is recorded on every server the controller owns, telling
+	// apart servers of controllers in different clusters. scope, along
+	// with it, tells apart servers of controllers watching different VMs.
+	clusterID string
+	scope     string
+
+	// settingsLock guards settings, which are reloaded while the
+	// controller runs.
+	settingsLock sync.Mutex
+	settings     settings
+
+	// statusPollInterval is how often the status poller refreshes the guest
+	// metrics of all VMs, with up to statusPollJitter times the interval
+	// added. A zero interval disables the poller.
+	statusPollInterval time.Duration
+	statusPollJitter   float64
+	// bulkStatusUnsupported is set once the cloud turned down a bulk status
+	// request. Only the status poller uses it.
+	bulkStatusUnsupported bool
+	// metricsHistory holds the recent samples of each server, by server ID,
+	// for the rolling averages. Only the status poller uses it.
+	metricsHistory map[string][]metricsSample
+	now            func() time.Time
+
+	// eventWatches are the event sinks, stopped with the controller once
+	// eventSink has been flushed.
+	eventWatches []watch.Interface
+	eventSink    *flushingSink
+
+	// progressLock guards lastProgress, the last time a worker took or
+	// finished a key, which tells whether the workers are stuck. It is
+	// zero until the workers start.
+	progressLock sync.Mutex
+	lastProgress time.Time
+
+	// owns, if set, tells whether this replica owns the VM with the given
+	// key. Only owned VMs are queued and polled, the others are left to
+	// the replicas owning them.
+	owns func(key string) bool
+	// rebalance, if set, receives when the VMs owned may have changed, so
+	// that all VMs are queued again and those gained are picked up.
+	rebalance <-chan struct{}
 }
 
-// NewController returns a new sample controller
+// settings are those of the controller that may change while it runs.
+type settings struct {
+	// nameChangePolicy decides what happens when spec.name of a VM is
+	// edited after its server was created.
+	nameChangePolicy nameChangePolicy
+
+	// resyncInterval is the delay after which a synced VM is queued again.
+	// Status writes do not trigger a sync on their own, so this is what
+	// catches changes made in the cloud.
+	resyncInterval time.Duration
+
+	// cpuUtilizationThreshold is the smallest change in CPU utilization the
+	// status poller writes to a VM right away.
+	cpuUtilizationThreshold int
+
+	// shutdownTimeout is how long a stopped controller waits for the syncs
+	// in flight, and then for its events to be written. Cloud requests still
+	// running after that are cancelled.
+	shutdownTimeout time.Duration
+}
+
+// NewController returns a new sample controller, for the VMs watched by
+// vmInformers: one informer per namespace watched, by namespace, or a single
+// one under metav1.NamespaceAll. VMs that failed to sync are retried as
+// rateLimiter allows. The metrics outlive the controller, so
+// that they keep counting across controllers built on every leadership
+// change.
 func NewController(
 	kubeclientset kubernetes.Interface,
 	sampleclientset clientset.Interface,
 	cloudAPIServer string,
-	vmInformer informers.VMInformer) *Controller {
+	vmInformers map[string]informers.VMInformer,
+	rateLimiter workqueue.RateLimiter,
+	m *metrics.Metrics) *Controller {
 
 	// Create event broadcaster
 	// Add sample-controller types to the default Kubernetes Scheme so Events can be
@@ -89,34 +228,74 @@ func NewController(
 	utilruntime.Must(samplescheme.AddToScheme(scheme.Scheme))
 	klog.V(4).Info("Creating event broadcaster")
 	eventBroadcaster := record.NewBroadcaster()
-	eventBroadcaster.StartLogging(klog.Infof)
-	eventBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: kubeclientset.CoreV1().Events("")})
+	logging := eventBroadcaster.StartEventWatcher(logEvent)
+	eventSink := newFlushingSink(&typedcorev1.EventSinkImpl{Interface: kubeclientset.CoreV1().Events("")})
+	sink := eventBroadcaster.StartRecordingToSink(eventSink)
 	recorder := eventBroadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: controllerAgentName})
+	eventSink.recorder = recorder
+
+	vmListers := map[string]listers.VMLister{}
+	var vmsSynced []cache.InformerSynced
+	for namespace, vmInformer := range vmInformers {
+		vmListers[namespace] = vmInformer.Lister()
+		vmsSynced = append(vmsSynced, vmInformer.Informer().HasSynced)
+	}
 
 	controller := &Controller{
 		kubeclientset:   kubeclientset,
 		sampleclientset: sampleclientset,
-		vmsLister:       vmInformer.Lister(),
-		vmsSynced:       vmInformer.Informer().HasSynced,
-		workqueue:       workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "VMs"),
+		vmsLister:       newScopedVMLister(vmListers),
+		vmsSynced:       allSynced(vmsSynced),
+		workqueue:       workqueue.NewNamedRateLimitingQueue(rateLimiter, "VMs"),
 		recorder:        recorder,
 		cloud:           vmctl.Cloud{Address: cloudAPIServer},
-		metrics:         metrics.InitMetrics(""),
+		metrics:         m,
+
+		settings: settings{
+			nameChangePolicy:        nameChangeImmutable,
+			resyncInterval:          defaultResyncInterval,
+			cpuUtilizationThreshold: 1,
+			shutdownTimeout:         defaultShutdownTimeout,
+		},
+		statusPollInterval: defaultStatusPollInterval,
+		metricsHistory:     map[string][]metricsSample{},
+		now:                time.Now,
+		eventWatches:       []watch.Interface{logging, sink},
+		eventSink:          eventSink,
 	}
 
+	controller.metrics.CountVMsByPhase(controller.countVMsByPhase)
+
 	klog.Info("Setting up event handlers")
 	// Set up an event handler for when VM resources change
-	vmInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+	handler := cache.ResourceEventHandlerFuncs{
 		AddFunc: func(obj interface{}) {
-			controller.metrics.K8sEventUpdate()
+			controller.metrics.EventReceived(metrics.EventAdd)
 			controller.enqueueVM(obj)
 		},
 		UpdateFunc: func(old, new interface{}) {
-			controller.metrics.K8sEventUpdate()
+			controller.metrics.EventReceived(metrics.EventUpdate)
+			oldVM, ok := old.(*samplev1alpha1.VM)
+			if !ok {
+				return
+			}
+			newVM, ok := new.(*samplev1alpha1.VM)
+			if !ok {
+				return
+			}
+			// Our own status writes and informer resyncs come through here
+			// too. Ignore them, or every status update would queue the VM
+			// again and we would spin on the cloud API.
+			if !vmNeedsSync(oldVM, newVM) {
+				return
+			}
 			controller.enqueueVM(new)
 		},
 		DeleteFunc: controller.handleDelete,
-	})
+	}
+	for _, vmInformer := range vmInformers {
+		vmInformer.Informer().AddEventHandler(handler)
+	}
 
 	return controller
 }
@@ -124,10 +303,12 @@ func NewController(
 // Run will set up the event handlers for types we are interested in, as well
 // as syncing informer caches and starting workers. It will block until stopCh
 // is closed, at which point it will shutdown the workqueue and wait for
-// workers to finish processing their current work items.
+// workers to finish processing their current work items. Cloud requests
+// still running after the shutdown timeout are cancelled, and an error is
+// returned if the controller did not stop cleanly.
 func (c *Controller) Run(threadiness int, stopCh <-chan struct{}) error {
 	defer utilruntime.HandleCrash()
-	defer c.workqueue.ShutDown()
+	defer c.stopRecording()
 
 	// Start the informer factories to begin populating the informer caches
 	klog.Info("Starting VM controller")
@@ -135,22 +316,148 @@ func (c *Controller) Run(threadiness int, stopCh <-chan struct{}) error {
 	// Wait for the caches to be synced before starting workers
 	klog.Info("Waiting for informer caches to sync")
 	if ok := cache.WaitForCacheSync(stopCh, c.vmsSynced); !ok {
+		c.workqueue.ShutDown()
 		return fmt.Errorf("failed to wait for caches to sync")
 	}
 
+	// Everything talking to the cloud is cancelled through this once the
+	// shutdown timeout is over.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c.cloud.Context = ctx
+
+	// Everything started here is waited for before returning, so a
+	// controller that was stopped has nothing left running.
+	var wg sync.WaitGroup
+	goWithWait := func(f func()) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f()
+		}()
+	}
+
 	klog.Info("Starting workers")
+	// Keys queued while the caches synced only count from now on.
+	c.recordProgress()
 	// Launch two workers to process VM resources
 	for i := 0; i < threadiness; i++ {
-		go wait.Until(c.runWorker, time.Second, stopCh)
+		goWithWait(func() { wait.Until(c.runWorker, time.Second, stopCh) })
 	}
 
 	klog.Info("Started workers")
+	if c.orphans != nil {
+		goWithWait(func() { c.orphans.Run(stopCh) })
+	}
+	if c.statusPollInterval > 0 {
+		goWithWait(func() { wait.JitterUntil(c.pollStatus, c.statusPollInterval, c.statusPollJitter, true, stopCh) })
+	}
+	if c.rebalance != nil {
+		goWithWait(func() { c.runRebalance(stopCh) })
+	}
 	<-stopCh
 	klog.Info("Shutting down workers")
+	shutdownTimeout := c.currentSettings().shutdownTimeout
+	deadline := time.Now().Add(shutdownTimeout)
+
+	// Workers finish the keys they are working on, and leave the rest.
+	c.workqueue.ShutDown()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	var err error
+	if !waitUntil(done, deadline) {
+		klog.Warningf("Workers still busy after %v, cancelling their cloud requests", shutdownTimeout)
+		cancel()
+		<-done
+		err = fmt.Errorf("workers did not finish within %v", shutdownTimeout)
+	}
+	klog.Info("Shut down workers")
 
+	if !c.eventSink.flush(deadline) {
+		klog.Warning("Events still unwritten after the shutdown timeout, dropping them")
+		if err == nil {
+			err = fmt.Errorf("events were not written within %v", shutdownTimeout)
+		}
+	}
+	return err
+}
+
+// recordProgress records that a worker took or finished a key.
+func (c *Controller) recordProgress() {
+	c.progressLock.Lock()
+	defer c.progressLock.Unlock()
+	c.lastProgress = c.now()
+}
+
+// checkProgress fails if keys are queued but no worker took or finished one
+// for timeout, which means all the workers are stuck. Workers not started
+// yet, while the caches sync, are not stuck.
+func (c *Controller) checkProgress(timeout time.Duration) error {
+	queued := c.workqueue.Len()
+	if queued == 0 {
+		return nil
+	}
+	c.progressLock.Lock()
+	defer c.progressLock.Unlock()
+	if c.lastProgress.IsZero() {
+		return nil
+	}
+	if since := c.now().Sub(c.lastProgress); since > timeout {
+		return fmt.Errorf("%d VMs queued but no progress for %v", queued, since.Round(time.Second))
+	}
 	return nil
 }
 
+// checkSynced fails until the informer caches are synced.
+func (c *Controller) checkSynced() error {
+	if !c.vmsSynced() {
+		return fmt.Errorf("informer caches not synced")
+	}
+	return nil
+}
+
+// currentSettings returns the settings in effect.
+func (c *Controller) currentSettings() settings {
+	c.settingsLock.Lock()
+	defer c.settingsLock.Unlock()
+	return c.settings
+}
+
+// reconfigure replaces the settings of the controller, running or not.
+func (c *Controller) reconfigure(s settings) {
+	c.settingsLock.Lock()
+	defer c.settingsLock.Unlock()
+	c.settings = s
+}
+
+// forgetMetrics stops exporting the guest metrics of the VMs in the cache
+// and the number of VMs in each phase, which the metrics would otherwise
+// keep reporting after the controller stopped.
+func (c *Controller) forgetMetrics() {
+	c.metrics.CountVMsByPhase(nil)
+	vms, err := c.vmsLister.List(labels.Everything())
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("error listing VMs: %v", err))
+		return
+	}
+	for _, vm := range vms {
+		c.metrics.DeleteVM(vm.Namespace, vm.Name)
+	}
+}
+
+// stopRecording stops sending the events of the controller to the API
+// server and the log. The broadcaster itself cannot be shut down safely in
+// this version of client-go, as events are handed to it asynchronously.
+func (c *Controller) stopRecording() {
+	for _, w := range c.eventWatches {
+		w.Stop()
+	}
+}
+
 // runWorker is a long-running function that will continually call the
 // processNextWorkItem function in order to read and process a message on the
 // workqueue.
@@ -167,6 +474,14 @@ func (c *Controller) processNextWorkItem() bool {
 	if shutdown {
 		return false
 	}
+	c.recordProgress()
+	defer c.recordProgress()
+	// Keys still queued when the controller is stopped are left to the
+	// next controller.
+	if c.workqueue.ShuttingDown() {
+		c.workqueue.Done(obj)
+		return false
+	}
 
 	// We wrap this block in a func so we can defer c.workqueue.Done.
 	err := func(obj interface{}) error {
@@ -192,13 +507,22 @@ func (c *Controller) processNextWorkItem() bool {
 			utilruntime.HandleError(fmt.Errorf("expected string in workqueue but got %#v", obj))
 			return nil
 		}
+		// The VM may have moved to another replica since it was queued.
+		if !c.ownsKey(key) {
+			c.workqueue.Forget(obj)
+			klog.V(4).Infof("Skipping '%s', owned by another replica", key)
+			return nil
+		}
 		// Run the syncHandler, passing it the namespace/name string of the
 		// VM resource to be synced.
+		start := time.Now()
 		if err := c.syncHandler(key); err != nil {
+			c.metrics.ObserveReconcile(metrics.OutcomeError, time.Since(start))
 			// Put the item back on the workqueue to handle any transient errors.
 			c.workqueue.AddRateLimited(key)
 			return fmt.Errorf("error syncing '%s': %s, requeuing", key, err.Error())
 		}
+		c.metrics.ObserveReconcile(metrics.OutcomeSuccess, time.Since(start))
 		// Finally, if no error occurs we Forget this item so it does not
 		// get queued again until another change happens.
 		c.workqueue.Forget(obj)
@@ -239,6 +563,10 @@ func (c *Controller) syncHandler(key string) error {
 	}
 
 	vmName := vm.Spec.Name
+	if vmName == "" && vm.DeletionTimestamp != nil {
+		// Nothing was ever created for this VM.
+		return c.removeFinalizer(vm)
+	}
 	if vmName == "" {
 		// We choose to absorb the error here as the worker would requeue the
 		// resource otherwise. Instead, the next time the resource is updated
@@ -247,55 +575,232 @@ func (c *Controller) syncHandler(key string) error {
 		return nil
 	}
 
+	if vm.DeletionTimestamp != nil {
+		return c.finalizeVM(key, vm)
+	}
+
 	if c.cloud.IsProhibitedServer(vmName) {
 		utilruntime.HandleError(fmt.Errorf("%s: VM name is prohibited", key))
+		// Resyncs no longer queue the VM, so check the name again later.
+		c.workqueue.AddAfter(key, c.currentSettings().resyncInterval)
 		return nil
 	}
 
-	if !c.cloud.IsExistServer(vmName) {
-		if err := c.cloud.CreateServer(vmName); err != nil {
-			utilruntime.HandleError(fmt.Errorf("%s: Unable to create VM %s", key, err))
-			return nil
+	// Claim the VM before creating anything in the cloud, so a deletion can
+	// never slip past us.
+	if !hasFinalizer(vm) {
+		vm, err = c.addFinalizer(vm)
+		if err != nil {
+			return err
 		}
+	}
+
+	server, err := c.lookupServer(vm, false)
+	if err == vmctl.ErrServerNotFound && vm.Status.VMID != "" {
+		// The server we recorded is gone.
+		recreate, handleErr := c.handleMissingServer(key, vm)
+		if handleErr != nil || !recreate {
+			return handleErr
+		}
+		server, err = c.lookupServer(vm, true)
+	}
+	if err == vmctl.ErrServerNotFound {
+		id, err := c.cloud.CreateServer(vmName, c.ownerOf(vm))
+		if err != nil {
+			return fmt.Errorf("unable to create VM %s: %v", vmName, err)
+		}
+		server = &vmctl.Server{ID: id, Name: vmName, Metadata: c.ownerOf(vm).Metadata()}
 		klog.Infof("Successfully created VM '%s'", vmName)
+	} else if err != nil {
+		return err
+	}
+
+	owned, err := c.claimServer(key, vm, server)
+	if err != nil || !owned {
+		return err
 	}
+	id := server.ID
+
+	if server.Name != vmName {
+		if !isRename(vm, server.Name) {
+			return c.reportIDMismatch(key, vm, &idMismatchError{id: id, name: vmName, serverName: server.Name})
+		}
+		if c.currentSettings().nameChangePolicy != nameChangeRename {
+			return c.rejectNameChange(key, vm, server.Name)
+		}
+		if err := c.cloud.RenameServerByID(id, vmName); err != nil {
+			return err
+		}
+		klog.Infof("Successfully renamed VM '%s' to '%s'", server.Name, vmName)
+	}
+
+	c.reportDrift(vm, server)
 
 	// Finally, we update the status block of the VM resource to reflect the
 	// current state of the world
-	err = c.updateVMStatus(vm, vmName)
+	err = c.updateVMStatus(vm, server)
 	if err != nil {
 		klog.Infof("unable to update VM status %s", err)
 		return err
 	}
 
 	c.recorder.Event(vm, corev1.EventTypeNormal, SuccessSynced, MessageResourceSynced)
+
+	// Status-only updates are filtered out of the event handlers, so schedule
+	// the next check explicitly.
+	c.workqueue.AddAfter(key, c.currentSettings().resyncInterval)
 	return nil
 }
 
-func (c *Controller) updateVMStatus(vm *samplev1alpha1.VM, vmName string) error {
-	uuid, cpuUtilization, err := c.cloud.GetStatus(vmName)
-	if err != nil {
-		utilruntime.HandleError(fmt.Errorf("failed to retrieve vm(%s) status", vmName))
-		return err
+// idMismatchError is returned when the server recorded in the status of a VM
+// no longer carries the name from its spec.
+type idMismatchError struct {
+	id         string
+	name       string
+	serverName string
+}
+
+func (e *idMismatchError) Error() string {
+	return fmt.Sprintf("server %s is named %q, expected %q", e.id, e.serverName, e.name)
+}
+
+// lookupServer returns the server backing a VM. The ID recorded in the
+// status, or claimed through the adopt annotation, is authoritative. The name
+// is only looked up when no ID is known yet, when the claimed server does not
+// exist, or, if fallback is set, when the recorded server is gone.
+func (c *Controller) lookupServer(vm *samplev1alpha1.VM, fallback bool) (*vmctl.Server, error) {
+	if vm.Status.VMID != "" {
+		server, err := c.cloud.GetServerByID(vm.Status.VMID)
+		if err != vmctl.ErrServerNotFound || !fallback {
+			return server, err
+		}
+	} else if id := vm.Annotations[adoptAnnotation]; id != "" {
+		server, err := c.cloud.GetServerByID(id)
+		if err != vmctl.ErrServerNotFound {
+			return server, err
+		}
 	}
 
-	// NEVER modify objects from the store. It's a read-only, local cache.
-	// You can use DeepCopy() to make a deep copy of original object and modify this copy
-	// Or create a copy manually for better performance
-	vmCopy := vm.DeepCopy()
-	vmCopy.Status.VMID = uuid
-	vmCopy.Status.CpuUtilization = cpuUtilization
-	// If the CustomResourceSubresources feature gate is not enabled,
-	// we must use Update instead of UpdateStatus to update the Status block of the VM resource.
-	// UpdateStatus will not allow changes to the Spec of the resource,
-	// which is ideal for ensuring nothing other than resource status has been updated.
-	_, err = c.sampleclientset.SamplecontrollerV1alpha1().VMs(vm.Namespace).Update(vmCopy)
-	if err != nil {
+	return c.cloud.GetServer(vm.Spec.Name, string(vm.UID))
+}
+
+// isRename reports whether a server named serverName that does not match
+// spec.name is explained by an edit of spec.name, rather than by the server
+// being renamed behind our back.
+func isRename(vm *samplev1alpha1.VM, serverName string) bool {
+	return vm.Status.ServerName != "" && vm.Status.ServerName == serverName
+}
+
+// rejectNameChange records a NameChangeRejected condition on a VM whose
+// spec.name was edited. The server keeps its name and stays managed through
+// its recorded ID until the edit is reverted.
+func (c *Controller) rejectNameChange(key string, vm *samplev1alpha1.VM, serverName string) error {
+	message := fmt.Sprintf("spec.name is immutable, change it back to %q", serverName)
+	return c.reportProblem(key, vm, samplev1alpha1.VMNameChangeRejected, ErrNameImmutable, message)
+}
+
+// reportIDMismatch records an IDMismatch condition on the VM.
+func (c *Controller) reportIDMismatch(key string, vm *samplev1alpha1.VM, mismatch *idMismatchError) error {
+	return c.reportProblem(key, vm, samplev1alpha1.VMIDMismatch, ErrIDMismatch, mismatch.Error())
+}
+
+// reportProblem records a warning event and a condition on a VM the
+// controller refuses to act on. The VM is left alone until the problem is
+// resolved, but still refreshed periodically so the condition clears once it
+// is.
+func (c *Controller) reportProblem(key string, vm *samplev1alpha1.VM, condType samplev1alpha1.VMConditionType, reason, message string) error {
+	c.recorder.Event(vm, corev1.EventTypeWarning, reason, message)
+
+	status := vm.Status.DeepCopy()
+	setVMCondition(status, samplev1alpha1.VMCondition{
+		Type:    condType,
+		Status:  corev1.ConditionTrue,
+		Reason:  reason,
+		Message: message,
+	})
+	if err := c.writeVMStatus(vm, *status); err != nil {
 		return err
 	}
+
+	c.workqueue.AddAfter(key, c.currentSettings().resyncInterval)
 	return nil
 }
 
+// updateVMStatus writes the observed state of server to the status
+// subresource.
+func (c *Controller) updateVMStatus(vm *samplev1alpha1.VM, server *vmctl.Server) error {
+	status := vm.Status.DeepCopy()
+	// The status poller, when running, keeps the CPU utilization current,
+	// only fetch it here for a server we have not seen before.
+	if status.VMID != server.ID || c.statusPollInterval == 0 {
+		cpuUtilization, err := c.cloud.GetStatusByID(server.ID)
+		if err != nil {
+			utilruntime.HandleError(fmt.Errorf("failed to retrieve vm(%s) status", server.ID))
+			return err
+		}
+		status.CpuUtilization = cpuUtilization
+	}
+	status.VMID = server.ID
+	status.ServerName = vm.Spec.Name
+	status.Size = server.Size
+	status.PowerState = server.PowerState
+	removeVMCondition(status, samplev1alpha1.VMIDMismatch)
+	removeVMCondition(status, samplev1alpha1.VMNameChangeRejected)
+	removeVMCondition(status, samplev1alpha1.VMConflict)
+	removeVMCondition(status, samplev1alpha1.VMDrifted)
+	return c.writeVMStatus(vm, *status)
+}
+
+// writeVMStatus writes status to the status subresource of a VM. The write is
+// skipped when nothing has changed, and retried against a fresh copy of the
+// VM on conflict.
+func (c *Controller) writeVMStatus(vm *samplev1alpha1.VM, status samplev1alpha1.VMStatus) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		if equality.Semantic.DeepEqual(vm.Status, status) {
+			return nil
+		}
+
+		// NEVER modify objects from the store. It's a read-only, local cache.
+		// You can use DeepCopy() to make a deep copy of original object and modify this copy
+		// Or create a copy manually for better performance
+		vmCopy := vm.DeepCopy()
+		vmCopy.Status = status
+		// UpdateStatus will not allow changes to the Spec of the resource,
+		// which is ideal for ensuring nothing other than resource status has been updated.
+		_, err := c.sampleclientset.SamplecontrollerV1alpha1().VMs(vm.Namespace).UpdateStatus(vmCopy)
+		if errors.IsConflict(err) {
+			// Our copy is stale, fetch the latest version straight from the
+			// API server before trying again.
+			latest, getErr := c.sampleclientset.SamplecontrollerV1alpha1().VMs(vm.Namespace).Get(vm.Name, metav1.GetOptions{})
+			if getErr != nil {
+				return getErr
+			}
+			vm = latest
+		}
+		return err
+	})
+}
+
+// vmNeedsSync reports whether an update of a VM carries changes the
+// controller has to act on. Periodic resyncs and status-only updates are
+// ignored.
+func vmNeedsSync(old, new *samplev1alpha1.VM) bool {
+	if old.ResourceVersion == new.ResourceVersion {
+		return false
+	}
+
+	// The generation is bumped on spec changes. Without the status
+	// subresource it is bumped on status changes too, so check the spec.
+	if old.Generation != new.Generation && !equality.Semantic.DeepEqual(old.Spec, new.Spec) {
+		return true
+	}
+
+	return !equality.Semantic.DeepEqual(old.DeletionTimestamp, new.DeletionTimestamp) ||
+		!equality.Semantic.DeepEqual(old.Finalizers, new.Finalizers) ||
+		!equality.Semantic.DeepEqual(old.Labels, new.Labels) ||
+		!equality.Semantic.DeepEqual(old.Annotations, new.Annotations)
+}
+
 // enqueueVM takes a VM resource and converts it into a namespace/name
 // string which is then put onto the work queue. This method should *not* be
 // passed resources of any type other than VM.
@@ -306,23 +811,152 @@ func (c *Controller) enqueueVM(obj interface{}) {
 		utilruntime.HandleError(err)
 		return
 	}
+	if !c.ownsKey(key) {
+		return
+	}
 	c.workqueue.Add(key)
 }
 
-// handleDelete will call cloud API to delete the VM
-func (c *Controller) handleDelete(obj interface{}) {
-	var vm *samplev1alpha1.VM
+// ownsKey reports whether this replica reconciles the VM with the given key.
+// Without sharding it reconciles them all.
+func (c *Controller) ownsKey(key string) bool {
+	return c.owns == nil || c.owns(key)
+}
 
+// runRebalance queues every VM owned each time the VMs owned may have
+// changed, until stopCh is closed. Those no longer owned are skipped by the
+// workers.
+func (c *Controller) runRebalance(stopCh <-chan struct{}) {
+	for {
+		select {
+		case <-c.rebalance:
+			c.enqueueAll()
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// enqueueAll queues every VM owned.
+func (c *Controller) enqueueAll() {
+	vms, err := c.vmsLister.List(labels.Everything())
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("error listing VMs: %v", err))
+		return
+	}
+	for _, vm := range vms {
+		c.enqueueVM(vm)
+	}
+}
+
+// handleDelete is called once a VM is gone from the API. The cloud server
+// has already been removed by finalizeVM by then, so there is nothing left to
+// clean up.
+func (c *Controller) handleDelete(obj interface{}) {
 	vm, ok := obj.(*samplev1alpha1.VM)
 	if !ok {
-		utilruntime.HandleError(fmt.Errorf("error decoding object, invalid type"))
-		return
+		tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+		if !ok {
+			utilruntime.HandleError(fmt.Errorf("error decoding object, invalid type"))
+			return
+		}
+		vm, ok = tombstone.Obj.(*samplev1alpha1.VM)
+		if !ok {
+			utilruntime.HandleError(fmt.Errorf("error decoding object tombstone, invalid type"))
+			return
+		}
+	}
+
+	c.metrics.EventReceived(metrics.EventDelete)
+	c.metrics.DeleteVM(vm.Namespace, vm.Name)
+	klog.V(4).Infof("VM '%s/%s' deleted", vm.Namespace, vm.Name)
+}
+
+// finalizeVM applies the deletion policy of a VM that is being deleted, and
+// releases the VM once the cloud confirms the server is taken care of. Any
+// error is returned so the VM is requeued and the deletion retried.
+func (c *Controller) finalizeVM(key string, vm *samplev1alpha1.VM) error {
+	if !hasFinalizer(vm) {
+		return nil
+	}
+
+	// Never fall back to the name here: if the recorded server is gone, a
+	// server with the same name is not ours to delete.
+	server, err := c.lookupServer(vm, false)
+	if err == vmctl.ErrServerNotFound {
+		return c.removeFinalizer(vm)
+	}
+	if err != nil {
+		return err
+	}
+	if !ownsServer(vm, server) {
+		// Whatever is out there was never ours.
+		return c.removeFinalizer(vm)
+	}
+	if server.Name != vm.Spec.Name && !isRename(vm, server.Name) {
+		return c.reportIDMismatch(key, vm, &idMismatchError{id: server.ID, name: vm.Spec.Name, serverName: server.Name})
+	}
+	id := server.ID
+
+	// A retained server keeps running and keeps its owner, but is tagged as
+	// retained: it is not collected as orphaned, and may be adopted.
+	if vm.Spec.DeletionPolicy == samplev1alpha1.DeletionPolicyRetain {
+		err := c.cloud.RetainServerByID(id)
+		if err != nil && err != vmctl.ErrServerNotFound {
+			c.recorder.Eventf(vm, corev1.EventTypeWarning, ErrReleaseServer, "Failed to retain server %s: %v", vm.Spec.Name, err)
+			return err
+		}
+		klog.Infof("Retaining VM '%s'", vm.Spec.Name)
+		return c.removeFinalizer(vm)
 	}
 
-	if err := c.cloud.DeleteServer(vm.Spec.Name); err != nil {
-		utilruntime.HandleError(fmt.Errorf("error deleting VM %q", err))
+	if vm.Spec.DeletionPolicy == samplev1alpha1.DeletionPolicyDetach {
+		err := c.cloud.ReleaseServerByID(id)
+		if err != nil && err != vmctl.ErrServerNotFound {
+			c.recorder.Eventf(vm, corev1.EventTypeWarning, ErrReleaseServer, "Failed to detach server %s: %v", vm.Spec.Name, err)
+			return err
+		}
+		klog.Infof("Successfully detached VM '%s'", vm.Spec.Name)
+		return c.removeFinalizer(vm)
 	}
 
+	err = c.cloud.DeleteServerByID(id)
+	if err != nil && err != vmctl.ErrServerNotFound {
+		c.recorder.Eventf(vm, corev1.EventTypeWarning, ErrDeleteServer, "Failed to delete server %s: %v", vm.Spec.Name, err)
+		return err
+	}
 	klog.Infof("Successfully deleted VM '%s'", vm.Spec.Name)
-	return
+
+	return c.removeFinalizer(vm)
+}
+
+func hasFinalizer(vm *samplev1alpha1.VM) bool {
+	for _, f := range vm.Finalizers {
+		if f == vmFinalizer {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Controller) addFinalizer(vm *samplev1alpha1.VM) (*samplev1alpha1.VM, error) {
+	vmCopy := vm.DeepCopy()
+	vmCopy.Finalizers = append(vmCopy.Finalizers, vmFinalizer)
+	return c.sampleclientset.SamplecontrollerV1alpha1().VMs(vm.Namespace).Update(vmCopy)
+}
+
+func (c *Controller) removeFinalizer(vm *samplev1alpha1.VM) error {
+	if !hasFinalizer(vm) {
+		return nil
+	}
+
+	vmCopy := vm.DeepCopy()
+	vmCopy.Finalizers = nil
+	for _, f := range vm.Finalizers {
+		if f != vmFinalizer {
+			vmCopy.Finalizers = append(vmCopy.Finalizers, f)
+		}
+	}
+	_, err := c.sampleclientset.SamplecontrollerV1alpha1().VMs(vm.Namespace).Update(vmCopy)
+	return err
 }
@@ -17,46 +17,243 @@ limitations under the License.
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
-	apps "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/diff"
-	kubeinformers "k8s.io/client-go/informers"
+	"k8s.io/apimachinery/pkg/util/wait"
 	k8sfake "k8s.io/client-go/kubernetes/fake"
 	core "k8s.io/client-go/testing"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
 
 	samplecontroller "k8s.io/sample-controller/pkg/apis/samplecontroller/v1alpha1"
+	vmctl "k8s.io/sample-controller/pkg/cloud"
+	"k8s.io/sample-controller/pkg/config"
 	"k8s.io/sample-controller/pkg/generated/clientset/versioned/fake"
 	informers "k8s.io/sample-controller/pkg/generated/informers/externalversions"
+	vminformers "k8s.io/sample-controller/pkg/generated/informers/externalversions/samplecontroller/v1alpha1"
+	listers "k8s.io/sample-controller/pkg/generated/listers/samplecontroller/v1alpha1"
+	"k8s.io/sample-controller/pkg/metrics"
 )
 
+const testClusterID = "test-cluster"
+
 var (
 	alwaysReady        = func() bool { return true }
 	noResyncPeriodFunc = func() time.Duration { return 0 }
 )
 
+// fakeServer is a server known to the fake cloud.
+type fakeServer struct {
+	ID             string            `json:"id"`
+	Name           string            `json:"name"`
+	Size           string            `json:"size,omitempty"`
+	PowerState     string            `json:"powerState,omitempty"`
+	Metadata       map[string]string `json:"metadata,omitempty"`
+	CpuUtilization int               `json:"cpuUtilization"`
+	MemoryUsage    int64             `json:"-"`
+}
+
+func (s *fakeServer) status() vmctl.ServerStatus {
+	return vmctl.ServerStatus{
+		CpuUtilization:   s.CpuUtilization,
+		MemoryUsageBytes: s.MemoryUsage,
+		UptimeSeconds:    3600,
+	}
+}
+
+// fakeCloud is an in-memory implementation of the cloud REST API.
+type fakeCloud struct {
+	mu         sync.Mutex
+	servers    map[string]*fakeServer
+	prohibited map[string]bool
+	failDelete bool
+	// failCreates is the number of server creations to fail.
+	failCreates int
+	nextID      int
+	// bulkStatus enables the bulk status endpoint.
+	bulkStatus     bool
+	bulkRequests   int
+	statusRequests int
+	listRequests   int
+	// beforeRequest, if set, is called before each request is served.
+	beforeRequest func(r *http.Request)
+	*httptest.Server
+}
+
+func newFakeCloud() *fakeCloud {
+	fc := &fakeCloud{
+		servers:    map[string]*fakeServer{},
+		prohibited: map[string]bool{},
+	}
+	fc.Server = httptest.NewServer(http.HandlerFunc(fc.serveHTTP))
+	return fc
+}
+
+// addOwnedServer registers a server owned by vm in the fake cloud and returns
+// its ID.
+func (fc *fakeCloud) addOwnedServer(vm *samplecontroller.VM, cpuUtilization int) string {
+	id := fc.addServer(vm.Spec.Name, cpuUtilization)
+	fc.servers[id].Metadata = vmctl.Owner{
+		ClusterID: testClusterID,
+		Namespace: vm.Namespace,
+		Name:      vm.Name,
+		UID:       string(vm.UID),
+	}.Metadata()
+	return id
+}
+
+// addServer registers a server in the fake cloud and returns its ID.
+func (fc *fakeCloud) addServer(name string, cpuUtilization int) string {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.nextID++
+	id := fmt.Sprintf("uuid-%d", fc.nextID)
+	fc.servers[id] = &fakeServer{ID: id, Name: name, CpuUtilization: cpuUtilization}
+	return id
+}
+
+func (fc *fakeCloud) byName(name string) *fakeServer {
+	for _, s := range fc.servers {
+		if s.Name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+func (fc *fakeCloud) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if fc.beforeRequest != nil {
+		fc.beforeRequest(r)
+	}
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 2 && parts[0] == "check" && r.Method == http.MethodGet:
+		switch {
+		case fc.prohibited[parts[1]]:
+			w.WriteHeader(http.StatusForbidden)
+		case fc.byName(parts[1]) != nil:
+			w.WriteHeader(http.StatusOK)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	case len(parts) == 1 && parts[0] == "servers" && r.Method == http.MethodGet:
+		fc.listRequests++
+		servers := []*fakeServer{}
+		for _, s := range fc.servers {
+			servers = append(servers, s)
+		}
+		json.NewEncoder(w).Encode(servers)
+	case len(parts) == 1 && parts[0] == "servers" && r.Method == http.MethodPost && fc.failCreates > 0:
+		fc.failCreates--
+		w.WriteHeader(http.StatusInternalServerError)
+	case len(parts) == 1 && parts[0] == "servers" && r.Method == http.MethodPost:
+		s := fakeServer{}
+		json.NewDecoder(r.Body).Decode(&s)
+		fc.nextID++
+		s.ID = fmt.Sprintf("uuid-%d", fc.nextID)
+		fc.servers[s.ID] = &s
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(s)
+	case len(parts) == 2 && parts[0] == "servers" && parts[1] == "status" && r.Method == http.MethodPost && fc.bulkStatus:
+		fc.bulkRequests++
+		request := struct {
+			IDs []string `json:"ids"`
+		}{}
+		json.NewDecoder(r.Body).Decode(&request)
+		statuses := map[string]vmctl.ServerStatus{}
+		for _, id := range request.IDs {
+			if s, ok := fc.servers[id]; ok {
+				statuses[id] = s.status()
+			}
+		}
+		json.NewEncoder(w).Encode(statuses)
+	case len(parts) == 2 && parts[0] == "servers" && r.Method == http.MethodGet:
+		s, ok := fc.servers[parts[1]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(s)
+	case len(parts) == 2 && parts[0] == "servers" && r.Method == http.MethodDelete:
+		if fc.failDelete {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if _, ok := fc.servers[parts[1]]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(fc.servers, parts[1])
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 2 && parts[0] == "servers" && r.Method == http.MethodPut:
+		s, ok := fc.servers[parts[1]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		// The server is replaced with what is put.
+		update := fakeServer{}
+		json.NewDecoder(r.Body).Decode(&update)
+		s.Name, s.Size, s.PowerState, s.Metadata = update.Name, update.Size, update.PowerState, update.Metadata
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 3 && parts[0] == "servers" && parts[2] == "metadata" && r.Method == http.MethodPut:
+		s, ok := fc.servers[parts[1]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		s.Metadata = map[string]string{}
+		json.NewDecoder(r.Body).Decode(&s.Metadata)
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 3 && parts[0] == "servers" && parts[2] == "status" && r.Method == http.MethodGet:
+		s, ok := fc.servers[parts[1]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fc.statusRequests++
+		json.NewEncoder(w).Encode(s.status())
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
 type fixture struct {
 	t *testing.T
 
 	client     *fake.Clientset
 	kubeclient *k8sfake.Clientset
+	cloud      *fakeCloud
 	// Objects to put in the store.
-	fooLister        []*samplecontroller.Foo
-	deploymentLister []*apps.Deployment
+	vmLister []*samplecontroller.VM
 	// Actions expected to happen on the client.
-	kubeactions []core.Action
-	actions     []core.Action
+	actions []core.Action
 	// Objects from here preloaded into NewSimpleFake.
 	kubeobjects []runtime.Object
 	objects     []runtime.Object
+	// setup, if set, is called on the controller before it is run.
+	setup func(c *Controller)
 }
 
 func newFixture(t *testing.T) *fixture {
@@ -64,70 +261,72 @@ func newFixture(t *testing.T) *fixture {
 	f.t = t
 	f.objects = []runtime.Object{}
 	f.kubeobjects = []runtime.Object{}
+	f.cloud = newFakeCloud()
 	return f
 }
 
-func newFoo(name string, replicas *int32) *samplecontroller.Foo {
-	return &samplecontroller.Foo{
+func newVM(name string) *samplecontroller.VM {
+	return &samplecontroller.VM{
 		TypeMeta: metav1.TypeMeta{APIVersion: samplecontroller.SchemeGroupVersion.String()},
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      name,
 			Namespace: metav1.NamespaceDefault,
+			UID:       types.UID(name + "-uid"),
 		},
-		Spec: samplecontroller.FooSpec{
-			DeploymentName: fmt.Sprintf("%s-deployment", name),
-			Replicas:       replicas,
+		Spec: samplecontroller.VMSpec{
+			Name: fmt.Sprintf("%s-server", name),
 		},
 	}
 }
 
-func (f *fixture) newController() (*Controller, informers.SharedInformerFactory, kubeinformers.SharedInformerFactory) {
+func (f *fixture) newController() (*Controller, informers.SharedInformerFactory) {
 	f.client = fake.NewSimpleClientset(f.objects...)
 	f.kubeclient = k8sfake.NewSimpleClientset(f.kubeobjects...)
 
 	i := informers.NewSharedInformerFactory(f.client, noResyncPeriodFunc())
-	k8sI := kubeinformers.NewSharedInformerFactory(f.kubeclient, noResyncPeriodFunc())
 
 	c := NewController(f.kubeclient, f.client,
-		k8sI.Apps().V1().Deployments(), i.Samplecontroller().V1alpha1().Foos())
+		f.cloud.URL, map[string]vminformers.VMInformer{metav1.NamespaceAll: i.Samplecontroller().V1alpha1().VMs()},
+		workqueue.DefaultControllerRateLimiter(), metrics.New())
 
-	c.foosSynced = alwaysReady
-	c.deploymentsSynced = alwaysReady
+	c.vmsSynced = alwaysReady
 	c.recorder = &record.FakeRecorder{}
+	c.clusterID = testClusterID
 
-	for _, f := range f.fooLister {
-		i.Samplecontroller().V1alpha1().Foos().Informer().GetIndexer().Add(f)
+	for _, vm := range f.vmLister {
+		i.Samplecontroller().V1alpha1().VMs().Informer().GetIndexer().Add(vm)
 	}
 
-	for _, d := range f.deploymentLister {
-		k8sI.Apps().V1().Deployments().Informer().GetIndexer().Add(d)
+	if f.setup != nil {
+		f.setup(c)
 	}
 
-	return c, i, k8sI
+	return c, i
 }
 
-func (f *fixture) run(fooName string) {
-	f.runController(fooName, true, false)
+func (f *fixture) run(vmName string) {
+	f.runController(vmName, true, false)
 }
 
-func (f *fixture) runExpectError(fooName string) {
-	f.runController(fooName, true, true)
+func (f *fixture) runExpectError(vmName string) {
+	f.runController(vmName, true, true)
 }
 
-func (f *fixture) runController(fooName string, startInformers bool, expectError bool) {
-	c, i, k8sI := f.newController()
+func (f *fixture) runController(vmName string, startInformers bool, expectError bool) {
+	defer f.cloud.Close()
+
+	c, i := f.newController()
 	if startInformers {
 		stopCh := make(chan struct{})
 		defer close(stopCh)
 		i.Start(stopCh)
-		k8sI.Start(stopCh)
 	}
 
-	err := c.syncHandler(fooName)
+	err := c.syncHandler(vmName)
 	if !expectError && err != nil {
-		f.t.Errorf("error syncing foo: %v", err)
+		f.t.Errorf("error syncing vm: %v", err)
 	} else if expectError && err == nil {
-		f.t.Error("expected error syncing foo, got nil")
+		f.t.Error("expected error syncing vm, got nil")
 	}
 
 	actions := filterInformerActions(f.client.Actions())
@@ -144,21 +343,6 @@ func (f *fixture) runController(fooName string, startInformers bool, expectError
 	if len(f.actions) > len(actions) {
 		f.t.Errorf("%d additional expected actions:%+v", len(f.actions)-len(actions), f.actions[len(actions):])
 	}
-
-	k8sActions := filterInformerActions(f.kubeclient.Actions())
-	for i, action := range k8sActions {
-		if len(f.kubeactions) < i+1 {
-			f.t.Errorf("%d unexpected actions: %+v", len(k8sActions)-len(f.kubeactions), k8sActions[i:])
-			break
-		}
-
-		expectedAction := f.kubeactions[i]
-		checkAction(expectedAction, action, f.t)
-	}
-
-	if len(f.kubeactions) > len(k8sActions) {
-		f.t.Errorf("%d additional expected actions:%+v", len(f.kubeactions)-len(k8sActions), f.kubeactions[len(k8sActions):])
-	}
 }
 
 // checkAction verifies that expected and actual actions are equal and both have
@@ -212,10 +396,8 @@ func filterInformerActions(actions []core.Action) []core.Action {
 	ret := []core.Action{}
 	for _, action := range actions {
 		if len(action.GetNamespace()) == 0 &&
-			(action.Matches("list", "foos") ||
-				action.Matches("watch", "foos") ||
-				action.Matches("list", "deployments") ||
-				action.Matches("watch", "deployments")) {
+			(action.Matches("list", "vms") ||
+				action.Matches("watch", "vms")) {
 			continue
 		}
 		ret = append(ret, action)
@@ -224,90 +406,1285 @@ func filterInformerActions(actions []core.Action) []core.Action {
 	return ret
 }
 
-func (f *fixture) expectCreateDeploymentAction(d *apps.Deployment) {
-	f.kubeactions = append(f.kubeactions, core.NewCreateAction(schema.GroupVersionResource{Resource: "deployments"}, d.Namespace, d))
+func (f *fixture) expectUpdateVMStatusAction(vm *samplecontroller.VM) {
+	action := core.NewUpdateSubresourceAction(schema.GroupVersionResource{Resource: "vms"}, "status", vm.Namespace, vm)
+	f.actions = append(f.actions, action)
 }
 
-func (f *fixture) expectUpdateDeploymentAction(d *apps.Deployment) {
-	f.kubeactions = append(f.kubeactions, core.NewUpdateAction(schema.GroupVersionResource{Resource: "deployments"}, d.Namespace, d))
+func (f *fixture) expectUpdateVMAction(vm *samplecontroller.VM) {
+	f.actions = append(f.actions, core.NewUpdateAction(schema.GroupVersionResource{Resource: "vms"}, vm.Namespace, vm))
 }
 
-func (f *fixture) expectUpdateFooStatusAction(foo *samplecontroller.Foo) {
-	action := core.NewUpdateAction(schema.GroupVersionResource{Resource: "foos"}, foo.Namespace, foo)
-	// TODO: Until #38113 is merged, we can't use Subresource
-	//action.Subresource = "status"
-	f.actions = append(f.actions, action)
+func (f *fixture) expectGetVMAction(vm *samplecontroller.VM) {
+	f.actions = append(f.actions, core.NewGetAction(schema.GroupVersionResource{Resource: "vms"}, vm.Namespace, vm.Name))
+}
+
+// expectCondition checks that the only write was a status update setting a
+// condition of the given type.
+func (f *fixture) expectCondition(condType samplecontroller.VMConditionType) {
+	var actions []core.Action
+	for _, action := range filterInformerActions(f.client.Actions()) {
+		if action.GetVerb() != "get" {
+			actions = append(actions, action)
+		}
+	}
+	if len(actions) != 1 {
+		f.t.Fatalf("expected 1 action, got %d: %+v", len(actions), actions)
+	}
+	updated := actions[0].(core.UpdateAction).GetObject().(*samplecontroller.VM)
+	cond := getVMCondition(&updated.Status, condType)
+	if cond == nil || cond.Status != corev1.ConditionTrue {
+		f.t.Errorf("expected %s condition, got %+v", condType, updated.Status.Conditions)
+	}
 }
 
-func getKey(foo *samplecontroller.Foo, t *testing.T) string {
-	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(foo)
+func getKey(vm *samplecontroller.VM, t *testing.T) string {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(vm)
 	if err != nil {
-		t.Errorf("Unexpected error getting key for foo %v: %v", foo.Name, err)
+		t.Errorf("Unexpected error getting key for vm %v: %v", vm.Name, err)
 		return ""
 	}
 	return key
 }
 
-func TestCreatesDeployment(t *testing.T) {
+func TestCreatesServer(t *testing.T) {
 	f := newFixture(t)
-	foo := newFoo("test", int32Ptr(1))
+	vm := newVM("test")
 
-	f.fooLister = append(f.fooLister, foo)
-	f.objects = append(f.objects, foo)
+	f.vmLister = append(f.vmLister, vm)
+	f.objects = append(f.objects, vm)
 
-	expDeployment := newDeployment(foo)
-	f.expectCreateDeploymentAction(expDeployment)
-	f.expectUpdateFooStatusAction(foo)
+	expVM := vm.DeepCopy()
+	expVM.Finalizers = []string{vmFinalizer}
+	f.expectUpdateVMAction(expVM)
+	expVM = expVM.DeepCopy()
+	expVM.Status.VMID = "uuid-1"
+	expVM.Status.ServerName = vm.Spec.Name
+	f.expectUpdateVMStatusAction(expVM)
 
-	f.run(getKey(foo, t))
+	f.run(getKey(vm, t))
+
+	server := f.cloud.byName(vm.Spec.Name)
+	if len(f.cloud.servers) != 1 || server == nil {
+		t.Fatalf("expected server %q to be created, got %+v", vm.Spec.Name, f.cloud.servers)
+	}
+	expOwner := map[string]string{
+		vmctl.OwnerClusterIDKey: testClusterID,
+		vmctl.OwnerNamespaceKey: vm.Namespace,
+		vmctl.OwnerNameKey:      vm.Name,
+		vmctl.OwnerUIDKey:       string(vm.UID),
+	}
+	if !reflect.DeepEqual(server.Metadata, expOwner) {
+		t.Errorf("expected server to be stamped with its owner, got %v", server.Metadata)
+	}
+}
+
+func TestUpdatesStatus(t *testing.T) {
+	f := newFixture(t)
+	vm := newVM("test")
+	vm.Finalizers = []string{vmFinalizer}
+	id := f.cloud.addOwnedServer(vm, 42)
+
+	f.vmLister = append(f.vmLister, vm)
+	f.objects = append(f.objects, vm)
+
+	expVM := vm.DeepCopy()
+	expVM.Status.VMID = id
+	expVM.Status.CpuUtilization = 42
+	expVM.Status.ServerName = vm.Spec.Name
+	f.expectUpdateVMStatusAction(expVM)
+
+	f.run(getKey(vm, t))
 }
 
 func TestDoNothing(t *testing.T) {
 	f := newFixture(t)
-	foo := newFoo("test", int32Ptr(1))
-	d := newDeployment(foo)
+	vm := newVM("test")
+	vm.Finalizers = []string{vmFinalizer}
+	id := f.cloud.addOwnedServer(vm, 42)
+	vm.Status.VMID = id
+	vm.Status.CpuUtilization = 42
+	vm.Status.ServerName = vm.Spec.Name
+
+	f.vmLister = append(f.vmLister, vm)
+	f.objects = append(f.objects, vm)
+
+	f.run(getKey(vm, t))
+}
+
+func TestUpdatesCPUWithoutPoller(t *testing.T) {
+	f := newFixture(t)
+	vm := newVM("test")
+	vm.Finalizers = []string{vmFinalizer}
+	id := f.cloud.addOwnedServer(vm, 42)
+	vm.Status.VMID = id
+	vm.Status.CpuUtilization = 10
+	vm.Status.ServerName = vm.Spec.Name
+
+	f.vmLister = append(f.vmLister, vm)
+	f.objects = append(f.objects, vm)
+
+	expVM := vm.DeepCopy()
+	expVM.Status.CpuUtilization = 42
+	f.expectUpdateVMStatusAction(expVM)
+
+	f.setup = func(c *Controller) {
+		c.statusPollInterval = 0
+	}
+	f.run(getKey(vm, t))
+}
+
+func TestLooksUpRecordedServerByID(t *testing.T) {
+	f := newFixture(t)
+	vm := newVM("test")
+	vm.Finalizers = []string{vmFinalizer}
+	id := f.cloud.addOwnedServer(vm, 42)
+	vm.Status.VMID = id
+	vm.Status.CpuUtilization = 42
+	vm.Status.ServerName = vm.Spec.Name
+
+	f.vmLister = append(f.vmLister, vm)
+	f.objects = append(f.objects, vm)
+
+	f.run(getKey(vm, t))
+
+	if f.cloud.listRequests != 0 {
+		t.Errorf("expected the recorded server to be fetched by ID, got %d lists", f.cloud.listRequests)
+	}
+}
+
+func TestPrefersOwnedServerByName(t *testing.T) {
+	f := newFixture(t)
+	vm := newVM("test")
+	vm.Finalizers = []string{vmFinalizer}
+	// Another server of the same name may be listed first.
+	f.cloud.addOwnedServer(newVM("other"), 0)
+	f.cloud.servers["uuid-1"].Name = vm.Spec.Name
+	id := f.cloud.addOwnedServer(vm, 42)
+
+	f.vmLister = append(f.vmLister, vm)
+	f.objects = append(f.objects, vm)
+
+	expVM := vm.DeepCopy()
+	expVM.Status.VMID = id
+	expVM.Status.CpuUtilization = 42
+	expVM.Status.ServerName = vm.Spec.Name
+	f.expectUpdateVMStatusAction(expVM)
+
+	f.run(getKey(vm, t))
+}
+
+func TestUpdateStatusRetriesOnConflict(t *testing.T) {
+	f := newFixture(t)
+	vm := newVM("test")
+	vm.Finalizers = []string{vmFinalizer}
+	id := f.cloud.addOwnedServer(vm, 42)
+
+	f.vmLister = append(f.vmLister, vm)
+	f.objects = append(f.objects, vm)
+
+	expVM := vm.DeepCopy()
+	expVM.Status.VMID = id
+	expVM.Status.CpuUtilization = 42
+	expVM.Status.ServerName = vm.Spec.Name
+	f.expectUpdateVMStatusAction(expVM)
+	f.expectGetVMAction(vm)
+	f.expectUpdateVMStatusAction(expVM)
+
+	conflicted := false
+	f.setup = func(c *Controller) {
+		f.client.PrependReactor("update", "vms", func(action core.Action) (bool, runtime.Object, error) {
+			if conflicted {
+				return false, nil, nil
+			}
+			conflicted = true
+			return true, nil, errors.NewConflict(schema.GroupResource{Resource: "vms"}, vm.Name, fmt.Errorf("stale"))
+		})
+	}
+
+	f.run(getKey(vm, t))
+}
+
+func TestProhibitedServer(t *testing.T) {
+	f := newFixture(t)
+	vm := newVM("test")
+	f.cloud.prohibited[vm.Spec.Name] = true
+
+	f.vmLister = append(f.vmLister, vm)
+	f.objects = append(f.objects, vm)
+
+	f.run(getKey(vm, t))
+
+	if len(f.cloud.servers) != 0 {
+		t.Errorf("expected no server to be created, got %+v", f.cloud.servers)
+	}
+}
+
+func TestRetriesFailedCreate(t *testing.T) {
+	f := newFixture(t)
+	defer f.cloud.Close()
+	vm := newVM("test")
+	vm.Finalizers = []string{vmFinalizer}
+	f.cloud.failCreates = 1
+
+	f.vmLister = append(f.vmLister, vm)
+	f.objects = append(f.objects, vm)
+
+	c, _ := f.newController()
+	c.workqueue.Add(getKey(vm, t))
+	c.processNextWorkItem()
+	if len(f.cloud.servers) != 0 {
+		t.Fatalf("expected the creation to fail, got %+v", f.cloud.servers)
+	}
+
+	// The failure is retried without waiting for the VM to change.
+	c.processNextWorkItem()
+	if f.cloud.byName(vm.Spec.Name) == nil {
+		t.Errorf("expected the creation to be retried, got %+v", f.cloud.servers)
+	}
+}
+
+func TestDeletesServerBeforeReleasingVM(t *testing.T) {
+	f := newFixture(t)
+	vm := newVM("test")
+	now := metav1.Now()
+	vm.DeletionTimestamp = &now
+	vm.Finalizers = []string{vmFinalizer}
+	f.cloud.addOwnedServer(vm, 42)
+
+	f.vmLister = append(f.vmLister, vm)
+	f.objects = append(f.objects, vm)
+
+	expVM := vm.DeepCopy()
+	expVM.Finalizers = nil
+	f.expectUpdateVMAction(expVM)
+
+	f.run(getKey(vm, t))
+
+	if len(f.cloud.servers) != 0 {
+		t.Errorf("expected server to be deleted, got %+v", f.cloud.servers)
+	}
+}
+
+func TestReleasesVMWhenServerAlreadyGone(t *testing.T) {
+	f := newFixture(t)
+	vm := newVM("test")
+	now := metav1.Now()
+	vm.DeletionTimestamp = &now
+	vm.Finalizers = []string{"other", vmFinalizer}
+
+	f.vmLister = append(f.vmLister, vm)
+	f.objects = append(f.objects, vm)
+
+	expVM := vm.DeepCopy()
+	expVM.Finalizers = []string{"other"}
+	f.expectUpdateVMAction(expVM)
+
+	f.run(getKey(vm, t))
+}
+
+func TestDeletesServerByRecordedID(t *testing.T) {
+	f := newFixture(t)
+	vm := newVM("test")
+	now := metav1.Now()
+	vm.DeletionTimestamp = &now
+	vm.Finalizers = []string{vmFinalizer}
+	other := f.cloud.addServer(vm.Spec.Name, 1)
+	vm.Status.VMID = f.cloud.addServer(vm.Spec.Name, 42)
+
+	f.vmLister = append(f.vmLister, vm)
+	f.objects = append(f.objects, vm)
+
+	expVM := vm.DeepCopy()
+	expVM.Finalizers = nil
+	f.expectUpdateVMAction(expVM)
+
+	f.run(getKey(vm, t))
+
+	if _, ok := f.cloud.servers[vm.Status.VMID]; ok {
+		t.Errorf("expected server %s to be deleted", vm.Status.VMID)
+	}
+	if _, ok := f.cloud.servers[other]; !ok {
+		t.Errorf("expected server %s with the same name to be kept", other)
+	}
+}
+
+func TestDoesNotDeleteByNameWhenRecordedServerIsGone(t *testing.T) {
+	f := newFixture(t)
+	vm := newVM("test")
+	now := metav1.Now()
+	vm.DeletionTimestamp = &now
+	vm.Finalizers = []string{vmFinalizer}
+	vm.Status.VMID = "gone"
+	other := f.cloud.addServer(vm.Spec.Name, 1)
+
+	f.vmLister = append(f.vmLister, vm)
+	f.objects = append(f.objects, vm)
+
+	expVM := vm.DeepCopy()
+	expVM.Finalizers = nil
+	f.expectUpdateVMAction(expVM)
+
+	f.run(getKey(vm, t))
+
+	if _, ok := f.cloud.servers[other]; !ok {
+		t.Errorf("expected server %s to be kept", other)
+	}
+}
+
+func TestReportsIDMismatch(t *testing.T) {
+	f := newFixture(t)
+	vm := newVM("test")
+	vm.Finalizers = []string{vmFinalizer}
+	vm.Status.VMID = f.cloud.addServer("renamed", 42)
+
+	f.vmLister = append(f.vmLister, vm)
+	f.objects = append(f.objects, vm)
+
+	c, _ := f.newController()
+	defer f.cloud.Close()
+
+	if err := c.syncHandler(getKey(vm, t)); err != nil {
+		t.Fatalf("error syncing vm: %v", err)
+	}
+
+	f.expectCondition(samplecontroller.VMIDMismatch)
+	if len(f.cloud.servers) != 1 {
+		t.Errorf("expected no server to be created, got %+v", f.cloud.servers)
+	}
+}
+
+func TestRejectsNameChange(t *testing.T) {
+	f := newFixture(t)
+	vm := newVM("test")
+	vm.Finalizers = []string{vmFinalizer}
+	vm.Status.VMID = f.cloud.addServer(vm.Spec.Name, 42)
+	vm.Status.ServerName = vm.Spec.Name
+	vm.Spec.Name = "new-name"
+
+	f.vmLister = append(f.vmLister, vm)
+	f.objects = append(f.objects, vm)
+
+	c, _ := f.newController()
+	defer f.cloud.Close()
+
+	if err := c.syncHandler(getKey(vm, t)); err != nil {
+		t.Fatalf("error syncing vm: %v", err)
+	}
+
+	f.expectCondition(samplecontroller.VMNameChangeRejected)
+	if len(f.cloud.servers) != 1 || f.cloud.servers[vm.Status.VMID].Name != "test-server" {
+		t.Errorf("expected server to keep its name, got %+v", f.cloud.servers)
+	}
+}
+
+func TestRenamesServer(t *testing.T) {
+	f := newFixture(t)
+	vm := newVM("test")
+	vm.Finalizers = []string{vmFinalizer}
+	id := f.cloud.addOwnedServer(vm, 42)
+	vm.Status.VMID = id
+	vm.Status.CpuUtilization = 42
+	vm.Status.ServerName = vm.Spec.Name
+	vm.Spec.Name = "new-name"
+
+	f.vmLister = append(f.vmLister, vm)
+	f.objects = append(f.objects, vm)
+
+	expVM := vm.DeepCopy()
+	expVM.Status.ServerName = "new-name"
+	f.expectUpdateVMStatusAction(expVM)
+
+	f.setup = func(c *Controller) {
+		c.settings.nameChangePolicy = nameChangeRename
+	}
+
+	f.run(getKey(vm, t))
+
+	if len(f.cloud.servers) != 1 || f.cloud.servers[id].Name != "new-name" {
+		t.Errorf("expected server to be renamed in place, got %+v", f.cloud.servers)
+	}
+	if owner := f.cloud.servers[id].Metadata[vmctl.OwnerUIDKey]; owner != string(vm.UID) {
+		t.Errorf("expected the renamed server to keep its owner, got %q", owner)
+	}
+}
+
+func TestRejectsUnownedNameCollision(t *testing.T) {
+	f := newFixture(t)
+	vm := newVM("test")
+	vm.Finalizers = []string{vmFinalizer}
+	id := f.cloud.addServer(vm.Spec.Name, 42)
+
+	f.vmLister = append(f.vmLister, vm)
+	f.objects = append(f.objects, vm)
+
+	c, _ := f.newController()
+	defer f.cloud.Close()
+	if err := c.syncHandler(getKey(vm, t)); err != nil {
+		t.Fatalf("error syncing vm: %v", err)
+	}
+
+	f.expectCondition(samplecontroller.VMConflict)
+	if len(f.cloud.servers) != 1 || len(f.cloud.servers[id].Metadata) != 0 {
+		t.Errorf("expected server to be left alone, got %+v", f.cloud.servers[id])
+	}
+}
+
+func TestRejectsServerOwnedByOtherVM(t *testing.T) {
+	f := newFixture(t)
+	vm := newVM("test")
+	vm.Finalizers = []string{vmFinalizer}
+	vm.Spec.Adopt = true
+	other := newVM("other")
+	f.cloud.addOwnedServer(other, 42)
+	vm.Spec.Name = "other-server"
+
+	f.vmLister = append(f.vmLister, vm)
+	f.objects = append(f.objects, vm, other)
+
+	c, _ := f.newController()
+	defer f.cloud.Close()
+	if err := c.syncHandler(getKey(vm, t)); err != nil {
+		t.Fatalf("error syncing vm: %v", err)
+	}
+
+	f.expectCondition(samplecontroller.VMConflict)
+}
+
+func TestRejectsSameNameInOtherNamespace(t *testing.T) {
+	f := newFixture(t)
+	owner := newVM("test")
+	f.cloud.addOwnedServer(owner, 42)
+
+	vm := newVM("test")
+	vm.Namespace = "other"
+	vm.UID = "other-uid"
+	vm.Finalizers = []string{vmFinalizer}
+
+	f.vmLister = append(f.vmLister, vm)
+	f.objects = append(f.objects, vm)
+
+	c, _ := f.newController()
+	defer f.cloud.Close()
+	if err := c.syncHandler(getKey(vm, t)); err != nil {
+		t.Fatalf("error syncing vm: %v", err)
+	}
+
+	f.expectCondition(samplecontroller.VMConflict)
+	if len(f.cloud.servers) != 1 {
+		t.Errorf("expected no server to be created, got %+v", f.cloud.servers)
+	}
+}
+
+func TestAdoptsServerByName(t *testing.T) {
+	f := newFixture(t)
+	vm := newVM("test")
+	vm.Finalizers = []string{vmFinalizer}
+	vm.Spec.Adopt = true
+	id := f.cloud.addServer(vm.Spec.Name, 42)
+
+	f.vmLister = append(f.vmLister, vm)
+	f.objects = append(f.objects, vm)
+
+	expVM := vm.DeepCopy()
+	expVM.Status.VMID = id
+	expVM.Status.CpuUtilization = 42
+	expVM.Status.ServerName = vm.Spec.Name
+	f.expectUpdateVMStatusAction(expVM)
+
+	f.run(getKey(vm, t))
+
+	if f.cloud.servers[id].Metadata[vmctl.OwnerUIDKey] != string(vm.UID) {
+		t.Errorf("expected server to be tagged as owned, got %v", f.cloud.servers[id].Metadata)
+	}
+}
+
+func TestAdoptsServerByID(t *testing.T) {
+	f := newFixture(t)
+	vm := newVM("test")
+	vm.Finalizers = []string{vmFinalizer}
+	f.cloud.addServer(vm.Spec.Name, 1)
+	id := f.cloud.addServer(vm.Spec.Name, 42)
+	vm.Annotations = map[string]string{adoptAnnotation: id}
+
+	f.vmLister = append(f.vmLister, vm)
+	f.objects = append(f.objects, vm)
+
+	expVM := vm.DeepCopy()
+	expVM.Status.VMID = id
+	expVM.Status.CpuUtilization = 42
+	expVM.Status.ServerName = vm.Spec.Name
+	f.expectUpdateVMStatusAction(expVM)
+
+	f.run(getKey(vm, t))
+
+	if f.cloud.servers[id].Metadata[vmctl.OwnerUIDKey] != string(vm.UID) {
+		t.Errorf("expected server to be tagged as owned, got %v", f.cloud.servers[id].Metadata)
+	}
+}
+
+func TestDoesNotDeleteUnownedServer(t *testing.T) {
+	f := newFixture(t)
+	vm := newVM("test")
+	now := metav1.Now()
+	vm.DeletionTimestamp = &now
+	vm.Finalizers = []string{vmFinalizer}
+	id := f.cloud.addServer(vm.Spec.Name, 42)
+
+	f.vmLister = append(f.vmLister, vm)
+	f.objects = append(f.objects, vm)
+
+	expVM := vm.DeepCopy()
+	expVM.Finalizers = nil
+	f.expectUpdateVMAction(expVM)
+
+	f.run(getKey(vm, t))
+
+	if _, ok := f.cloud.servers[id]; !ok {
+		t.Errorf("expected unowned server %s to be kept", id)
+	}
+}
+
+func TestRecreatesMissingServer(t *testing.T) {
+	f := newFixture(t)
+	vm := newVM("test")
+	vm.Finalizers = []string{vmFinalizer}
+	vm.Status.VMID = "gone"
+	vm.Status.ServerName = vm.Spec.Name
+
+	f.vmLister = append(f.vmLister, vm)
+	f.objects = append(f.objects, vm)
+
+	expVM := vm.DeepCopy()
+	expVM.Status.VMID = "uuid-1"
+	f.expectUpdateVMStatusAction(expVM)
+
+	recorder := record.NewFakeRecorder(10)
+	f.setup = func(c *Controller) {
+		c.recorder = recorder
+	}
+	f.run(getKey(vm, t))
+
+	if f.cloud.byName(vm.Spec.Name) == nil {
+		t.Errorf("expected server to be recreated, got %+v", f.cloud.servers)
+	}
+	if event := <-recorder.Events; !strings.Contains(event, ServerRecreated) {
+		t.Errorf("expected %s event, got %q", ServerRecreated, event)
+	}
+}
+
+func TestReportsMissingServer(t *testing.T) {
+	f := newFixture(t)
+	vm := newVM("test")
+	vm.Finalizers = []string{vmFinalizer}
+	vm.Spec.DriftPolicy = samplecontroller.DriftPolicyReport
+	vm.Status.VMID = "gone"
+	vm.Status.ServerName = vm.Spec.Name
+
+	f.vmLister = append(f.vmLister, vm)
+	f.objects = append(f.objects, vm)
+
+	c, _ := f.newController()
+	defer f.cloud.Close()
+	if err := c.syncHandler(getKey(vm, t)); err != nil {
+		t.Fatalf("error syncing vm: %v", err)
+	}
+
+	f.expectCondition(samplecontroller.VMDrifted)
+	if len(f.cloud.servers) != 0 {
+		t.Errorf("expected server not to be recreated, got %+v", f.cloud.servers)
+	}
+}
+
+func TestIgnoresMissingServer(t *testing.T) {
+	f := newFixture(t)
+	vm := newVM("test")
+	vm.Finalizers = []string{vmFinalizer}
+	vm.Spec.DriftPolicy = samplecontroller.DriftPolicyIgnore
+	vm.Status.VMID = "gone"
+	vm.Status.ServerName = vm.Spec.Name
+
+	f.vmLister = append(f.vmLister, vm)
+	f.objects = append(f.objects, vm)
+
+	recorder := record.NewFakeRecorder(10)
+	f.setup = func(c *Controller) {
+		c.recorder = recorder
+	}
+	c, _ := f.newController()
+	defer f.cloud.Close()
+	if err := c.syncHandler(getKey(vm, t)); err != nil {
+		t.Fatalf("error syncing vm: %v", err)
+	}
+
+	f.expectCondition(samplecontroller.VMDrifted)
+	if len(f.cloud.servers) != 0 {
+		t.Errorf("expected server not to be recreated, got %+v", f.cloud.servers)
+	}
+	if len(recorder.Events) != 0 {
+		t.Errorf("expected no event, got %q", <-recorder.Events)
+	}
+}
+
+func TestReportsChangedSizeAndPowerState(t *testing.T) {
+	f := newFixture(t)
+	vm := newVM("test")
+	vm.Finalizers = []string{vmFinalizer}
+	id := f.cloud.addOwnedServer(vm, 42)
+	f.cloud.servers[id].Size = "large"
+	f.cloud.servers[id].PowerState = "stopped"
+	vm.Status.VMID = id
+	vm.Status.CpuUtilization = 42
+	vm.Status.ServerName = vm.Spec.Name
+	vm.Status.Size = "small"
+	vm.Status.PowerState = "running"
+
+	f.vmLister = append(f.vmLister, vm)
+	f.objects = append(f.objects, vm)
+
+	expVM := vm.DeepCopy()
+	expVM.Status.Size = "large"
+	expVM.Status.PowerState = "stopped"
+	f.expectUpdateVMStatusAction(expVM)
+
+	recorder := record.NewFakeRecorder(10)
+	f.setup = func(c *Controller) {
+		c.recorder = recorder
+	}
+	f.run(getKey(vm, t))
+
+	for _, want := range []string{"Size of server", "Power state of server"} {
+		if event := <-recorder.Events; !strings.Contains(event, ServerDrifted) || !strings.Contains(event, want) {
+			t.Errorf("expected %s event about %q, got %q", ServerDrifted, want, event)
+		}
+	}
+}
+
+func TestReportsDriftFromSpec(t *testing.T) {
+	f := newFixture(t)
+	vm := newVM("test")
+	vm.Finalizers = []string{vmFinalizer}
+	vm.Spec.Size = "small"
+	vm.Spec.PowerState = "running"
+	id := f.cloud.addOwnedServer(vm, 42)
+	f.cloud.servers[id].Size = "large"
+	f.cloud.servers[id].PowerState = "running"
+	vm.Status.VMID = id
+	vm.Status.CpuUtilization = 42
+	vm.Status.ServerName = vm.Spec.Name
+	// The server was never seen at the size of the spec.
+	vm.Status.PowerState = "running"
+
+	f.vmLister = append(f.vmLister, vm)
+	f.objects = append(f.objects, vm)
 
-	f.fooLister = append(f.fooLister, foo)
-	f.objects = append(f.objects, foo)
-	f.deploymentLister = append(f.deploymentLister, d)
-	f.kubeobjects = append(f.kubeobjects, d)
+	expVM := vm.DeepCopy()
+	expVM.Status.Size = "large"
+	f.expectUpdateVMStatusAction(expVM)
 
-	f.expectUpdateFooStatusAction(foo)
-	f.run(getKey(foo, t))
+	recorder := record.NewFakeRecorder(10)
+	f.setup = func(c *Controller) {
+		c.recorder = recorder
+	}
+	f.run(getKey(vm, t))
+
+	if event := <-recorder.Events; !strings.Contains(event, "Size of server "+id+" is large, expected small") {
+		t.Errorf("expected %s event about the size, got %q", ServerDrifted, event)
+	}
+	if event := <-recorder.Events; !strings.Contains(event, SuccessSynced) {
+		t.Errorf("expected no drift of the power state, got %q", event)
+	}
 }
 
-func TestUpdateDeployment(t *testing.T) {
+func TestRetainsServer(t *testing.T) {
 	f := newFixture(t)
-	foo := newFoo("test", int32Ptr(1))
-	d := newDeployment(foo)
+	vm := newVM("test")
+	now := metav1.Now()
+	vm.DeletionTimestamp = &now
+	vm.Finalizers = []string{vmFinalizer}
+	vm.Spec.DeletionPolicy = samplecontroller.DeletionPolicyRetain
+	id := f.cloud.addOwnedServer(vm, 42)
+
+	f.vmLister = append(f.vmLister, vm)
+	f.objects = append(f.objects, vm)
+
+	expVM := vm.DeepCopy()
+	expVM.Finalizers = nil
+	f.expectUpdateVMAction(expVM)
+
+	f.run(getKey(vm, t))
+
+	server, ok := f.cloud.servers[id]
+	if !ok {
+		t.Fatalf("expected server to be retained")
+	}
+	if server.Metadata[vmctl.OwnerUIDKey] != string(vm.UID) || server.Metadata[vmctl.RetainedKey] != "true" {
+		t.Errorf("expected server to keep its owner and be marked retained, got %v", server.Metadata)
+	}
+}
+
+func TestAdoptsRetainedServer(t *testing.T) {
+	f := newFixture(t)
+	defer f.cloud.Close()
+	// The VM is moved to another namespace: deleted with the Retain
+	// policy, then created again adopting its server.
+	old := newVM("test")
+	now := metav1.Now()
+	old.DeletionTimestamp = &now
+	old.Finalizers = []string{vmFinalizer}
+	old.Spec.DeletionPolicy = samplecontroller.DeletionPolicyRetain
+	id := f.cloud.addOwnedServer(old, 42)
+
+	moved := newVM("test")
+	moved.Namespace = "other"
+	moved.UID = "moved-uid"
+	moved.Finalizers = []string{vmFinalizer}
+	moved.Spec.Adopt = true
+
+	f.vmLister = append(f.vmLister, old, moved)
+	f.objects = append(f.objects, old, moved)
+
+	c, _ := f.newController()
+	if err := c.syncHandler(getKey(old, t)); err != nil {
+		t.Fatalf("error finalizing vm: %v", err)
+	}
+	if err := c.syncHandler(getKey(moved, t)); err != nil {
+		t.Fatalf("error syncing vm: %v", err)
+	}
+
+	server := f.cloud.servers[id]
+	if len(f.cloud.servers) != 1 || server == nil {
+		t.Fatalf("expected the retained server to be adopted, got %+v", f.cloud.servers)
+	}
+	if server.Metadata[vmctl.OwnerUIDKey] != string(moved.UID) || server.Metadata[vmctl.RetainedKey] != "" {
+		t.Errorf("expected the server to be owned by the moved VM and no longer retained, got %v", server.Metadata)
+	}
+	updated, _ := f.client.SamplecontrollerV1alpha1().VMs(moved.Namespace).Get(moved.Name, metav1.GetOptions{})
+	if updated.Status.VMID != id {
+		t.Errorf("expected the moved VM to record server %s, got %q", id, updated.Status.VMID)
+	}
+}
 
-	// Update replicas
-	foo.Spec.Replicas = int32Ptr(2)
-	expDeployment := newDeployment(foo)
+func TestAdoptsServerOfDeletedVM(t *testing.T) {
+	f := newFixture(t)
+	defer f.cloud.Close()
+	vm := newVM("test")
+	vm.Finalizers = []string{vmFinalizer}
+	vm.Spec.Adopt = true
+	// The server of a VM deleted without its finalizer running.
+	id := f.cloud.addOwnedServer(newVM("gone"), 42)
+	vm.Spec.Name = "gone-server"
 
-	f.fooLister = append(f.fooLister, foo)
-	f.objects = append(f.objects, foo)
-	f.deploymentLister = append(f.deploymentLister, d)
-	f.kubeobjects = append(f.kubeobjects, d)
+	f.vmLister = append(f.vmLister, vm)
+	f.objects = append(f.objects, vm)
 
-	f.expectUpdateFooStatusAction(foo)
-	f.expectUpdateDeploymentAction(expDeployment)
-	f.run(getKey(foo, t))
+	c, _ := f.newController()
+	if err := c.syncHandler(getKey(vm, t)); err != nil {
+		t.Fatalf("error syncing vm: %v", err)
+	}
+	if owner := f.cloud.servers[id].Metadata[vmctl.OwnerUIDKey]; owner != string(vm.UID) {
+		t.Errorf("expected the server to be adopted, owned by %q", owner)
+	}
 }
 
-func TestNotControlledByUs(t *testing.T) {
+func TestDetachesServer(t *testing.T) {
 	f := newFixture(t)
-	foo := newFoo("test", int32Ptr(1))
-	d := newDeployment(foo)
+	vm := newVM("test")
+	now := metav1.Now()
+	vm.DeletionTimestamp = &now
+	vm.Finalizers = []string{vmFinalizer}
+	vm.Spec.DeletionPolicy = samplecontroller.DeletionPolicyDetach
+	id := f.cloud.addOwnedServer(vm, 42)
+	f.cloud.servers[id].Metadata["team"] = "infra"
 
-	d.ObjectMeta.OwnerReferences = []metav1.OwnerReference{}
+	f.vmLister = append(f.vmLister, vm)
+	f.objects = append(f.objects, vm)
 
-	f.fooLister = append(f.fooLister, foo)
-	f.objects = append(f.objects, foo)
-	f.deploymentLister = append(f.deploymentLister, d)
-	f.kubeobjects = append(f.kubeobjects, d)
+	expVM := vm.DeepCopy()
+	expVM.Finalizers = nil
+	f.expectUpdateVMAction(expVM)
 
-	f.runExpectError(getKey(foo, t))
+	f.run(getKey(vm, t))
+
+	server, ok := f.cloud.servers[id]
+	if !ok {
+		t.Fatalf("expected server to be kept")
+	}
+	if !reflect.DeepEqual(server.Metadata, map[string]string{"team": "infra"}) {
+		t.Errorf("expected ownership metadata to be cleared, got %v", server.Metadata)
+	}
 }
 
-func int32Ptr(i int32) *int32 { return &i }
+func TestKeepsFinalizerWhenDeleteFails(t *testing.T) {
+	f := newFixture(t)
+	vm := newVM("test")
+	now := metav1.Now()
+	vm.DeletionTimestamp = &now
+	vm.Finalizers = []string{vmFinalizer}
+	f.cloud.addOwnedServer(vm, 42)
+	f.cloud.failDelete = true
+
+	f.vmLister = append(f.vmLister, vm)
+	f.objects = append(f.objects, vm)
+
+	f.runExpectError(getKey(vm, t))
+}
+
+func TestVMNeedsSync(t *testing.T) {
+	base := newVM("test")
+	base.ResourceVersion = "1"
+	base.Generation = 1
+
+	now := metav1.Now()
+	tests := []struct {
+		name   string
+		mutate func(vm *samplecontroller.VM)
+		want   bool
+	}{
+		{
+			name:   "resync",
+			mutate: func(vm *samplecontroller.VM) {},
+			want:   false,
+		},
+		{
+			name: "status only",
+			mutate: func(vm *samplecontroller.VM) {
+				vm.ResourceVersion = "2"
+				vm.Status.CpuUtilization = 10
+			},
+			want: false,
+		},
+		{
+			name: "status only without status subresource",
+			mutate: func(vm *samplecontroller.VM) {
+				vm.ResourceVersion = "2"
+				vm.Generation = 2
+				vm.Status.CpuUtilization = 10
+			},
+			want: false,
+		},
+		{
+			name: "spec change",
+			mutate: func(vm *samplecontroller.VM) {
+				vm.ResourceVersion = "2"
+				vm.Generation = 2
+				vm.Spec.Name = "other"
+			},
+			want: true,
+		},
+		{
+			name: "deletion",
+			mutate: func(vm *samplecontroller.VM) {
+				vm.ResourceVersion = "2"
+				vm.DeletionTimestamp = &now
+			},
+			want: true,
+		},
+		{
+			name: "annotation change",
+			mutate: func(vm *samplecontroller.VM) {
+				vm.ResourceVersion = "2"
+				vm.Annotations = map[string]string{"foo": "bar"}
+			},
+			want: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			updated := base.DeepCopy()
+			test.mutate(updated)
+			if got := vmNeedsSync(base, updated); got != test.want {
+				t.Errorf("vmNeedsSync() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSyncSchedulesStatusRefresh(t *testing.T) {
+	f := newFixture(t)
+	defer f.cloud.Close()
+	vm := newVM("test")
+	vm.Finalizers = []string{vmFinalizer}
+	f.cloud.addOwnedServer(vm, 42)
+
+	f.vmLister = append(f.vmLister, vm)
+	f.objects = append(f.objects, vm)
+
+	c, _ := f.newController()
+	c.settings.resyncInterval = 0
+
+	key := getKey(vm, t)
+	if err := c.syncHandler(key); err != nil {
+		t.Fatalf("error syncing vm: %v", err)
+	}
+
+	if c.workqueue.Len() != 1 {
+		t.Fatalf("expected %q to be queued for a status refresh, queue length is %d", key, c.workqueue.Len())
+	}
+	item, _ := c.workqueue.Get()
+	if item != key {
+		t.Errorf("expected %q to be queued, got %v", key, item)
+	}
+}
+
+func TestPollStatus(t *testing.T) {
+	now := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	for _, bulk := range []bool{true, false} {
+		t.Run(fmt.Sprintf("bulk=%v", bulk), func(t *testing.T) {
+			f := newFixture(t)
+			f.cloud.bulkStatus = bulk
+
+			var vms []*samplecontroller.VM
+			for i, cpu := range []int{10, 50, 80} {
+				vm := newVM(fmt.Sprintf("test-%d", i))
+				vm.Status.VMID = f.cloud.addOwnedServer(vm, cpu)
+				f.cloud.servers[vm.Status.VMID].MemoryUsage = 1 << 30
+				vm.Status.CpuUtilization = 50
+				vm.Status.Metrics = &samplecontroller.VMMetrics{
+					Timestamp:      metav1.NewTime(now.Add(-time.Minute)),
+					CpuUtilization: 50,
+				}
+				vms = append(vms, vm)
+				f.vmLister = append(f.vmLister, vm)
+				f.objects = append(f.objects, vm)
+			}
+			// Under the threshold and recent enough, no write expected.
+			vms[1].Status.CpuUtilization = 48
+			// A VM without a server yet is left to the workers.
+			pending := newVM("pending")
+			f.vmLister = append(f.vmLister, pending)
+			f.objects = append(f.objects, pending)
+
+			for _, vm := range []*samplecontroller.VM{vms[0], vms[2]} {
+				cpu := f.cloud.servers[vm.Status.VMID].CpuUtilization
+				expVM := vm.DeepCopy()
+				expVM.Status.CpuUtilization = cpu
+				expVM.Status.Metrics = &samplecontroller.VMMetrics{
+					Timestamp:        metav1.NewTime(now),
+					CpuUtilization:   cpu,
+					MemoryUsageBytes: 1 << 30,
+					UptimeSeconds:    3600,
+					CpuUtilizationAverage: samplecontroller.MetricAverages{
+						OneMinute: int64(cpu), FiveMinutes: int64(cpu), FifteenMinutes: int64(cpu),
+					},
+					MemoryUsageBytesAverage: samplecontroller.MetricAverages{
+						OneMinute: 1 << 30, FiveMinutes: 1 << 30, FifteenMinutes: 1 << 30,
+					},
+				}
+				f.actions = append(f.actions, core.NewUpdateSubresourceAction(schema.GroupVersionResource{Resource: "vms"}, "status", vm.Namespace, expVM))
+			}
+
+			c, _ := f.newController()
+			defer f.cloud.Close()
+			c.settings.cpuUtilizationThreshold = 5
+			c.now = func() time.Time { return now }
+
+			c.pollStatus()
+
+			actions := filterInformerActions(f.client.Actions())
+			if len(actions) != len(f.actions) {
+				t.Fatalf("expected %d actions, got %d: %+v", len(f.actions), len(actions), actions)
+			}
+			// The lister does not return VMs in a stable order.
+			for _, expected := range f.actions {
+				found := false
+				for _, action := range actions {
+					if reflect.DeepEqual(expected.(core.UpdateAction).GetObject(), action.(core.UpdateAction).GetObject()) {
+						found = true
+					}
+				}
+				if !found {
+					t.Errorf("expected action %+v", expected)
+				}
+			}
+
+			if bulk && (f.cloud.bulkRequests != 1 || f.cloud.statusRequests != 0) {
+				t.Errorf("expected a single bulk request, got %d bulk and %d single requests", f.cloud.bulkRequests, f.cloud.statusRequests)
+			}
+			if !bulk && f.cloud.statusRequests != 3 {
+				t.Errorf("expected 3 single requests, got %d", f.cloud.statusRequests)
+			}
+		})
+	}
+}
+
+func TestPollStatusAverages(t *testing.T) {
+	f := newFixture(t)
+	vm := newVM("test")
+	vm.Status.VMID = f.cloud.addOwnedServer(vm, 0)
+	f.vmLister = append(f.vmLister, vm)
+	f.objects = append(f.objects, vm)
+
+	c, _ := f.newController()
+	defer f.cloud.Close()
+
+	start := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	var now time.Time
+	c.now = func() time.Time { return now }
+
+	samples := []struct {
+		after time.Duration
+		cpu   int
+	}{
+		{0, 10},
+		{2 * time.Minute, 20},
+		{6 * time.Minute, 30},
+		// Drops the first sample out of the 15 minute window.
+		{16 * time.Minute, 60},
+	}
+	for _, sample := range samples {
+		now = start.Add(sample.after)
+		f.cloud.servers[vm.Status.VMID].CpuUtilization = sample.cpu
+		f.cloud.servers[vm.Status.VMID].MemoryUsage = int64(sample.cpu*3) << 20
+		c.pollStatus()
+	}
+
+	updated, err := f.client.SamplecontrollerV1alpha1().VMs(vm.Namespace).Get(vm.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := updated.Status.Metrics
+	if metrics == nil {
+		t.Fatal("expected metrics in the status")
+	}
+	if !metrics.Timestamp.Equal(&metav1.Time{Time: now}) || metrics.CpuUtilization != 60 || updated.Status.CpuUtilization != 60 {
+		t.Errorf("expected the latest sample, got %+v", metrics)
+	}
+	expected := samplecontroller.MetricAverages{OneMinute: 60, FiveMinutes: 60, FifteenMinutes: 37}
+	if metrics.CpuUtilizationAverage != expected {
+		t.Errorf("expected CPU averages %+v, got %+v", expected, metrics.CpuUtilizationAverage)
+	}
+	expected = samplecontroller.MetricAverages{OneMinute: 180 << 20, FiveMinutes: 180 << 20, FifteenMinutes: 110 << 20}
+	if metrics.MemoryUsageBytesAverage != expected {
+		t.Errorf("expected memory averages %+v, got %+v", expected, metrics.MemoryUsageBytesAverage)
+	}
+
+	// The history of a deleted VM is dropped.
+	f.client.SamplecontrollerV1alpha1().VMs(vm.Namespace).Delete(vm.Name, nil)
+	c.vmsLister = listers.NewVMLister(cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{}))
+	c.pollStatus()
+	if len(c.metricsHistory) != 0 {
+		t.Errorf("expected no metrics history, got %v", c.metricsHistory)
+	}
+}
+
+func TestVMPhase(t *testing.T) {
+	pending := newVM("pending")
+	running := newVM("running")
+	running.Status.VMID = "id"
+	failed := running.DeepCopy()
+	failed.Status.Conditions = []samplecontroller.VMCondition{{Type: samplecontroller.VMConflict, Status: corev1.ConditionTrue}}
+	deleting := running.DeepCopy()
+	now := metav1.Now()
+	deleting.DeletionTimestamp = &now
+
+	for _, test := range []struct {
+		vm    *samplecontroller.VM
+		phase string
+	}{
+		{pending, vmPhasePending},
+		{running, vmPhaseRunning},
+		{failed, vmPhaseFailed},
+		{deleting, vmPhaseDeleting},
+	} {
+		if phase := vmPhase(test.vm); phase != test.phase {
+			t.Errorf("expected phase %s for VM %s, got %s", test.phase, test.vm.Name, phase)
+		}
+	}
+}
+
+func TestShardedQueue(t *testing.T) {
+	f := newFixture(t)
+	defer f.cloud.Close()
+	mine := newVM("mine")
+	theirs := newVM("theirs")
+	f.vmLister = append(f.vmLister, mine, theirs)
+	f.objects = append(f.objects, mine, theirs)
+
+	c, _ := f.newController()
+	owned := map[string]bool{}
+	c.owns = func(key string) bool { return owned[key] }
+
+	// Nothing is queued before this replica owns anything.
+	c.enqueueVM(mine)
+	c.enqueueVM(theirs)
+	if c.workqueue.Len() != 0 {
+		t.Fatalf("expected nothing to be queued, queue length is %d", c.workqueue.Len())
+	}
+
+	// Gaining VMs queues them.
+	owned["default/mine"] = true
+	rebalance := make(chan struct{}, 1)
+	c.rebalance = rebalance
+	stopCh := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.runRebalance(stopCh)
+	}()
+	rebalance <- struct{}{}
+	if err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		return c.workqueue.Len() == 1, nil
+	}); err != nil {
+		t.Fatalf("expected the VM gained to be queued, queue length is %d", c.workqueue.Len())
+	}
+	close(stopCh)
+	<-done
+	item, _ := c.workqueue.Get()
+	c.workqueue.Done(item)
+	if item != "default/mine" {
+		t.Errorf("expected default/mine to be queued, got %v", item)
+	}
+
+	// A VM lost while queued is skipped by the workers.
+	c.workqueue.Add("default/mine")
+	owned["default/mine"] = false
+	if !c.processNextWorkItem() {
+		t.Fatalf("expected the worker to go on")
+	}
+	if actions := filterInformerActions(f.client.Actions()); len(actions) != 0 {
+		t.Errorf("expected no action on a VM owned by another replica, got %+v", actions)
+	}
+}
+
+func TestScopedInformers(t *testing.T) {
+	f := newFixture(t)
+	defer f.cloud.Close()
+	var vms []*samplecontroller.VM
+	for _, vm := range []struct{ namespace, team string }{
+		{"team-a", "a"}, {"team-a", "b"}, {"team-b", "a"}, {"team-c", "a"},
+	} {
+		v := newVM(vm.namespace + "-" + vm.team)
+		v.Namespace = vm.namespace
+		v.Labels = map[string]string{"team": vm.team}
+		vms = append(vms, v)
+		f.objects = append(f.objects, v)
+	}
+	f.client = fake.NewSimpleClientset(f.objects...)
+	f.kubeclient = k8sfake.NewSimpleClientset()
+
+	vmInformers := map[string]vminformers.VMInformer{}
+	var factories []informers.SharedInformerFactory
+	for _, namespace := range []string{"team-a", "team-b"} {
+		i := informers.NewSharedInformerFactoryWithOptions(f.client, noResyncPeriodFunc(), informers.WithNamespace(namespace),
+			informers.WithTweakListOptions(func(options *metav1.ListOptions) { options.LabelSelector = "team=a" }))
+		vmInformers[namespace] = i.Samplecontroller().V1alpha1().VMs()
+		factories = append(factories, i)
+	}
+	c := NewController(f.kubeclient, f.client, f.cloud.URL, vmInformers, workqueue.DefaultControllerRateLimiter(), metrics.New())
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	for _, i := range factories {
+		i.Start(stopCh)
+	}
+	if !cache.WaitForCacheSync(stopCh, c.vmsSynced) {
+		t.Fatalf("expected the informers to sync")
+	}
+
+	listed, err := c.vmsLister.List(labels.Everything())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, vm := range listed {
+		names = append(names, vm.Name)
+	}
+	sort.Strings(names)
+	if !reflect.DeepEqual(names, []string{"team-a-a", "team-b-a"}) {
+		t.Errorf("expected only the VMs in scope to be listed, got %v", names)
+	}
+	if _, err := c.vmsLister.VMs("team-c").Get("team-c-a"); !errors.IsNotFound(err) {
+		t.Errorf("expected a VM out of the namespaces watched not to be found, got %v", err)
+	}
+	if c.workqueue.Len() != 2 {
+		t.Errorf("expected only the VMs in scope to be queued, queue length is %d", c.workqueue.Len())
+	}
+}
+
+func TestScopeStamp(t *testing.T) {
+	if stamp := scopeStamp(config.ScopeConfiguration{}); stamp != "" {
+		t.Errorf("expected no stamp when watching all VMs, got %q", stamp)
+	}
+
+	stamp := scopeStamp(config.ScopeConfiguration{Namespaces: []string{"a", "b"}, LabelSelector: "tier=web,team=a"})
+	same := scopeStamp(config.ScopeConfiguration{Namespaces: []string{"b", "a"}, LabelSelector: "team=a, tier=web"})
+	other := scopeStamp(config.ScopeConfiguration{Namespaces: []string{"a"}, LabelSelector: "tier=web,team=a"})
+	if stamp == "" || stamp != same {
+		t.Errorf("expected the same VMs to have the same stamp, got %q and %q", stamp, same)
+	}
+	if other == stamp {
+		t.Errorf("expected other VMs to have another stamp")
+	}
+}
+
+func TestPollStatusOnlyOwned(t *testing.T) {
+	f := newFixture(t)
+	defer f.cloud.Close()
+	f.cloud.bulkStatus = true
+	mine := newVM("mine")
+	mine.Status.VMID = f.cloud.addOwnedServer(mine, 10)
+	theirs := newVM("theirs")
+	theirs.Status.VMID = f.cloud.addOwnedServer(theirs, 20)
+	f.vmLister = append(f.vmLister, mine, theirs)
+	f.objects = append(f.objects, mine, theirs)
+
+	c, _ := f.newController()
+	c.owns = func(key string) bool { return key == "default/mine" }
+	// Metrics exported before theirs moved to another replica are dropped.
+	c.metrics.SetVMStatus(theirs.Namespace, theirs.Name, theirs.Status.VMID, vmctl.ServerStatus{CpuUtilization: 20})
+
+	c.pollStatus()
+
+	actions := filterInformerActions(f.client.Actions())
+	if len(actions) != 1 || actions[0].(core.UpdateAction).GetObject().(*samplecontroller.VM).Name != "mine" {
+		t.Errorf("expected only the status of mine to be written, got %+v", actions)
+	}
+	if _, ok := c.metricsHistory[theirs.Status.VMID]; ok {
+		t.Errorf("expected no metrics history for a VM owned by another replica")
+	}
+	w := httptest.NewRecorder()
+	c.metrics.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if strings.Contains(w.Body.String(), `vm="theirs"`) {
+		t.Errorf("expected no metrics for a VM owned by another replica, got:\n%s", w.Body.String())
+	}
+}
+
+func TestCheckProgress(t *testing.T) {
+	f := newFixture(t)
+	defer f.cloud.Close()
+	vm := newVM("test")
+	f.vmLister = append(f.vmLister, vm)
+	f.objects = append(f.objects, vm)
+
+	c, _ := f.newController()
+	now := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	c.now = func() time.Time { return now }
+
+	// Keys queued while the caches sync wait for the workers to start.
+	c.workqueue.Add(getKey(vm, t))
+	if err := c.checkProgress(time.Minute); err != nil {
+		t.Errorf("expected no error before the workers started, got %v", err)
+	}
+	c.workqueue.Get()
+	c.workqueue.Done(getKey(vm, t))
+	c.recordProgress()
+
+	// Idle workers are not stuck.
+	now = now.Add(time.Hour)
+	if err := c.checkProgress(time.Minute); err != nil {
+		t.Errorf("expected no error with an empty queue, got %v", err)
+	}
+
+	c.workqueue.Add(getKey(vm, t))
+	if err := c.checkProgress(time.Minute); err == nil {
+		t.Errorf("expected an error with a VM queued and no progress")
+	}
+	if !c.processNextWorkItem() {
+		t.Fatalf("expected the worker to go on")
+	}
+	c.workqueue.Add(getKey(vm, t))
+	if err := c.checkProgress(time.Minute); err != nil {
+		t.Errorf("expected no error right after progress, got %v", err)
+	}
+}
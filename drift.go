@@ -0,0 +1,112 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+
+	samplev1alpha1 "k8s.io/sample-controller/pkg/apis/samplecontroller/v1alpha1"
+	vmctl "k8s.io/sample-controller/pkg/cloud"
+)
+
+const (
+	// ServerDrifted is used as part of the Event 'reason' when the cloud
+	// server of a VM changed or disappeared behind the controller's back
+	ServerDrifted = "ServerDrifted"
+
+	// ServerRecreated is used as part of the Event 'reason' when a missing
+	// cloud server is recreated
+	ServerRecreated = "ServerRecreated"
+)
+
+// Kinds of drift, as reported in the drift metric.
+const (
+	driftMissing    = "missing"
+	driftSize       = "size"
+	driftPowerState = "power_state"
+)
+
+// handleMissingServer applies the drift policy of a VM whose recorded server
+// no longer exists in the cloud. It returns whether a replacement server
+// should be created.
+func (c *Controller) handleMissingServer(key string, vm *samplev1alpha1.VM) (bool, error) {
+	message := fmt.Sprintf("server %s no longer exists", vm.Status.VMID)
+
+	switch vm.Spec.DriftPolicy {
+	case samplev1alpha1.DriftPolicyIgnore:
+		// The server is neither brought back nor reported, but the VM must
+		// not look as if it still had one.
+		status := vm.Status.DeepCopy()
+		setVMCondition(status, samplev1alpha1.VMCondition{
+			Type:    samplev1alpha1.VMDrifted,
+			Status:  corev1.ConditionTrue,
+			Reason:  ServerDrifted,
+			Message: message,
+		})
+		if err := c.writeVMStatus(vm, *status); err != nil {
+			return false, err
+		}
+		c.workqueue.AddAfter(key, c.currentSettings().resyncInterval)
+		return false, nil
+	case samplev1alpha1.DriftPolicyReport:
+		klog.Warningf("%s: %s, not recreating it", key, message)
+		c.metrics.DriftDetected(driftMissing)
+		return false, c.reportProblem(key, vm, samplev1alpha1.VMDrifted, ServerDrifted, message)
+	default:
+		klog.Warningf("%s: %s, recreating it", key, message)
+		c.metrics.DriftDetected(driftMissing)
+		c.recorder.Event(vm, corev1.EventTypeWarning, ServerRecreated, message+", recreating it")
+		return true, nil
+	}
+}
+
+// reportDrift reports a size or power state of server departing from the
+// spec of the VM, or, for what the spec leaves out, from what was last
+// synced. They cannot be healed, so they are only reported.
+func (c *Controller) reportDrift(vm *samplev1alpha1.VM, server *vmctl.Server) {
+	if vm.Spec.DriftPolicy == samplev1alpha1.DriftPolicyIgnore {
+		return
+	}
+
+	if expected, ok := drifted(server.Size, vm.Spec.Size, vm.Status.Size); ok {
+		c.metrics.DriftDetected(driftSize)
+		c.recorder.Eventf(vm, corev1.EventTypeWarning, ServerDrifted,
+			"Size of server %s is %s, expected %s", server.ID, server.Size, expected)
+	}
+	if expected, ok := drifted(server.PowerState, vm.Spec.PowerState, vm.Status.PowerState); ok {
+		c.metrics.DriftDetected(driftPowerState)
+		c.recorder.Eventf(vm, corev1.EventTypeWarning, ServerDrifted,
+			"Power state of server %s is %s, expected %s", server.ID, server.PowerState, expected)
+	}
+}
+
+// drifted returns the value expected in place of observed, and whether
+// observed newly departs from it. The declared value is expected when set,
+// the last synced one otherwise. Drift already recorded in last is not
+// reported again.
+func drifted(observed, declared, last string) (string, bool) {
+	if observed == last {
+		return "", false
+	}
+	if declared != "" {
+		return declared, observed != declared
+	}
+	return last, last != ""
+}
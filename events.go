@@ -0,0 +1,108 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog"
+)
+
+// eventFlushReason marks the events sent after all others to find out when
+// those have been written. They are neither written nor logged.
+const eventFlushReason = "EventFlush"
+
+// flushingSink writes events to the API server, and tells when a flush
+// marker got through. The broadcaster hands events to the sink in order, so
+// once the marker did, every event recorded before it was written or given
+// up on.
+type flushingSink struct {
+	record.EventSink
+	// recorder records the markers, it must be one of the broadcaster
+	// writing to the sink.
+	recorder record.EventRecorder
+
+	lock    sync.Mutex
+	pending map[string]chan struct{}
+}
+
+func newFlushingSink(sink record.EventSink) *flushingSink {
+	return &flushingSink{EventSink: sink, pending: map[string]chan struct{}{}}
+}
+
+func (s *flushingSink) Create(event *corev1.Event) (*corev1.Event, error) {
+	if event.Reason == eventFlushReason {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		if done, ok := s.pending[event.InvolvedObject.Name]; ok {
+			close(done)
+			delete(s.pending, event.InvolvedObject.Name)
+		}
+		return event, nil
+	}
+	return s.EventSink.Create(event)
+}
+
+// flush records a marker, and waits until deadline for it to reach the
+// sink. It reports whether it did.
+func (s *flushingSink) flush(deadline time.Time) bool {
+	name := string(uuid.NewUUID())
+	done := make(chan struct{})
+	s.lock.Lock()
+	s.pending[name] = done
+	s.lock.Unlock()
+	defer func() {
+		s.lock.Lock()
+		delete(s.pending, name)
+		s.lock.Unlock()
+	}()
+
+	s.recorder.Event(&corev1.ObjectReference{Kind: eventFlushReason, Name: name}, corev1.EventTypeNormal, eventFlushReason, "")
+	return waitUntil(done, deadline)
+}
+
+// waitUntil waits until deadline for done to be closed, and reports whether
+// it was.
+func waitUntil(done <-chan struct{}, deadline time.Time) bool {
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		// Both may be ready, done wins.
+		select {
+		case <-done:
+			return true
+		default:
+			return false
+		}
+	}
+}
+
+// logEvent logs an event, the way the broadcaster does, unless it is a
+// flush marker.
+func logEvent(e *corev1.Event) {
+	if e.Reason == eventFlushReason {
+		return
+	}
+	klog.Infof("Event(%#v): type: '%v' reason: '%v' %v", e.InvolvedObject, e.Type, e.Reason, e.Message)
+}
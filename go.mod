@@ -7,12 +7,14 @@ go 1.12
 require (
 	github.com/google/uuid v1.0.0
 	github.com/prometheus/client_golang v0.9.3
+	golang.org/x/time v0.0.0-20161028155119-f51c12702a4d
 	gopkg.in/resty.v1 v1.12.0
 	k8s.io/api v0.0.0-20190515023547-db5a9d1c40eb
 	k8s.io/apimachinery v0.0.0-20190515023456-b74e4c97951f
 	k8s.io/client-go v0.0.0-20190515063710-7b18d6600f6b
 	k8s.io/code-generator v0.0.0-20190511023357-639c964206c2
 	k8s.io/klog v0.3.0
+	sigs.k8s.io/yaml v1.1.0
 )
 
 replace (
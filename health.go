@@ -0,0 +1,72 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	vmctl "k8s.io/sample-controller/pkg/cloud"
+	"k8s.io/sample-controller/pkg/health"
+)
+
+// cloudPingTimeout is how long the readiness check waits for the cloud.
+const cloudPingTimeout = 5 * time.Second
+
+// handler is where the probes are served, the metrics server in main.
+type handler interface {
+	Handle(pattern string, handler http.Handler)
+}
+
+// serveHealth serves /healthz and /readyz with m, as configured in
+// settings. leaderCheck, if set, is part of the readiness.
+func serveHealth(m handler, controllers *lifecycle, settings *configStore, leaderCheck *health.Check) {
+	conf := settings.get()
+	pingCloud := func() error {
+		return ping(conf.Cloud.APIServer)
+	}
+	ready := []health.Check{
+		{Name: "informers", Check: func() error {
+			// Replicas not leading have no caches to wait for.
+			if c := controllers.current(); c != nil {
+				return c.checkSynced()
+			}
+			return nil
+		}},
+		{Name: "cloud", Check: health.Cached(pingCloud, conf.Health.CloudCheckInterval.Duration)},
+	}
+	if leaderCheck != nil {
+		ready = append(ready, *leaderCheck)
+	}
+	m.Handle("/readyz", health.Handler(ready...))
+
+	m.Handle("/healthz", health.Handler(health.Check{Name: "workers", Check: func() error {
+		if c := controllers.current(); c != nil {
+			return c.checkProgress(settings.get().Health.WorkerStuckTimeout.Duration)
+		}
+		return nil
+	}}))
+}
+
+// ping checks the cloud at address answers.
+func ping(address string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), cloudPingTimeout)
+	defer cancel()
+	cloud := vmctl.Cloud{Address: address, Context: ctx}
+	return cloud.Ping()
+}
@@ -0,0 +1,144 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/klog"
+)
+
+// informerFactory is the part of the shared informer factories the
+// lifecycle needs.
+type informerFactory interface {
+	Start(stopCh <-chan struct{})
+}
+
+// lifecycle runs a controller while this replica leads. Each time leadership
+// is gained it builds a fresh controller, with its own informers and
+// workqueue, and each time it is lost it stops that controller and waits
+// for everything it started to return.
+type lifecycle struct {
+	build       func() (*Controller, []informerFactory)
+	threadiness int
+
+	lock sync.Mutex
+	// stopCh and done are those of the running controller, nil when none
+	// runs. err is what it returned, once done.
+	stopCh chan struct{}
+	done   chan struct{}
+	err    error
+
+	// controllerLock guards controller, the running controller, apart from
+	// lock so that health checks and reloads do not wait for a controller
+	// to stop. settings, if set, were reloaded and replace those of every
+	// controller built.
+	controllerLock sync.Mutex
+	controller     *Controller
+	settings       *settings
+}
+
+func newLifecycle(build func() (*Controller, []informerFactory), threadiness int) *lifecycle {
+	return &lifecycle{build: build, threadiness: threadiness}
+}
+
+// start builds and runs a controller, unless one is running already.
+func (l *lifecycle) start() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.stopCh != nil {
+		return
+	}
+
+	c, factories := l.build()
+	stopCh := make(chan struct{})
+	done := make(chan struct{})
+	for _, factory := range factories {
+		factory.Start(stopCh)
+	}
+	go func() {
+		defer close(done)
+		if err := c.Run(l.threadiness, stopCh); err != nil {
+			utilruntime.HandleError(fmt.Errorf("error running controller: %v", err))
+			l.err = err
+		}
+	}()
+	l.stopCh, l.done = stopCh, done
+	l.setCurrent(c)
+	klog.Info("Started controller")
+}
+
+// stop stops the running controller, if any, and returns once its workers
+// are done. It returns the error the controller stopped with, if it did not
+// stop cleanly.
+func (l *lifecycle) stop() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.stopCh == nil {
+		return nil
+	}
+
+	klog.Info("Stopping controller")
+	c := l.current()
+	l.setCurrent(nil)
+	close(l.stopCh)
+	<-l.done
+	// The metrics outlive the controller, and another replica may now
+	// report the same VMs.
+	c.forgetMetrics()
+	err := l.err
+	l.stopCh, l.done, l.err = nil, nil, nil
+	klog.Info("Stopped controller")
+	return err
+}
+
+// current returns the running controller, nil if none runs or it is
+// stopping.
+func (l *lifecycle) current() *Controller {
+	l.controllerLock.Lock()
+	defer l.controllerLock.Unlock()
+	return l.controller
+}
+
+func (l *lifecycle) setCurrent(c *Controller) {
+	l.controllerLock.Lock()
+	defer l.controllerLock.Unlock()
+	l.controller = c
+	if c != nil && l.settings != nil {
+		c.reconfigure(*l.settings)
+	}
+}
+
+// reconfigure applies reloaded settings to the running controller, if any,
+// and to those built from now on.
+func (l *lifecycle) reconfigure(s settings) {
+	l.controllerLock.Lock()
+	defer l.controllerLock.Unlock()
+	l.settings = &s
+	if l.controller != nil {
+		l.controller.reconfigure(s)
+	}
+}
+
+// running reports whether a controller runs.
+func (l *lifecycle) running() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.stopCh != nil
+}
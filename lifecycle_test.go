@@ -0,0 +1,339 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	core "k8s.io/client-go/testing"
+	"k8s.io/client-go/util/workqueue"
+
+	samplecontroller "k8s.io/sample-controller/pkg/apis/samplecontroller/v1alpha1"
+	"k8s.io/sample-controller/pkg/config"
+	"k8s.io/sample-controller/pkg/generated/clientset/versioned/fake"
+	informers "k8s.io/sample-controller/pkg/generated/informers/externalversions"
+	vminformers "k8s.io/sample-controller/pkg/generated/informers/externalversions/samplecontroller/v1alpha1"
+	"k8s.io/sample-controller/pkg/health"
+	"k8s.io/sample-controller/pkg/metrics"
+)
+
+// newTestLifecycle returns a lifecycle building controllers on top of the
+// same fake API server and cloud, and the controllers it built.
+func newTestLifecycle(f *fixture) (*lifecycle, *[]*Controller) {
+	f.client = fake.NewSimpleClientset(f.objects...)
+	f.kubeclient = k8sfake.NewSimpleClientset()
+	m := metrics.New()
+
+	var built []*Controller
+	l := newLifecycle(func() (*Controller, []informerFactory) {
+		i := informers.NewSharedInformerFactory(f.client, noResyncPeriodFunc())
+		c := NewController(f.kubeclient, f.client, f.cloud.URL,
+			map[string]vminformers.VMInformer{metav1.NamespaceAll: i.Samplecontroller().V1alpha1().VMs()},
+			workqueue.DefaultControllerRateLimiter(), m)
+		c.clusterID = testClusterID
+		c.statusPollInterval = 0
+		if f.setup != nil {
+			f.setup(c)
+		}
+		built = append(built, c)
+		return c, []informerFactory{i}
+	}, 2)
+	return l, &built
+}
+
+// waitForServer waits until the status of the VM records a server.
+func waitForServer(f *fixture, vm *samplecontroller.VM) error {
+	return wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		current, err := f.client.SamplecontrollerV1alpha1().VMs(vm.Namespace).Get(vm.Name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		return current.Status.VMID != "", nil
+	})
+}
+
+func TestLifecycleSurvivesLeaseFlaps(t *testing.T) {
+	f := newFixture(t)
+	defer f.cloud.Close()
+	vm := newVM("test")
+	f.objects = append(f.objects, vm)
+	l, built := newTestLifecycle(f)
+
+	for flap := 0; flap < 5; flap++ {
+		l.start()
+		// Gaining leadership again while leading changes nothing.
+		l.start()
+		if len(*built) != flap+1 {
+			t.Fatalf("flap %d: expected %d controllers built, got %d", flap, flap+1, len(*built))
+		}
+
+		if err := waitForServer(f, vm); err != nil {
+			t.Fatalf("flap %d: VM %s not synced: %v", flap, vm.Name, err)
+		}
+		// A VM created while this replica did not lead is picked up by
+		// the fresh informers.
+		if flap > 0 {
+			added := newVM(fmt.Sprintf("added-%d", flap))
+			if err := waitForServer(f, added); err != nil {
+				t.Fatalf("flap %d: VM %s not synced: %v", flap, added.Name, err)
+			}
+		}
+
+		l.stop()
+		l.stop()
+		if l.running() {
+			t.Fatalf("flap %d: expected no controller running", flap)
+		}
+		c := (*built)[flap]
+		if !c.workqueue.ShuttingDown() {
+			t.Errorf("flap %d: expected the workqueue of the stopped controller to be shut down", flap)
+		}
+		if flap > 0 && c.workqueue == (*built)[flap-1].workqueue {
+			t.Errorf("flap %d: expected a fresh workqueue", flap)
+		}
+
+		added := newVM(fmt.Sprintf("added-%d", flap+1))
+		if _, err := f.client.SamplecontrollerV1alpha1().VMs(added.Namespace).Create(added); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Nothing is left running to sync VMs created after the last stop.
+	time.Sleep(100 * time.Millisecond)
+	last, _ := f.client.SamplecontrollerV1alpha1().VMs(metav1.NamespaceDefault).Get("added-5", metav1.GetOptions{})
+	if last.Status.VMID != "" {
+		t.Errorf("expected VM added-5 to stay unsynced, got server %s", last.Status.VMID)
+	}
+}
+
+func TestLifecycleStopWaitsForInFlightSync(t *testing.T) {
+	f := newFixture(t)
+	defer f.cloud.Close()
+	vm := newVM("test")
+	f.objects = append(f.objects, vm)
+
+	creating := make(chan struct{})
+	release := make(chan struct{})
+	f.cloud.beforeRequest = func(r *http.Request) {
+		if r.Method == http.MethodPost && r.URL.Path == "/servers" {
+			close(creating)
+			<-release
+		}
+	}
+	l, _ := newTestLifecycle(f)
+
+	l.start()
+	select {
+	case <-creating:
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Fatal("server never created")
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		if err := l.stop(); err != nil {
+			t.Errorf("expected a clean stop, got %v", err)
+		}
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		t.Fatal("expected stop to wait for the server to be created")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case <-stopped:
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Fatal("stop never returned")
+	}
+	// The sync finished, status included, before stop returned.
+	current, _ := f.client.SamplecontrollerV1alpha1().VMs(vm.Namespace).Get(vm.Name, metav1.GetOptions{})
+	if current.Status.VMID == "" {
+		t.Error("expected the in-flight sync to record the server")
+	}
+}
+
+func TestLifecycleStopCancelsAfterTimeout(t *testing.T) {
+	f := newFixture(t)
+	defer f.cloud.Close()
+	vm := newVM("test")
+	f.objects = append(f.objects, vm)
+
+	creating := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	f.cloud.beforeRequest = func(r *http.Request) {
+		if r.Method == http.MethodPost && r.URL.Path == "/servers" {
+			close(creating)
+			<-release
+		}
+	}
+	f.setup = func(c *Controller) { c.settings.shutdownTimeout = 100 * time.Millisecond }
+	l, _ := newTestLifecycle(f)
+
+	l.start()
+	select {
+	case <-creating:
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Fatal("server never created")
+	}
+
+	// The cloud never answers, the request is cancelled once the timeout
+	// is over.
+	stopped := make(chan error)
+	go func() {
+		stopped <- l.stop()
+	}()
+	select {
+	case err := <-stopped:
+		if err == nil {
+			t.Error("expected an error when the sync had to be cancelled")
+		}
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Fatal("stop never returned")
+	}
+}
+
+func TestLifecycleStopFlushesEvents(t *testing.T) {
+	f := newFixture(t)
+	defer f.cloud.Close()
+	vm := newVM("test")
+	f.objects = append(f.objects, vm)
+	l, _ := newTestLifecycle(f)
+
+	// Events are slow to be written.
+	var lock sync.Mutex
+	var written []string
+	f.kubeclient.PrependReactor("create", "events", func(action core.Action) (bool, runtime.Object, error) {
+		time.Sleep(200 * time.Millisecond)
+		event := action.(core.CreateAction).GetObject().(*corev1.Event)
+		lock.Lock()
+		defer lock.Unlock()
+		written = append(written, event.Reason)
+		return true, event, nil
+	})
+
+	l.start()
+	if err := waitForServer(f, vm); err != nil {
+		t.Fatalf("VM %s not synced: %v", vm.Name, err)
+	}
+	if err := l.stop(); err != nil {
+		t.Fatalf("expected a clean stop, got %v", err)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if !reflect.DeepEqual(written, []string{SuccessSynced}) {
+		t.Errorf("expected the %s event, and it alone, to be written before stop returned, got %v", SuccessSynced, written)
+	}
+}
+
+// gathered returns the names of the metric families m has series in.
+func gathered(t *testing.T, m *metrics.Metrics) map[string]bool {
+	families, err := m.Registry().Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := map[string]bool{}
+	for _, family := range families {
+		if len(family.GetMetric()) > 0 {
+			names[family.GetName()] = true
+		}
+	}
+	return names
+}
+
+func TestLifecycleStopClearsVMMetrics(t *testing.T) {
+	f := newFixture(t)
+	defer f.cloud.Close()
+	vm := newVM("test")
+	f.objects = append(f.objects, vm)
+	f.setup = func(c *Controller) { c.statusPollInterval = 10 * time.Millisecond }
+	l, built := newTestLifecycle(f)
+
+	l.start()
+	m := (*built)[0].metrics
+	if err := wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		return gathered(t, m)["vm_cpu_utilization_percent"], nil
+	}); err != nil {
+		t.Fatalf("expected the guest metrics of the VM to be exported")
+	}
+
+	// As when leadership is lost, the leader now reports the VMs.
+	l.stop()
+	names := gathered(t, m)
+	for _, name := range []string{"vm_cpu_utilization_percent", "vm_uptime_seconds", "vm_phase_count"} {
+		if names[name] {
+			t.Errorf("expected %s to be cleared once the controller stopped", name)
+		}
+	}
+}
+
+func TestServeHealth(t *testing.T) {
+	f := newFixture(t)
+	defer f.cloud.Close()
+	conf := config.Default()
+	conf.Cloud.APIServer = f.cloud.URL
+	conf.Health.CloudCheckInterval.Duration = 0
+
+	l, _ := newTestLifecycle(f)
+	mux := http.NewServeMux()
+	leading := fmt.Errorf("no leader elected")
+	serveHealth(mux, l, newConfigStore(conf), &health.Check{Name: "leader", Check: func() error { return leading }})
+
+	get := func(path string) int {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w.Code
+	}
+	if code := get("/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("expected not to be ready without a leader, got %d", code)
+	}
+	leading = nil
+	if code := get("/readyz"); code != http.StatusOK {
+		t.Errorf("expected to be ready, got %d", code)
+	}
+	if code := get("/healthz"); code != http.StatusOK {
+		t.Errorf("expected to be healthy, got %d", code)
+	}
+
+	l.start()
+	defer l.stop()
+	if err := wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		return get("/readyz") == http.StatusOK, nil
+	}); err != nil {
+		t.Errorf("expected to be ready once the caches synced")
+	}
+
+	f.cloud.Close()
+	if code := get("/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("expected not to be ready without the cloud, got %d", code)
+	}
+}
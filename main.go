@@ -21,40 +21,57 @@ import (
 	"os"
 	"time"
 
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
 	kubeinformers "k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/klog"
 	// Uncomment the following line to load the gcp plugin (only required to authenticate against GKE clusters).
 	// _ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 
+	"k8s.io/sample-controller/pkg/admission"
+	samplev1alpha1 "k8s.io/sample-controller/pkg/apis/samplecontroller/v1alpha1"
+	"k8s.io/sample-controller/pkg/config"
+	"k8s.io/sample-controller/pkg/custommetrics"
+	"k8s.io/sample-controller/pkg/gc"
 	clientset "k8s.io/sample-controller/pkg/generated/clientset/versioned"
 	informers "k8s.io/sample-controller/pkg/generated/informers/externalversions"
+	"k8s.io/sample-controller/pkg/generated/informers/externalversions/internalinterfaces"
+	vminformers "k8s.io/sample-controller/pkg/generated/informers/externalversions/samplecontroller/v1alpha1"
+	"k8s.io/sample-controller/pkg/health"
 	"k8s.io/sample-controller/pkg/leader"
+	"k8s.io/sample-controller/pkg/metrics"
+	"k8s.io/sample-controller/pkg/shard"
 	"k8s.io/sample-controller/pkg/signals"
 )
 
 var (
-	masterURL      string
-	kubeconfig     string
-	cloudAPIServer string
-)
+	masterURL  string
+	kubeconfig string
+	configFile string
 
-var (
-	leaseLockName      = "simple-controller-lock"
-	leaseLockNamespace = "kube-system"
+	// flagConfig only holds the values of the flags, applied on top of the
+	// configuration file by loadConfig.
+	flagConfig = config.Default()
 )
 
 func main() {
 	flag.Parse()
 	klog.InitFlags(nil)
 
-	if len(cloudAPIServer) == 0 {
-		klog.Fatalf("please specify cloudAPIServer")
+	conf, err := loadConfig()
+	if err != nil {
+		klog.Fatalf("Error loading configuration: %s", err.Error())
 	}
+	settings := newConfigStore(conf)
+
 	var cfg *rest.Config
-	var err error
 
 	if masterURL == "" && kubeconfig == "" {
 		cfg, err = rest.InClusterConfig()
@@ -65,38 +82,121 @@ func main() {
 	if err != nil {
 		klog.Fatalf("Error building kubeconfig: %s", err.Error())
 	}
+	cfg.QPS = conf.RateLimits.KubeAPIQPS
+	cfg.Burst = conf.RateLimits.KubeAPIBurst
 
 	kubeClient, err := kubernetes.NewForConfig(cfg)
 	if err != nil {
 		klog.Fatalf("Error building kubernetes clientset: %s", err.Error())
 	}
 
-	leader := leader.LeaderInit(kubeClient)
-	leaderCh := make(chan int)
-	leader.StartElection(leaderCh)
-	c, kIF, eIF := setupController(cfg)
-	go func() {
-		// set up signals so we handle the first shutdown signal gracefully
-		stopOSCh := signals.SetupSignalHandler()
+	m := metrics.New()
+	// Before any workqueue is created.
+	m.InstallClientGoProviders()
+	if conf.Metrics.Address != "" {
+		go func() {
+			if err := m.Serve(conf.Metrics.Address, wait.NeverStop); err != nil {
+				klog.Fatalf("Error serving metrics: %s", err.Error())
+			}
+		}()
+	}
+	if conf.Metrics.CustomMetricsAddress != "" {
+		go serveCustomMetrics(cfg, conf)
+	}
+	if conf.Webhook.Address != "" {
+		go serveWebhook(settings)
+	}
+
+	var membership *shard.Membership
+	if conf.Sharding.Enabled {
+		membership, err = shard.New(kubeClient, shard.NewConfig(conf.Sharding))
+		if err != nil {
+			klog.Fatalf("Error setting up sharding: %s", err.Error())
+		}
+	}
+
+	controllers := newLifecycle(func() (*Controller, []informerFactory) {
+		return setupController(cfg, settings.get(), m, membership)
+	}, conf.Workers)
+
+	// set up signals so we handle the first shutdown signal gracefully
+	stopOSCh := signals.SetupSignalHandler()
+	watchConfig(settings, controllers, stopOSCh)
+
+	if conf.Sharding.Enabled {
+		klog.Info("Sharding VMs among replicas, starting controller")
+		membershipStopCh := make(chan struct{})
+		membershipDone := make(chan struct{})
+		go func() {
+			defer close(membershipDone)
+			membership.Run(membershipStopCh)
+		}()
+		serveHealth(m, controllers, settings, &health.Check{Name: "shard", Check: membership.Check})
+		controllers.start()
+		<-stopOSCh
+		err := controllers.stop()
+		// Leave the group once done, so the others take over right away.
+		close(membershipStopCh)
+		<-membershipDone
+		exit(err)
+	}
+
+	if !conf.LeaderElection.LeaderElect {
+		klog.Info("Leader election disabled, starting controller")
+		serveHealth(m, controllers, settings, nil)
+		controllers.start()
 		<-stopOSCh
-		leader.Clean()
-		os.Exit(1)
+		exit(controllers.stop())
+	}
 
-	}()
+	candidate, err := leader.LeaderInit(kubeClient, leader.NewConfig(conf.LeaderElection))
+	if err != nil {
+		klog.Fatalf("Error setting up leader election: %s", err.Error())
+	}
+	m.ReportLeaderElection(candidate.Status)
+	m.Handle("/leader", candidate)
+	serveHealth(m, controllers, settings, &health.Check{Name: "leader", Check: candidate.Check})
+	events, unsubscribe := candidate.Subscribe()
+	candidate.StartElection()
 	for {
-		stopControllerCh := make(chan struct{})
-		<-leaderCh
-		if leader.IsLeader() {
-			go runController(c, stopControllerCh, kIF, eIF)
-		} else {
-			klog.Infof("Not a leader any more, stopping controller")
-			close(stopControllerCh)
+		select {
+		case event := <-events:
+			switch event.Type {
+			case leader.Acquired:
+				controllers.start()
+			case leader.Lost:
+				klog.Infof("Not a leader any more, stopping controller")
+				controllers.stop()
+			}
+		case <-stopOSCh:
+			// No controller is started once shutting down, and the lease
+			// is only released once the controller is done with it.
+			unsubscribe()
+			err := controllers.stop()
+			candidate.Clean()
+			exit(err)
 		}
 	}
+}
 
+// exit ends the process once shut down, successfully if the controller
+// stopped cleanly.
+func exit(err error) {
+	if err != nil {
+		klog.Errorf("Controller did not shut down cleanly: %s", err.Error())
+		klog.Flush()
+		os.Exit(1)
+	}
+	klog.Info("Shut down cleanly")
+	klog.Flush()
+	os.Exit(0)
 }
 
-func setupController(cfg *rest.Config) (*Controller, kubeinformers.SharedInformerFactory, informers.SharedInformerFactory) {
+// setupController builds a controller configured by conf, and the informer
+// factories feeding it, which still have to be started. The controller only
+// watches the VMs in scope, with an informer for each namespace in scope.
+// With a membership, it only reconciles the VMs this replica owns.
+func setupController(cfg *rest.Config, conf *config.ControllerConfiguration, m *metrics.Metrics, membership *shard.Membership) (*Controller, []informerFactory) {
 	kubeClient, err := kubernetes.NewForConfig(cfg)
 	if err != nil {
 		klog.Fatalf("Error building kubernetes clientset: %s", err.Error())
@@ -106,29 +206,121 @@ func setupController(cfg *rest.Config) (*Controller, kubeinformers.SharedInforme
 	if err != nil {
 		klog.Fatalf("Error building example clientset: %s", err.Error())
 	}
-	kubeInformerFactory := kubeinformers.NewSharedInformerFactory(kubeClient, time.Second*30)
-	exampleInformerFactory := informers.NewSharedInformerFactory(exampleClient, time.Second*30)
+	kubeInformerFactory := kubeinformers.NewSharedInformerFactory(kubeClient, conf.InformerResync.Duration)
+	factories := []informerFactory{kubeInformerFactory}
+
+	namespaces := conf.Scope.Namespaces
+	if len(namespaces) == 0 {
+		namespaces = []string{metav1.NamespaceAll}
+	}
+	vmInformers := map[string]vminformers.VMInformer{}
+	for _, namespace := range namespaces {
+		exampleInformerFactory := informers.NewSharedInformerFactoryWithOptions(exampleClient, conf.InformerResync.Duration,
+			informers.WithNamespace(namespace))
+		exampleInformerFactory.InformerFor(&samplev1alpha1.VM{}, newVMInformer(m, namespace, conf.Scope.LabelSelector))
+		vmInformers[namespace] = exampleInformerFactory.Samplecontroller().V1alpha1().VMs()
+		factories = append(factories, exampleInformerFactory)
+	}
 
 	c := NewController(kubeClient, exampleClient,
-		cloudAPIServer,
-		exampleInformerFactory.Samplecontroller().V1alpha1().VMs())
-	return c, kubeInformerFactory, exampleInformerFactory
+		conf.Cloud.APIServer, vmInformers, rateLimiter(conf), m)
+	c.clusterID = conf.Cloud.ClusterID
+	c.scope = scopeStamp(conf.Scope)
+	c.settings = controllerSettings(conf)
+	c.statusPollInterval = conf.StatusPoll.Interval.Duration
+	if !conf.FeatureEnabled(config.StatusPolling) {
+		c.statusPollInterval = 0
+	}
+	c.statusPollJitter = conf.StatusPoll.Jitter
+	c.bulkStatusUnsupported = !conf.FeatureEnabled(config.BulkStatus)
+	if conf.Orphans.Policy != "" && conf.FeatureEnabled(config.OrphanCollection) {
+		c.orphans = gc.NewCollector(&c.cloud, c.vmsLister, c.vmsSynced, c.recorder, c.metrics,
+			conf.Cloud.ClusterID, gc.Policy(conf.Orphans.Policy), conf.Orphans.ScanPeriod.Duration, conf.Orphans.GracePeriod.Duration)
+		if len(conf.Scope.Namespaces) > 0 || conf.Scope.LabelSelector != "" {
+			// Validated with the configuration.
+			selector, _ := labels.Parse(conf.Scope.LabelSelector)
+			c.orphans.SetScope(c.scope, conf.Scope.Namespaces, selector, func(namespace, name string) (*samplev1alpha1.VM, error) {
+				return exampleClient.SamplecontrollerV1alpha1().VMs(namespace).Get(name, metav1.GetOptions{})
+			})
+		}
+	}
+	if membership != nil {
+		c.owns = membership.Owns
+		c.rebalance = membership.Changed()
+		if c.orphans != nil {
+			c.orphans.SetOwnership(membership.Owns)
+		}
+	}
+	return c, factories
 }
 
-func runController(c *Controller, stopCh <-chan struct{},
-	kIF kubeinformers.SharedInformerFactory, eIF informers.SharedInformerFactory) {
-	// notice that there is no need to run Start methods in a separate goroutine. (i.e. go kubeInformerFactory.Start(stopCh)
-	// Start method is non-blocking and runs all registered informers in a dedicated goroutine.
-	kIF.Start(stopCh)
-	eIF.Start(stopCh)
+// newVMInformer builds the VM informer of a factory as the factory would,
+// watching the VMs in namespace matching labelSelector, with its lists and
+// watches reported to m.
+func newVMInformer(m *metrics.Metrics, namespace, labelSelector string) internalinterfaces.NewInformerFunc {
+	name := "vms"
+	if namespace != metav1.NamespaceAll {
+		name = "vms/" + namespace
+	}
+	return func(client clientset.Interface, resyncPeriod time.Duration) cache.SharedIndexInformer {
+		vms := client.SamplecontrollerV1alpha1().VMs(namespace)
+		lw := &cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				options.LabelSelector = labelSelector
+				return vms.List(options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				options.LabelSelector = labelSelector
+				return vms.Watch(options)
+			},
+		}
+		return cache.NewSharedIndexInformer(m.InstrumentListerWatcher(name, lw), &samplev1alpha1.VM{}, resyncPeriod,
+			cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	}
+}
 
-	if err := c.Run(2, stopCh); err != nil {
-		klog.Fatalf("Error running controller: %s", err.Error())
+// serveCustomMetrics serves the metrics of VMs through custom.metrics.k8s.io.
+// It has informers of its own, as it serves whether or not this replica
+// leads.
+func serveCustomMetrics(cfg *rest.Config, conf *config.ControllerConfiguration) {
+	exampleClient, err := clientset.NewForConfig(cfg)
+	if err != nil {
+		klog.Fatalf("Error building example clientset: %s", err.Error())
+	}
+	exampleInformerFactory := informers.NewSharedInformerFactory(exampleClient, conf.InformerResync.Duration)
+	vmInformer := exampleInformerFactory.Samplecontroller().V1alpha1().VMs()
+	handler := custommetrics.NewHandler(vmInformer.Lister())
+	exampleInformerFactory.Start(wait.NeverStop)
+
+	if ok := cache.WaitForCacheSync(wait.NeverStop, vmInformer.Informer().HasSynced); !ok {
+		klog.Fatalf("Error waiting for the custom metrics caches to sync")
+	}
+	err = custommetrics.Serve(conf.Metrics.CustomMetricsAddress, conf.Metrics.CustomMetricsCertFile,
+		conf.Metrics.CustomMetricsKeyFile, conf.Metrics.CustomMetricsClientCAFile, handler, wait.NeverStop)
+	if err != nil {
+		klog.Fatalf("Error serving custom metrics: %s", err.Error())
+	}
+}
+
+// serveWebhook serves the admission webhook rejecting edits of spec.name
+// while the name change policy, as reloaded, is Immutable. It serves
+// whether or not this replica leads.
+func serveWebhook(settings *configStore) {
+	conf := settings.get()
+	handler := admission.NewHandler(func() bool {
+		return nameChangePolicy(settings.get().NameChangePolicy) == nameChangeImmutable
+	})
+	err := admission.Serve(conf.Webhook.Address, conf.Webhook.CertFile, conf.Webhook.KeyFile, handler, wait.NeverStop)
+	if err != nil {
+		klog.Fatalf("Error serving the admission webhook: %s", err.Error())
 	}
 }
 
 func init() {
 	flag.StringVar(&kubeconfig, "kubeconfig", "", "Path to a kubeconfig. Only required if out-of-cluster.")
 	flag.StringVar(&masterURL, "master", "", "The address of the Kubernetes API server. Overrides any value in kubeconfig. Only required if out-of-cluster.")
-	flag.StringVar(&cloudAPIServer, "cloudAPIServer", "", "The address of cloud API server address")
+	flag.StringVar(&configFile, "config", "", "The path of a ControllerConfiguration file. Flags given on the command line override it. "+
+		"Changes to vmResync, nameChangePolicy, shutdownTimeout, statusPoll.cpuUtilizationThreshold and health.workerStuckTimeout "+
+		"are applied on SIGHUP or when the file changes, the others on restart")
+	bindFlags(flag.CommandLine, flagConfig)
 }
@@ -0,0 +1,130 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+
+	samplev1alpha1 "k8s.io/sample-controller/pkg/apis/samplecontroller/v1alpha1"
+	vmctl "k8s.io/sample-controller/pkg/cloud"
+)
+
+// adoptAnnotation claims the existing server with the ID given as its value.
+// Setting spec.adopt claims an existing server by name instead.
+const adoptAnnotation = "samplecontroller.k8s.io/adopt-server-id"
+
+// ownerOf returns the cloud owner record for vm.
+func (c *Controller) ownerOf(vm *samplev1alpha1.VM) vmctl.Owner {
+	return vmctl.Owner{
+		ClusterID: c.clusterID,
+		Namespace: vm.Namespace,
+		Name:      vm.Name,
+		UID:       string(vm.UID),
+		Scope:     c.scope,
+	}
+}
+
+// ownsServer reports whether server belongs to vm. Servers recorded in the
+// status before ownership metadata existed are treated as owned.
+func ownsServer(vm *samplev1alpha1.VM, server *vmctl.Server) bool {
+	owner := server.Owner()
+	if owner.UID == "" {
+		return vm.Status.VMID == server.ID
+	}
+	return owner.UID == string(vm.UID)
+}
+
+// wantsAdoption reports whether vm asked to adopt server.
+func wantsAdoption(vm *samplev1alpha1.VM, server *vmctl.Server) bool {
+	return vm.Spec.Adopt || vm.Annotations[adoptAnnotation] == server.ID
+}
+
+// claimServer makes sure server is owned by vm, tagging it if the VM is
+// entitled to it. It returns false, after recording a Conflict condition, if
+// the server belongs to someone else or was not asked to be adopted. Servers
+// their owner let go of may be adopted too.
+func (c *Controller) claimServer(key string, vm *samplev1alpha1.VM, server *vmctl.Server) (bool, error) {
+	owner := server.Owner()
+	if owner.UID == string(vm.UID) {
+		// Keep the record complete for servers tagged before the cluster,
+		// namespace and name were recorded.
+		if owner != c.ownerOf(vm) {
+			if err := c.cloud.SetOwnerByID(server.ID, c.ownerOf(vm)); err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	}
+
+	if owner.UID != "" {
+		// A server its owner let go of may be adopted, as when a VM is
+		// moved to another namespace.
+		abandoned := false
+		if wantsAdoption(vm, server) {
+			var err error
+			if abandoned, err = c.abandoned(server); err != nil {
+				return false, err
+			}
+		}
+		if !abandoned {
+			message := fmt.Sprintf("server %s is owned by %s", server.ID, owner)
+			return false, c.reportProblem(key, vm, samplev1alpha1.VMConflict, ErrConflict, message)
+		}
+	} else if !ownsServer(vm, server) && !wantsAdoption(vm, server) {
+		message := fmt.Sprintf("server %s already exists and is not owned by any VM, set spec.adopt to adopt it", server.Name)
+		return false, c.reportProblem(key, vm, samplev1alpha1.VMConflict, ErrConflict, message)
+	}
+
+	if err := c.cloud.SetOwnerByID(server.ID, c.ownerOf(vm)); err != nil {
+		return false, err
+	}
+	if vm.Status.VMID != server.ID {
+		klog.Infof("Successfully adopted server '%s' (%s)", server.Name, server.ID)
+		c.recorder.Eventf(vm, corev1.EventTypeNormal, SuccessAdopted, "Adopted server %s (%s)", server.Name, server.ID)
+	}
+	return true, nil
+}
+
+// abandoned reports whether the owner recorded on server let go of it:
+// either the server was retained when its VM was deleted, or the VM no
+// longer exists. VMs of other clusters cannot be looked up, so their servers
+// are only abandoned once retained.
+func (c *Controller) abandoned(server *vmctl.Server) (bool, error) {
+	if server.Retained() {
+		return true, nil
+	}
+	owner := server.Owner()
+	if owner.ClusterID != c.clusterID || owner.Name == "" {
+		return false, nil
+	}
+	// The VM may be outside the namespaces and labels watched, so it is
+	// looked up in the API rather than in the cache.
+	vm, err := c.sampleclientset.SamplecontrollerV1alpha1().VMs(owner.Namespace).Get(owner.Name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	// A VM of the same name created since is another VM.
+	return string(vm.UID) != owner.UID, nil
+}
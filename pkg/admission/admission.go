@@ -0,0 +1,103 @@
+// Package admission serves a validating admission webhook for VMs, checking
+// what the CRD schema cannot express before the API server stores an edit.
+// It is meant to be registered with a ValidatingWebhookConfiguration.
+package admission
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/klog"
+
+	samplev1alpha1 "k8s.io/sample-controller/pkg/apis/samplecontroller/v1alpha1"
+)
+
+// vmResource is the resource of the VMs reviewed.
+var vmResource = metav1.GroupVersionResource{
+	Group:    samplev1alpha1.SchemeGroupVersion.Group,
+	Version:  samplev1alpha1.SchemeGroupVersion.Version,
+	Resource: "vms",
+}
+
+// Handler reviews edits of VMs. It rejects changes of spec.name while names
+// are immutable, which is read on every review as it may be reloaded.
+type Handler struct {
+	immutableNames func() bool
+}
+
+// NewHandler returns a handler reviewing edits of VMs.
+func NewHandler(immutableNames func() bool) *Handler {
+	return &Handler{immutableNames: immutableNames}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var review admissionv1beta1.AdmissionReview
+	if err := json.NewDecoder(r.Body).Decode(&review); err != nil || review.Request == nil {
+		http.Error(w, "expected an AdmissionReview with a request", http.StatusBadRequest)
+		return
+	}
+	review.Response = h.review(review.Request)
+	review.Response.UID = review.Request.UID
+	review.Request = nil
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(review); err != nil {
+		utilruntime.HandleError(fmt.Errorf("error writing admission review: %v", err))
+	}
+}
+
+// review allows request unless it changes spec.name of a VM while names are
+// immutable.
+func (h *Handler) review(request *admissionv1beta1.AdmissionRequest) *admissionv1beta1.AdmissionResponse {
+	if request.Operation != admissionv1beta1.Update || request.Resource != vmResource || request.SubResource != "" ||
+		!h.immutableNames() {
+		return &admissionv1beta1.AdmissionResponse{Allowed: true}
+	}
+
+	var vm, old samplev1alpha1.VM
+	if err := json.Unmarshal(request.Object.Raw, &vm); err != nil {
+		return denied(http.StatusBadRequest, metav1.StatusReasonBadRequest, fmt.Sprintf("error decoding the VM: %v", err))
+	}
+	if err := json.Unmarshal(request.OldObject.Raw, &old); err != nil {
+		return denied(http.StatusBadRequest, metav1.StatusReasonBadRequest, fmt.Sprintf("error decoding the stored VM: %v", err))
+	}
+	if vm.Spec.Name != old.Spec.Name {
+		klog.Infof("Rejecting the change of spec.name of VM %s/%s from '%s' to '%s'", request.Namespace, request.Name, old.Spec.Name, vm.Spec.Name)
+		return denied(http.StatusUnprocessableEntity, metav1.StatusReasonInvalid,
+			fmt.Sprintf("spec.name is immutable: it may not change from %q to %q", old.Spec.Name, vm.Spec.Name))
+	}
+	return &admissionv1beta1.AdmissionResponse{Allowed: true}
+}
+
+func denied(code int32, reason metav1.StatusReason, message string) *admissionv1beta1.AdmissionResponse {
+	return &admissionv1beta1.AdmissionResponse{
+		Allowed: false,
+		Result: &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Code:    code,
+			Reason:  reason,
+			Message: message,
+		},
+	}
+}
+
+// Serve serves h over HTTPS on address until stopCh is closed, the API
+// server only calling webhooks over HTTPS.
+func Serve(address, certFile, keyFile string, h http.Handler, stopCh <-chan struct{}) error {
+	server := &http.Server{Addr: address, Handler: h}
+	go func() {
+		<-stopCh
+		server.Close()
+	}()
+
+	klog.Infof("Serving the admission webhook on https://%s", address)
+	err := server.ListenAndServeTLS(certFile, keyFile)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
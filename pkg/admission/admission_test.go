@@ -0,0 +1,104 @@
+package admission
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	samplev1alpha1 "k8s.io/sample-controller/pkg/apis/samplecontroller/v1alpha1"
+)
+
+func newVM(name string) *samplev1alpha1.VM {
+	return &samplev1alpha1.VM{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: metav1.NamespaceDefault},
+		Spec:       samplev1alpha1.VMSpec{Name: name},
+	}
+}
+
+// send reviews the edit of old into vm, and returns the response.
+func send(t *testing.T, h http.Handler, operation admissionv1beta1.Operation, subresource string, old, vm *samplev1alpha1.VM) *admissionv1beta1.AdmissionResponse {
+	request := &admissionv1beta1.AdmissionRequest{
+		UID:         types.UID("review-1"),
+		Resource:    vmResource,
+		SubResource: subresource,
+		Operation:   operation,
+		Namespace:   vm.Namespace,
+		Name:        vm.Name,
+	}
+	request.Object.Raw, _ = json.Marshal(vm)
+	if old != nil {
+		request.OldObject.Raw, _ = json.Marshal(old)
+	}
+	body, _ := json.Marshal(admissionv1beta1.AdmissionReview{Request: request})
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/", bytes.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the review to be answered, got %d: %s", w.Code, w.Body.String())
+	}
+	var review admissionv1beta1.AdmissionReview
+	if err := json.NewDecoder(w.Body).Decode(&review); err != nil {
+		t.Fatal(err)
+	}
+	if review.Response == nil || review.Response.UID != request.UID {
+		t.Fatalf("expected a response to review %s, got %+v", request.UID, review.Response)
+	}
+	return review.Response
+}
+
+func TestRejectsNameChange(t *testing.T) {
+	h := NewHandler(func() bool { return true })
+
+	response := send(t, h, admissionv1beta1.Update, "", newVM("server"), newVM("renamed"))
+	if response.Allowed || response.Result == nil || response.Result.Reason != metav1.StatusReasonInvalid {
+		t.Errorf("expected the change of spec.name to be rejected as invalid, got %+v", response)
+	}
+
+	// Edits keeping the name, new VMs and status updates are left alone.
+	edited := newVM("server")
+	edited.Labels = map[string]string{"team": "a"}
+	for name, response := range map[string]*admissionv1beta1.AdmissionResponse{
+		"other edit": send(t, h, admissionv1beta1.Update, "", newVM("server"), edited),
+		"create":     send(t, h, admissionv1beta1.Create, "", nil, newVM("server")),
+		"status":     send(t, h, admissionv1beta1.Update, "status", newVM("server"), newVM("renamed")),
+	} {
+		if !response.Allowed {
+			t.Errorf("%s: expected to be allowed, got %+v", name, response.Result)
+		}
+	}
+}
+
+func TestAllowsNameChangeWhenMutable(t *testing.T) {
+	immutable := false
+	h := NewHandler(func() bool { return immutable })
+
+	if response := send(t, h, admissionv1beta1.Update, "", newVM("server"), newVM("renamed")); !response.Allowed {
+		t.Errorf("expected the change of spec.name to be allowed, got %+v", response.Result)
+	}
+
+	// The policy is read on every review.
+	immutable = true
+	if response := send(t, h, admissionv1beta1.Update, "", newVM("server"), newVM("renamed")); response.Allowed {
+		t.Errorf("expected the change of spec.name to be rejected once names are immutable")
+	}
+}
+
+func TestRejectsMalformedReview(t *testing.T) {
+	h := NewHandler(func() bool { return true })
+	for name, body := range map[string]string{
+		"not JSON":   "{",
+		"no request": "{}",
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("POST", "/", bytes.NewReader([]byte(body))))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected %d, got %d", name, http.StatusBadRequest, w.Code)
+		}
+	}
+}
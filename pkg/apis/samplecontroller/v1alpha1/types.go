@@ -17,6 +17,7 @@ limitations under the License.
 package v1alpha1
 
 import (
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -34,13 +35,136 @@ type VM struct {
 
 // VMSpec is the spec for a VM resource
 type VMSpec struct {
+	// Name is the name of the cloud server. Whether it may be edited is up
+	// to the nameChangePolicy of the controller: Rename renames the server,
+	// Immutable has the admission webhook of the controller reject the edit.
 	Name string `json:"name"`
+
+	// DeletionPolicy decides what happens to the cloud server when the VM
+	// is deleted. Defaults to Delete.
+	DeletionPolicy DeletionPolicy `json:"deletionPolicy,omitempty"`
+
+	// Adopt claims an existing server with this name instead of treating it
+	// as a collision. The server must be unowned, or its owner must have let
+	// go of it: retained it when deleted, or no longer exist.
+	Adopt bool `json:"adopt,omitempty"`
+
+	// Size is the size the cloud server is expected to have. A server of
+	// another size is reported as drifted.
+	Size string `json:"size,omitempty"`
+
+	// PowerState is the power state the cloud server is expected to be in.
+	// A server in another state is reported as drifted.
+	PowerState string `json:"powerState,omitempty"`
+
+	// DriftPolicy decides what happens when the cloud server changes or
+	// disappears behind the controller's back. Defaults to Recreate.
+	DriftPolicy DriftPolicy `json:"driftPolicy,omitempty"`
 }
 
+// DeletionPolicy describes what happens to the cloud server of a deleted VM.
+type DeletionPolicy string
+
+const (
+	// DeletionPolicyDelete deletes the cloud server along with the VM.
+	DeletionPolicyDelete DeletionPolicy = "Delete"
+	// DeletionPolicyRetain leaves the cloud server running and owned. The
+	// server is only marked as retained, so it is not collected as orphaned.
+	DeletionPolicyRetain DeletionPolicy = "Retain"
+	// DeletionPolicyDetach leaves the cloud server running and clears its
+	// ownership metadata, so it is no longer tied to the VM.
+	DeletionPolicyDetach DeletionPolicy = "Detach"
+)
+
+// DriftPolicy describes how the controller reacts to drift between the VM and
+// its cloud server.
+type DriftPolicy string
+
+const (
+	// DriftPolicyRecreate recreates a missing server and reports any drift.
+	DriftPolicyRecreate DriftPolicy = "Recreate"
+	// DriftPolicyReport reports drift without acting on it.
+	DriftPolicyReport DriftPolicy = "Report"
+	// DriftPolicyIgnore neither reports drift nor heals it. A missing server
+	// is not recreated either, it is only recorded in the Drifted condition.
+	DriftPolicyIgnore DriftPolicy = "Ignore"
+)
+
 // VMStatus is the status for a VM resource
 type VMStatus struct {
 	VMID           string `json:"vmId"`
 	CpuUtilization int    `json:"cpuUtilization"`
+
+	// ServerName is the name the cloud server had when it was last synced.
+	// A spec.name that differs from it is a rename of the VM.
+	ServerName string `json:"serverName,omitempty"`
+	// Size is the size of the cloud server when it was last synced.
+	Size string `json:"size,omitempty"`
+	// PowerState is the power state of the cloud server when it was last
+	// synced.
+	PowerState string `json:"powerState,omitempty"`
+
+	// Metrics is the latest sample of the guest metrics of the cloud server.
+	Metrics *VMMetrics `json:"metrics,omitempty"`
+
+	// Conditions describe problems the controller ran into while managing
+	// the VM.
+	Conditions []VMCondition `json:"conditions,omitempty"`
+}
+
+// VMMetrics is a sample of the guest metrics of a VM, as reported by the
+// cloud. The disk and network figures are totals since the server booted.
+type VMMetrics struct {
+	// Timestamp is when the sample was taken.
+	Timestamp metav1.Time `json:"timestamp"`
+
+	CpuUtilization   int   `json:"cpuUtilization"`
+	MemoryUsageBytes int64 `json:"memoryUsageBytes"`
+	DiskReadBytes    int64 `json:"diskReadBytes"`
+	DiskWriteBytes   int64 `json:"diskWriteBytes"`
+	NetworkRxBytes   int64 `json:"networkRxBytes"`
+	NetworkTxBytes   int64 `json:"networkTxBytes"`
+	UptimeSeconds    int64 `json:"uptimeSeconds"`
+
+	// CpuUtilizationAverage and MemoryUsageBytesAverage are computed by the
+	// controller from the samples it took. They cover a shorter time after
+	// the controller starts.
+	CpuUtilizationAverage   MetricAverages `json:"cpuUtilizationAverage"`
+	MemoryUsageBytesAverage MetricAverages `json:"memoryUsageBytesAverage"`
+}
+
+// MetricAverages are the rolling averages of a metric over the last 1, 5 and
+// 15 minutes.
+type MetricAverages struct {
+	OneMinute      int64 `json:"1m"`
+	FiveMinutes    int64 `json:"5m"`
+	FifteenMinutes int64 `json:"15m"`
+}
+
+// VMConditionType is a valid value for VMCondition.Type
+type VMConditionType string
+
+const (
+	// VMIDMismatch means the server recorded in the status no longer carries
+	// the name from the spec.
+	VMIDMismatch VMConditionType = "IDMismatch"
+	// VMNameChangeRejected means spec.name was changed while the controller
+	// treats it as immutable.
+	VMNameChangeRejected VMConditionType = "NameChangeRejected"
+	// VMConflict means the server the VM refers to is not owned by it.
+	VMConflict VMConditionType = "Conflict"
+	// VMDrifted means the cloud server disappeared and, per the drift
+	// policy, was not recreated.
+	VMDrifted VMConditionType = "Drifted"
+)
+
+// VMCondition describes the state of a VM at a certain point.
+type VMCondition struct {
+	Type               VMConditionType        `json:"type"`
+	Status             corev1.ConditionStatus `json:"status"`
+	LastTransitionTime metav1.Time            `json:"lastTransitionTime,omitempty"`
+	Reason             string                 `json:"reason,omitempty"`
+	Message            string                 `json:"message,omitempty"`
 }
 
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
@@ -24,13 +24,29 @@ import (
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *MetricAverages) DeepCopyInto(out *MetricAverages) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new MetricAverages.
+func (in *MetricAverages) DeepCopy() *MetricAverages {
+	if in == nil {
+		return nil
+	}
+	out := new(MetricAverages)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *VM) DeepCopyInto(out *VM) {
 	*out = *in
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
 	out.Spec = in.Spec
-	out.Status = in.Status
+	in.Status.DeepCopyInto(&out.Status)
 	return
 }
 
@@ -52,6 +68,23 @@ func (in *VM) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VMCondition) DeepCopyInto(out *VMCondition) {
+	*out = *in
+	in.LastTransitionTime.DeepCopyInto(&out.LastTransitionTime)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VMCondition.
+func (in *VMCondition) DeepCopy() *VMCondition {
+	if in == nil {
+		return nil
+	}
+	out := new(VMCondition)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *VMList) DeepCopyInto(out *VMList) {
 	*out = *in
@@ -85,6 +118,25 @@ func (in *VMList) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VMMetrics) DeepCopyInto(out *VMMetrics) {
+	*out = *in
+	in.Timestamp.DeepCopyInto(&out.Timestamp)
+	out.CpuUtilizationAverage = in.CpuUtilizationAverage
+	out.MemoryUsageBytesAverage = in.MemoryUsageBytesAverage
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VMMetrics.
+func (in *VMMetrics) DeepCopy() *VMMetrics {
+	if in == nil {
+		return nil
+	}
+	out := new(VMMetrics)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *VMSpec) DeepCopyInto(out *VMSpec) {
 	*out = *in
@@ -104,6 +156,18 @@ func (in *VMSpec) DeepCopy() *VMSpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *VMStatus) DeepCopyInto(out *VMStatus) {
 	*out = *in
+	if in.Metrics != nil {
+		in, out := &in.Metrics, &out.Metrics
+		*out = new(VMMetrics)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]VMCondition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 	return
 }
 
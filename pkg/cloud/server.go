@@ -1,36 +1,142 @@
 package cloud
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
 	"path"
+	"strings"
 
 	"gopkg.in/resty.v1"
 )
 
+var (
+	// ErrServerNotFound is returned when the cloud has no server matching
+	// the request.
+	ErrServerNotFound = errors.New("server not found")
+
+	// ErrNotSupported is returned when the cloud does not implement an
+	// optional endpoint.
+	ErrNotSupported = errors.New("not supported by the cloud")
+)
+
 type Cloud struct {
 	Address string
+	// Context, if set, is given to every request, which is abandoned once
+	// it is done.
+	Context context.Context
+}
+
+const (
+	// OwnerMetadataPrefix prefixes the server metadata keys that record
+	// which VM owns a server.
+	OwnerMetadataPrefix = "samplecontroller.k8s.io/"
+	// OwnerClusterIDKey is the metadata key holding the ID of the cluster
+	// of the owning VM.
+	OwnerClusterIDKey = OwnerMetadataPrefix + "owner-cluster-id"
+	// OwnerNamespaceKey is the metadata key holding the namespace of the
+	// owning VM.
+	OwnerNamespaceKey = OwnerMetadataPrefix + "owner-namespace"
+	// OwnerNameKey is the metadata key holding the name of the owning VM.
+	OwnerNameKey = OwnerMetadataPrefix + "owner-name"
+	// OwnerUIDKey is the metadata key holding the UID of the owning VM.
+	OwnerUIDKey = OwnerMetadataPrefix + "owner-uid"
+	// OwnerScopeKey is the metadata key identifying the VMs watched by the
+	// controller that created the server, when it does not watch them all.
+	OwnerScopeKey = OwnerMetadataPrefix + "owner-scope"
+	// RetainedKey marks a server that was deliberately left running after
+	// its VM was deleted.
+	RetainedKey = OwnerMetadataPrefix + "retained"
+)
+
+// Owner identifies the Kubernetes object owning a server. A server without
+// ownership metadata has a zero Owner.
+type Owner struct {
+	ClusterID string
+	Namespace string
+	Name      string
+	UID       string
+	// Scope identifies the VMs watched by the controller of the owner, empty
+	// if it watches them all.
+	Scope string
+}
+
+// Metadata returns the server metadata recording o as the owner.
+func (o Owner) Metadata() map[string]string {
+	metadata := map[string]string{
+		OwnerClusterIDKey: o.ClusterID,
+		OwnerNamespaceKey: o.Namespace,
+		OwnerNameKey:      o.Name,
+		OwnerUIDKey:       o.UID,
+	}
+	if o.Scope != "" {
+		metadata[OwnerScopeKey] = o.Scope
+	}
+	return metadata
+}
+
+func (o Owner) String() string {
+	return fmt.Sprintf("%s/%s (uid %s) in cluster %q", o.Namespace, o.Name, o.UID, o.ClusterID)
+}
+
+// Server is a server as known to the cloud.
+type Server struct {
+	ID         string            `json:"id"`
+	Name       string            `json:"name"`
+	Size       string            `json:"size,omitempty"`
+	PowerState string            `json:"powerState,omitempty"`
+	Metadata   map[string]string `json:"metadata,omitempty"`
 }
 
-type server struct {
-	ID   string `json:"id"`
-	Name string `json:"name"`
+// Owner returns the owner recorded in the metadata of the server.
+func (s *Server) Owner() Owner {
+	return Owner{
+		ClusterID: s.Metadata[OwnerClusterIDKey],
+		Namespace: s.Metadata[OwnerNamespaceKey],
+		Name:      s.Metadata[OwnerNameKey],
+		UID:       s.Metadata[OwnerUIDKey],
+		Scope:     s.Metadata[OwnerScopeKey],
+	}
 }
 
-type status struct {
-	CpuUtilization int `json:"cpuUtilization"`
+// Retained reports whether the server was deliberately left running after
+// its VM was deleted.
+func (s *Server) Retained() bool {
+	return s.Metadata[RetainedKey] == "true"
 }
 
-type AuthSuccess struct {
-	/* variables */
+// ServerStatus is a sample of the guest metrics of a server. The disk and
+// network figures are totals since the server booted.
+type ServerStatus struct {
+	CpuUtilization   int   `json:"cpuUtilization"`
+	MemoryUsageBytes int64 `json:"memoryUsageBytes"`
+	DiskReadBytes    int64 `json:"diskReadBytes"`
+	DiskWriteBytes   int64 `json:"diskWriteBytes"`
+	NetworkRxBytes   int64 `json:"networkRxBytes"`
+	NetworkTxBytes   int64 `json:"networkTxBytes"`
+	UptimeSeconds    int64 `json:"uptimeSeconds"`
+}
+
+// Ping checks the cloud answers. No endpoint is meant for it, so any answer
+// short of a server error will do.
+func (c *Cloud) Ping() error {
+	resp, err := c.request().Get(c.Address)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode() >= http.StatusInternalServerError {
+		return fmt.Errorf("cloud answered with status code %v", resp.StatusCode())
+	}
+	return nil
 }
 
 func (c *Cloud) IsExistServer(name string) bool {
 	url, _ := url.Parse(c.Address)
 	url.Path = path.Join(url.Path, "check", name)
-	resp, err := resty.R().Get(url.String())
+	resp, err := c.request().Get(url.String())
 	if err != nil {
 		return false // TODO need to return err
 	}
@@ -44,7 +150,7 @@ func (c *Cloud) IsExistServer(name string) bool {
 func (c *Cloud) IsProhibitedServer(name string) bool {
 	url, _ := url.Parse(c.Address)
 	url.Path = path.Join(url.Path, "check", name)
-	resp, err := resty.R().Get(url.String())
+	resp, err := c.request().Get(url.String())
 	if err != nil {
 		return false // TODO need to return err
 	}
@@ -56,87 +162,306 @@ func (c *Cloud) IsProhibitedServer(name string) bool {
 	return false
 }
 
-func (c *Cloud) GetUUID(name string) (string, error) {
-	servers := []server{}
+// ListServers returns all servers known to the cloud.
+func (c *Cloud) ListServers() ([]Server, error) {
+	servers := []Server{}
 	url, _ := url.Parse(c.Address)
 	url.Path = path.Join(url.Path, "servers")
 
-	resp, err := resty.R().Get(url.String())
+	resp, err := c.request().Get(url.String())
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return nil, fmt.Errorf("failed to list servers Status code %v", resp.StatusCode())
 	}
 	json.Unmarshal(resp.Body(), &servers)
-	for _, server := range servers {
-		if server.Name == name {
-			return server.ID, nil
+	return servers, nil
+}
+
+// GetServer returns the server with the given name. Names are not unique, so
+// the server owned by the VM with ownerUID is preferred over the others.
+func (c *Cloud) GetServer(name string, ownerUID string) (*Server, error) {
+	servers, err := c.ListServers()
+	if err != nil {
+		return nil, err
+	}
+	var found *Server
+	for i := range servers {
+		if servers[i].Name != name {
+			continue
 		}
+		if ownerUID != "" && servers[i].Owner().UID == ownerUID {
+			return &servers[i], nil
+		}
+		if found == nil {
+			found = &servers[i]
+		}
+	}
+	if found == nil {
+		return nil, ErrServerNotFound
 	}
-	return "", fmt.Errorf("server not found")
+	return found, nil
 }
 
-func (c *Cloud) getStatusByUUID(uuid string) (string, int, error) {
-	status := status{}
+// GetServerByID returns the server with the given ID.
+func (c *Cloud) GetServerByID(uuid string) (*Server, error) {
+	server := &Server{}
+	url, _ := url.Parse(c.Address)
+	url.Path = path.Join(url.Path, "servers", uuid)
+	resp, err := c.request().Get(url.String())
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode() {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, ErrServerNotFound
+	default:
+		return nil, fmt.Errorf("failed to get %s Status code %v", uuid, resp.StatusCode())
+	}
+	if err := json.Unmarshal(resp.Body(), server); err != nil {
+		return nil, err
+	}
+	return server, nil
+}
+
+// GetStatusByID returns the CPU utilization of the server with the given ID.
+func (c *Cloud) GetStatusByID(uuid string) (int, error) {
+	status, err := c.GetServerStatusByID(uuid)
+	if err != nil {
+		return -1, err
+	}
+	return status.CpuUtilization, nil
+}
+
+// GetServerStatusByID returns the guest metrics of the server with the given
+// ID.
+func (c *Cloud) GetServerStatusByID(uuid string) (*ServerStatus, error) {
+	status := &ServerStatus{}
 	url, _ := url.Parse(c.Address)
 	url.Path = path.Join(url.Path, "servers", uuid, "status")
-	resp, err := resty.R().Get(url.String())
+	resp, err := c.request().Get(url.String())
 	if err != nil {
-		return "", -1, err
+		return nil, err
+	}
+
+	switch resp.StatusCode() {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, ErrServerNotFound
+	default:
+		return nil, fmt.Errorf("failed to get status of %s Status code %v", uuid, resp.StatusCode())
 	}
-	json.Unmarshal(resp.Body(), &status)
-	return uuid, status.CpuUtilization, nil
+	json.Unmarshal(resp.Body(), status)
+	return status, nil
 }
 
-func (c *Cloud) GetStatus(name string) (string, int, error) {
-	uuid, err := c.GetUUID(name)
+// GetStatuses returns the guest metrics of many servers in one request, by
+// server ID. Servers the cloud does not know are left out. It returns
+// ErrNotSupported if the cloud has no bulk status endpoint.
+func (c *Cloud) GetStatuses(uuids []string) (map[string]ServerStatus, error) {
+	body, err := json.Marshal(map[string][]string{"ids": uuids})
 	if err != nil {
-		return "", -1, nil
+		return nil, err
 	}
 
-	return c.getStatusByUUID(uuid)
+	url, _ := url.Parse(c.Address)
+	url.Path = path.Join(url.Path, "servers", "status")
+	resp, err := c.request().
+		SetHeader("Content-Type", "application/json").
+		SetBody(body).
+		Post(url.String())
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode() {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		return nil, ErrNotSupported
+	default:
+		return nil, fmt.Errorf("failed to get statuses Status code %v", resp.StatusCode())
+	}
+
+	statuses := map[string]ServerStatus{}
+	json.Unmarshal(resp.Body(), &statuses)
+	return statuses, nil
 }
 
-func (c *Cloud) CreateServer(name string) error {
-	server := server{Name: name}
+// CreateServer creates a server stamped with its owner and returns its ID.
+func (c *Cloud) CreateServer(name string, owner Owner) (string, error) {
+	server := Server{Name: name, Metadata: owner.Metadata()}
 	body, err := json.Marshal(server)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	url, _ := url.Parse(c.Address)
 	url.Path = path.Join(url.Path, "servers")
 
-	resp, err := resty.R().
+	resp, err := c.request().
 		SetHeader("Content-Type", "application/json").
 		SetBody(body).
-		SetResult(&AuthSuccess{}).
 		Post(url.String())
 
+	if err != nil {
+		return "", err
+	}
+
+	if resp.StatusCode() != http.StatusCreated {
+		return "", fmt.Errorf("failed to create %s Status code %v", name, resp.StatusCode())
+	}
+
+	json.Unmarshal(resp.Body(), &server)
+	if server.ID != "" {
+		return server.ID, nil
+	}
+	// Not every cloud echoes the new server back, look it up instead.
+	created, err := c.GetServer(name, owner.UID)
+	if err != nil {
+		return "", err
+	}
+	return created.ID, nil
+}
+
+// DeleteServerByID deletes the server with the given ID.
+func (c *Cloud) DeleteServerByID(uuid string) error {
+	url, _ := url.Parse(c.Address)
+	url.Path = path.Join(url.Path, "servers", uuid)
+
+	resp, err := c.request().
+		Delete(url.String())
 	if err != nil {
 		return err
 	}
 
-	if resp.StatusCode() == http.StatusCreated {
+	switch resp.StatusCode() {
+	case http.StatusNoContent:
 		return nil
+	case http.StatusNotFound:
+		return ErrServerNotFound
 	}
-	return fmt.Errorf("failed to create %s Status code %v", name, resp.StatusCode())
+	return fmt.Errorf("failed to delete %s Status code %v", uuid, resp.StatusCode())
 }
 
-func (c *Cloud) DeleteServer(name string) error {
-	uuid, err := c.GetUUID(name)
+// RenameServerByID renames the server with the given ID. The cloud replaces
+// the server with what is put, so the rest of the server, its metadata
+// included, is put back along with the new name.
+func (c *Cloud) RenameServerByID(uuid string, name string) error {
+	server, err := c.GetServerByID(uuid)
+	if err != nil {
+		return err
+	}
+	server.Name = name
+	body, err := json.Marshal(server)
 	if err != nil {
 		return err
 	}
+
 	url, _ := url.Parse(c.Address)
 	url.Path = path.Join(url.Path, "servers", uuid)
 
-	resp, err := resty.R().
-		Delete(url.String())
+	resp, err := c.request().
+		SetHeader("Content-Type", "application/json").
+		SetBody(body).
+		Put(url.String())
+	if err != nil {
+		return err
+	}
+
+	switch resp.StatusCode() {
+	case http.StatusOK, http.StatusNoContent:
+		return nil
+	case http.StatusNotFound:
+		return ErrServerNotFound
+	}
+	return fmt.Errorf("failed to rename %s to %s Status code %v", uuid, name, resp.StatusCode())
+}
+
+// SetOwnerByID records owner in the metadata of the server with the given ID,
+// keeping any other metadata it already has. A retained server is no longer
+// retained once it has an owner again.
+func (c *Cloud) SetOwnerByID(uuid string, owner Owner) error {
+	return c.addMetadata(uuid, owner.Metadata(), RetainedKey)
+}
+
+// RetainServerByID marks the server with the given ID as retained, keeping
+// its ownership metadata for reference.
+func (c *Cloud) RetainServerByID(uuid string) error {
+	return c.addMetadata(uuid, map[string]string{RetainedKey: "true"})
+}
+
+// addMetadata adds tags to the metadata of the server with the given ID, and
+// removes the keys in remove.
+func (c *Cloud) addMetadata(uuid string, tags map[string]string, remove ...string) error {
+	server, err := c.GetServerByID(uuid)
+	if err != nil {
+		return err
+	}
+
+	metadata := map[string]string{}
+	for k, v := range server.Metadata {
+		metadata[k] = v
+	}
+	for _, k := range remove {
+		delete(metadata, k)
+	}
+	for k, v := range tags {
+		metadata[k] = v
+	}
+	return c.setMetadata(server.ID, metadata)
+}
+
+// ReleaseServerByID clears the ownership metadata of the server with the
+// given ID and leaves it running.
+func (c *Cloud) ReleaseServerByID(uuid string) error {
+	server, err := c.GetServerByID(uuid)
+	if err != nil {
+		return err
+	}
+
+	metadata := map[string]string{}
+	for k, v := range server.Metadata {
+		if !strings.HasPrefix(k, OwnerMetadataPrefix) {
+			metadata[k] = v
+		}
+	}
+	return c.setMetadata(server.ID, metadata)
+}
+
+func (c *Cloud) setMetadata(uuid string, metadata map[string]string) error {
+	body, err := json.Marshal(metadata)
 	if err != nil {
 		return err
 	}
 
-	if resp.StatusCode() == http.StatusNoContent {
+	url, _ := url.Parse(c.Address)
+	url.Path = path.Join(url.Path, "servers", uuid, "metadata")
+
+	resp, err := c.request().
+		SetHeader("Content-Type", "application/json").
+		SetBody(body).
+		Put(url.String())
+	if err != nil {
+		return err
+	}
+
+	switch resp.StatusCode() {
+	case http.StatusOK, http.StatusNoContent:
 		return nil
+	case http.StatusNotFound:
+		return ErrServerNotFound
+	}
+	return fmt.Errorf("failed to set metadata of %s Status code %v", uuid, resp.StatusCode())
+}
+
+// request returns a new request, bound to the context of the cloud if set.
+func (c *Cloud) request() *resty.Request {
+	r := resty.R()
+	if c.Context != nil {
+		r.SetContext(c.Context)
 	}
-	return fmt.Errorf("failed to delete %s", name)
+	return r
 }
@@ -0,0 +1,312 @@
+// Package config defines ControllerConfiguration, the versioned file the
+// controller is configured with, along with its defaults, its validation
+// and the reloading of the fields that may change while the controller runs.
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// GroupName is the API group of the configuration file.
+	GroupName = "config.samplecontroller.k8s.io"
+	// Version is the version of the configuration file understood.
+	Version = "v1alpha1"
+	// Kind is the kind of the configuration file.
+	Kind = "ControllerConfiguration"
+)
+
+// Feature gates, all enabled unless turned off in FeatureGates.
+const (
+	// StatusPolling refreshes the guest metrics of all VMs in the background.
+	StatusPolling = "StatusPolling"
+	// BulkStatus asks the cloud for the status of all servers at once when
+	// polling, instead of one server at a time.
+	BulkStatus = "BulkStatus"
+	// OrphanCollection looks for servers whose VM is gone, and applies the
+	// orphan policy to them.
+	OrphanCollection = "OrphanCollection"
+)
+
+// Kinds of object the leader election lock may be held on.
+const (
+	LockTypeLease     = "Lease"
+	LockTypeConfigMap = "ConfigMap"
+	LockTypeEndpoints = "Endpoints"
+)
+
+// Policies for servers whose VM is gone.
+const (
+	// OrphanPolicyReport only reports orphaned servers.
+	OrphanPolicyReport = "Report"
+	// OrphanPolicyDelete deletes orphaned servers once they have been
+	// orphaned for the grace period.
+	OrphanPolicyDelete = "Delete"
+)
+
+var defaultFeatureGates = map[string]bool{
+	StatusPolling:    true,
+	BulkStatus:       true,
+	OrphanCollection: true,
+}
+
+// ControllerConfiguration configures the controller. The fields marked as
+// reloadable take effect while the controller runs, the others once it
+// restarts.
+type ControllerConfiguration struct {
+	metav1.TypeMeta `json:",inline"`
+
+	// Workers is the number of VMs reconciled at once.
+	Workers int `json:"workers"`
+	// InformerResync is how often the informers replay their whole cache.
+	InformerResync metav1.Duration `json:"informerResync"`
+	// VMResync is how long a synced VM waits before it is checked against
+	// the cloud again. Reloadable.
+	VMResync metav1.Duration `json:"vmResync"`
+	// NameChangePolicy decides what happens when spec.name of a VM is
+	// edited: Immutable rejects the change, Rename renames the server.
+	// Reloadable.
+	NameChangePolicy string `json:"nameChangePolicy"`
+	// ShutdownTimeout is how long to wait on shutdown for the syncs in
+	// flight and the events to be written, before cancelling them.
+	// Reloadable.
+	ShutdownTimeout metav1.Duration `json:"shutdownTimeout"`
+
+	Scope          ScopeConfiguration          `json:"scope"`
+	Cloud          CloudConfiguration          `json:"cloud"`
+	RateLimits     RateLimitConfiguration      `json:"rateLimits"`
+	LeaderElection LeaderElectionConfiguration `json:"leaderElection"`
+	Sharding       ShardingConfiguration       `json:"sharding"`
+	StatusPoll     StatusPollConfiguration     `json:"statusPoll"`
+	Orphans        OrphanConfiguration         `json:"orphans"`
+	Metrics        MetricsConfiguration        `json:"metrics"`
+	Webhook        WebhookConfiguration        `json:"webhook"`
+	Health         HealthConfiguration         `json:"health"`
+
+	// FeatureGates turns features on or off by name. Features left out
+	// keep their default.
+	FeatureGates map[string]bool `json:"featureGates,omitempty"`
+}
+
+// ScopeConfiguration restricts the VMs the controller watches, so that
+// several controllers, each with VMs of its own, can share a cluster.
+type ScopeConfiguration struct {
+	// Namespaces lists the namespaces watched, all of them if empty.
+	Namespaces []string `json:"namespaces,omitempty"`
+	// LabelSelector, if set, only watches the VMs it matches.
+	LabelSelector string `json:"labelSelector,omitempty"`
+}
+
+// CloudConfiguration configures how the cloud is reached.
+type CloudConfiguration struct {
+	// APIServer is the address of the cloud API server.
+	APIServer string `json:"apiServer"`
+	// ClusterID is recorded on every server the controller owns, telling
+	// apart servers of controllers in different clusters.
+	ClusterID string `json:"clusterID"`
+}
+
+// RateLimitConfiguration configures how fast the controller retries VMs and
+// talks to the Kubernetes API.
+type RateLimitConfiguration struct {
+	// BaseDelay is how long a VM that failed to sync waits before it is
+	// retried, doubled on every failure up to MaxDelay.
+	BaseDelay metav1.Duration `json:"baseDelay"`
+	MaxDelay  metav1.Duration `json:"maxDelay"`
+	// QPS and Burst limit the retries of all VMs together.
+	QPS   float64 `json:"qps"`
+	Burst int     `json:"burst"`
+	// KubeAPIQPS and KubeAPIBurst limit the requests to the Kubernetes API.
+	KubeAPIQPS   float32 `json:"kubeAPIQPS"`
+	KubeAPIBurst int     `json:"kubeAPIBurst"`
+}
+
+// LeaderElectionConfiguration configures the election of the replica
+// running the controller.
+type LeaderElectionConfiguration struct {
+	// LeaderElect elects a leader among the replicas to run the
+	// controller. Disable it for a single replica.
+	LeaderElect   bool   `json:"leaderElect"`
+	LockName      string `json:"lockName"`
+	LockNamespace string `json:"lockNamespace"`
+	// LockType is the kind of object the lock is held on: Lease,
+	// ConfigMap or Endpoints.
+	LockType string `json:"lockType"`
+	// Identity defaults to POD_NAME or the host name.
+	Identity      string          `json:"identity,omitempty"`
+	LeaseDuration metav1.Duration `json:"leaseDuration"`
+	RenewDeadline metav1.Duration `json:"renewDeadline"`
+	RetryPeriod   metav1.Duration `json:"retryPeriod"`
+}
+
+// ShardingConfiguration configures the sharing of the VMs among replicas,
+// which replaces the leader election when enabled.
+type ShardingConfiguration struct {
+	Enabled   bool   `json:"enabled"`
+	Group     string `json:"group"`
+	Namespace string `json:"namespace"`
+	// Identity defaults to POD_NAME or the host name.
+	Identity      string          `json:"identity,omitempty"`
+	LeaseDuration metav1.Duration `json:"leaseDuration"`
+	RenewPeriod   metav1.Duration `json:"renewPeriod"`
+}
+
+// StatusPollConfiguration configures the refreshing of the guest metrics of
+// VMs.
+type StatusPollConfiguration struct {
+	// Interval is how often all VMs are refreshed, 0 to never refresh them.
+	// Up to Jitter times the interval is added to each interval.
+	Interval metav1.Duration `json:"interval"`
+	Jitter   float64         `json:"jitter"`
+	// CPUUtilizationThreshold is the smallest change in CPU utilization
+	// written to the status of a VM. Reloadable.
+	CPUUtilizationThreshold int `json:"cpuUtilizationThreshold"`
+}
+
+// OrphanConfiguration configures what is done with servers whose VM is gone.
+type OrphanConfiguration struct {
+	// Policy is Report, Delete, or empty to not look for orphans.
+	Policy string `json:"policy"`
+	// ScanPeriod is how often to look for orphans.
+	ScanPeriod metav1.Duration `json:"scanPeriod"`
+	// GracePeriod is how long a server must stay orphaned before it is
+	// deleted with the Delete policy.
+	GracePeriod metav1.Duration `json:"gracePeriod"`
+}
+
+// MetricsConfiguration configures where metrics are served.
+type MetricsConfiguration struct {
+	// Address serves the Prometheus metrics, the /leader status and the
+	// probes, empty to not serve them.
+	Address string `json:"address"`
+	// CustomMetricsAddress serves the custom.metrics.k8s.io API, empty to
+	// not serve it, with the given serving certificate. Only clients with
+	// a certificate signed by CustomMetricsClientCAFile may use it, if set.
+	CustomMetricsAddress      string `json:"customMetricsAddress,omitempty"`
+	CustomMetricsCertFile     string `json:"customMetricsCertFile,omitempty"`
+	CustomMetricsKeyFile      string `json:"customMetricsKeyFile,omitempty"`
+	CustomMetricsClientCAFile string `json:"customMetricsClientCAFile,omitempty"`
+}
+
+// WebhookConfiguration configures the validating admission webhook, which
+// rejects edits of spec.name while nameChangePolicy is Immutable.
+type WebhookConfiguration struct {
+	// Address serves the webhook, empty to not serve it, with the given
+	// serving certificate: the API server only calls webhooks over HTTPS.
+	Address  string `json:"address,omitempty"`
+	CertFile string `json:"certFile,omitempty"`
+	KeyFile  string `json:"keyFile,omitempty"`
+}
+
+// HealthConfiguration configures the probes.
+type HealthConfiguration struct {
+	// CloudCheckInterval is how often the readiness probe checks the cloud
+	// answers.
+	CloudCheckInterval metav1.Duration `json:"cloudCheckInterval"`
+	// WorkerStuckTimeout is how long VMs may stay queued without any
+	// worker taking or finishing one before the liveness probe fails.
+	// Reloadable.
+	WorkerStuckTimeout metav1.Duration `json:"workerStuckTimeout"`
+}
+
+// Default returns the configuration used for everything the file and the
+// flags leave out. The election lock and the shard Leases live in the
+// namespace of the pod, taken from POD_NAMESPACE, or in kube-system.
+func Default() *ControllerConfiguration {
+	namespace := os.Getenv("POD_NAMESPACE")
+	if namespace == "" {
+		namespace = "kube-system"
+	}
+	return &ControllerConfiguration{
+		TypeMeta:         metav1.TypeMeta{APIVersion: GroupName + "/" + Version, Kind: Kind},
+		Workers:          2,
+		InformerResync:   metav1.Duration{Duration: 30 * time.Second},
+		VMResync:         metav1.Duration{Duration: 30 * time.Second},
+		NameChangePolicy: "Immutable",
+		ShutdownTimeout:  metav1.Duration{Duration: 20 * time.Second},
+		RateLimits: RateLimitConfiguration{
+			BaseDelay:    metav1.Duration{Duration: 5 * time.Millisecond},
+			MaxDelay:     metav1.Duration{Duration: 1000 * time.Second},
+			QPS:          10,
+			Burst:        100,
+			KubeAPIQPS:   5,
+			KubeAPIBurst: 10,
+		},
+		LeaderElection: LeaderElectionConfiguration{
+			LeaderElect:   true,
+			LockName:      "simple-controller-lock",
+			LockNamespace: namespace,
+			LockType:      LockTypeLease,
+			LeaseDuration: metav1.Duration{Duration: 5 * time.Second},
+			RenewDeadline: metav1.Duration{Duration: 2 * time.Second},
+			RetryPeriod:   metav1.Duration{Duration: 1 * time.Second},
+		},
+		Sharding: ShardingConfiguration{
+			Group:         "sample-controller",
+			Namespace:     namespace,
+			LeaseDuration: metav1.Duration{Duration: 15 * time.Second},
+			RenewPeriod:   metav1.Duration{Duration: 5 * time.Second},
+		},
+		StatusPoll: StatusPollConfiguration{
+			Interval:                metav1.Duration{Duration: 30 * time.Second},
+			Jitter:                  0.1,
+			CPUUtilizationThreshold: 1,
+		},
+		Orphans: OrphanConfiguration{
+			Policy:      OrphanPolicyReport,
+			ScanPeriod:  metav1.Duration{Duration: 5 * time.Minute},
+			GracePeriod: metav1.Duration{Duration: time.Hour},
+		},
+		Metrics: MetricsConfiguration{
+			Address: ":2112",
+		},
+		Health: HealthConfiguration{
+			CloudCheckInterval: metav1.Duration{Duration: 10 * time.Second},
+			WorkerStuckTimeout: metav1.Duration{Duration: 5 * time.Minute},
+		},
+	}
+}
+
+// Load reads the configuration file at path. Fields it leaves out are
+// defaulted, and it is not validated yet, so that flags can be applied on
+// top first.
+func Load(path string) (*ControllerConfiguration, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c, err := Decode(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return c, nil
+}
+
+// Decode decodes a configuration file, in YAML or JSON, on top of the
+// defaults. Unknown fields are errors, so that typos are not ignored.
+func Decode(data []byte) (*ControllerConfiguration, error) {
+	c := Default()
+	c.TypeMeta = metav1.TypeMeta{}
+	if err := yaml.UnmarshalStrict(data, c); err != nil {
+		return nil, err
+	}
+	if c.APIVersion != GroupName+"/"+Version || c.Kind != Kind {
+		return nil, fmt.Errorf("unsupported apiVersion %q and kind %q, expected %s/%s and %s",
+			c.APIVersion, c.Kind, GroupName, Version, Kind)
+	}
+	return c, nil
+}
+
+// FeatureEnabled tells whether the feature gate with the given name is on.
+func (c *ControllerConfiguration) FeatureEnabled(name string) bool {
+	if enabled, ok := c.FeatureGates[name]; ok {
+		return enabled
+	}
+	return defaultFeatureGates[name]
+}
@@ -0,0 +1,167 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const sampleConfig = `
+apiVersion: config.samplecontroller.k8s.io/v1alpha1
+kind: ControllerConfiguration
+workers: 8
+vmResync: 1m
+cloud:
+  apiServer: http://cloud:8080
+rateLimits:
+  qps: 50
+leaderElection:
+  leaderElect: false
+featureGates:
+  BulkStatus: false
+`
+
+func TestDecode(t *testing.T) {
+	c, err := Decode([]byte(sampleConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Workers != 8 || c.VMResync.Duration != time.Minute || c.Cloud.APIServer != "http://cloud:8080" ||
+		c.RateLimits.QPS != 50 || c.LeaderElection.LeaderElect {
+		t.Errorf("expected the values in the file, got %+v", c)
+	}
+
+	defaults := Default()
+	if c.InformerResync != defaults.InformerResync || c.RateLimits.Burst != defaults.RateLimits.Burst ||
+		c.LeaderElection.LockName != defaults.LeaderElection.LockName {
+		t.Errorf("expected the defaults for the fields left out, got %+v", c)
+	}
+
+	if c.FeatureEnabled(BulkStatus) || !c.FeatureEnabled(StatusPolling) {
+		t.Errorf("expected only BulkStatus to be off, got %v", c.FeatureGates)
+	}
+	if err := c.Validate(); err != nil {
+		t.Errorf("expected the configuration to be valid, got %v", err)
+	}
+}
+
+func TestDecodeRejects(t *testing.T) {
+	for name, data := range map[string]string{
+		"unknown field":   sampleConfig + "wrokers: 2\n",
+		"no kind":         "apiVersion: config.samplecontroller.k8s.io/v1alpha1\n",
+		"unknown version": strings.Replace(sampleConfig, "v1alpha1", "v1", 1),
+		"not YAML":        "workers: [",
+	} {
+		if _, err := Decode([]byte(data)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for name, edit := range map[string]func(c *ControllerConfiguration){
+		"no workers":           func(c *ControllerConfiguration) { c.Workers = 0 },
+		"no VM resync":         func(c *ControllerConfiguration) { c.VMResync.Duration = 0 },
+		"unknown name policy":  func(c *ControllerConfiguration) { c.NameChangePolicy = "Ignore" },
+		"invalid namespace":    func(c *ControllerConfiguration) { c.Scope.Namespaces = []string{"Team A"} },
+		"repeated namespace":   func(c *ControllerConfiguration) { c.Scope.Namespaces = []string{"team-a", "team-a"} },
+		"invalid selector":     func(c *ControllerConfiguration) { c.Scope.LabelSelector = "team in a" },
+		"no cloud":             func(c *ControllerConfiguration) { c.Cloud.APIServer = "" },
+		"max under base delay": func(c *ControllerConfiguration) { c.RateLimits.MaxDelay.Duration = time.Millisecond },
+		"no QPS":               func(c *ControllerConfiguration) { c.RateLimits.QPS = 0 },
+		"invalid lock type":    func(c *ControllerConfiguration) { c.LeaderElection.LockType = "Secret" },
+		"short shard lease": func(c *ControllerConfiguration) {
+			c.Sharding.Enabled, c.Sharding.LeaseDuration.Duration = true, time.Second
+		},
+		"negative jitter":       func(c *ControllerConfiguration) { c.StatusPoll.Jitter = -1 },
+		"unknown orphan policy": func(c *ControllerConfiguration) { c.Orphans.Policy = "Adopt" },
+		"no stuck timeout":      func(c *ControllerConfiguration) { c.Health.WorkerStuckTimeout.Duration = 0 },
+		"webhook without cert":  func(c *ControllerConfiguration) { c.Webhook.Address = ":8443" },
+		"unknown feature gate":  func(c *ControllerConfiguration) { c.FeatureGates = map[string]bool{"Teleport": true} },
+	} {
+		c := Default()
+		c.Cloud.APIServer = "http://cloud:8080"
+		edit(c)
+		if err := c.Validate(); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	// Only the mode in use is checked.
+	c := Default()
+	c.Cloud.APIServer = "http://cloud:8080"
+	c.LeaderElection.LockType = "Secret"
+	c.Sharding.Enabled = true
+	if err := c.Validate(); err != nil {
+		t.Errorf("expected the election not to be checked when sharding, got %v", err)
+	}
+}
+
+func TestReload(t *testing.T) {
+	current := Default()
+	next := Default()
+	next.VMResync.Duration = time.Minute
+	next.StatusPoll.CPUUtilizationThreshold = 5
+	next.Workers = 8
+	next.LeaderElection.LockName = "other-lock"
+	next.FeatureGates = map[string]bool{BulkStatus: false}
+
+	reloaded, ignored := Reload(current, next)
+	if reloaded.VMResync.Duration != time.Minute || reloaded.StatusPoll.CPUUtilizationThreshold != 5 {
+		t.Errorf("expected the reloadable fields to be reloaded, got %+v", reloaded)
+	}
+	if reloaded.Workers != 2 || reloaded.LeaderElection.LockName != current.LeaderElection.LockName ||
+		!reloaded.FeatureEnabled(BulkStatus) {
+		t.Errorf("expected the other fields to be kept, got %+v", reloaded)
+	}
+	expected := []string{"workers", "leaderElection.lockName", "featureGates"}
+	if !reflect.DeepEqual(ignored, expected) {
+		t.Errorf("expected the changes to %v to be ignored, got %v", expected, ignored)
+	}
+	if current.VMResync.Duration != 30*time.Second {
+		t.Errorf("expected the current configuration to be left alone")
+	}
+
+	if _, ignored := Reload(current, Default()); len(ignored) != 0 {
+		t.Errorf("expected nothing ignored without changes, got %v", ignored)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(path, []byte(sampleConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	changed := Watch(path, 10*time.Millisecond, stopCh)
+
+	// Rewriting the same content is not a change.
+	if err := ioutil.WriteFile(path, []byte(sampleConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-changed:
+		t.Fatalf("expected no change for the same content")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := ioutil.WriteFile(path, []byte(sampleConfig+"workers: 4\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-changed:
+	case <-time.After(time.Second):
+		t.Fatalf("expected the change to be noticed")
+	}
+}
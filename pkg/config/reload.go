@@ -0,0 +1,84 @@
+package config
+
+import (
+	"bytes"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// Reload returns current with the reloadable fields taken from next, and
+// the other fields next changes, which only take effect on restart, by
+// their path in the file.
+func Reload(current, next *ControllerConfiguration) (*ControllerConfiguration, []string) {
+	reloaded := *current
+	reloaded.FeatureGates = map[string]bool{}
+	for name, enabled := range current.FeatureGates {
+		reloaded.FeatureGates[name] = enabled
+	}
+
+	reloaded.VMResync = next.VMResync
+	reloaded.NameChangePolicy = next.NameChangePolicy
+	reloaded.ShutdownTimeout = next.ShutdownTimeout
+	reloaded.StatusPoll.CPUUtilizationThreshold = next.StatusPoll.CPUUtilizationThreshold
+	reloaded.Health.WorkerStuckTimeout = next.Health.WorkerStuckTimeout
+
+	var ignored []string
+	diff("", reflect.ValueOf(reloaded), reflect.ValueOf(*next), &ignored)
+	return &reloaded, ignored
+}
+
+var durationType = reflect.TypeOf(metav1.Duration{})
+
+// diff appends the path of every field differing between a and b to paths.
+func diff(path string, a, b reflect.Value, paths *[]string) {
+	if a.Kind() != reflect.Struct || a.Type() == durationType {
+		// Unset and empty lists and feature gates are the same.
+		if (a.Kind() == reflect.Map || a.Kind() == reflect.Slice) && a.Len() == 0 && b.Len() == 0 {
+			return
+		}
+		if !reflect.DeepEqual(a.Interface(), b.Interface()) {
+			*paths = append(*paths, path)
+		}
+		return
+	}
+	for i := 0; i < a.NumField(); i++ {
+		name := strings.Split(a.Type().Field(i).Tag.Get("json"), ",")[0]
+		fieldPath := path
+		switch {
+		case name == "":
+			// Inlined, as the TypeMeta.
+		case path == "":
+			fieldPath = name
+		default:
+			fieldPath = path + "." + name
+		}
+		diff(fieldPath, a.Field(i), b.Field(i), paths)
+	}
+}
+
+// Watch returns a channel receiving whenever the content of the file at
+// path changes, checked every period until stopCh is closed. Reading the
+// content, rather than watching the file, also catches mounted ConfigMaps,
+// which are updated by swapping symbolic links.
+func Watch(path string, period time.Duration, stopCh <-chan struct{}) <-chan struct{} {
+	changed := make(chan struct{}, 1)
+	last, _ := ioutil.ReadFile(path)
+	go wait.Until(func() {
+		// A file briefly missing while being replaced is not a change.
+		data, err := ioutil.ReadFile(path)
+		if err != nil || bytes.Equal(data, last) {
+			return
+		}
+		last = data
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}, period, stopCh)
+	return changed
+}
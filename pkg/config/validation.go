@@ -0,0 +1,155 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/tools/leaderelection"
+)
+
+// Validate checks the configuration makes a working controller, and returns
+// the first problem found, prefixed with the field it is in.
+func (c *ControllerConfiguration) Validate() error {
+	if c.Workers <= 0 {
+		return fmt.Errorf("workers must be positive")
+	}
+	if c.InformerResync.Duration < 0 {
+		return fmt.Errorf("informerResync must not be negative")
+	}
+	if c.VMResync.Duration <= 0 {
+		return fmt.Errorf("vmResync must be positive")
+	}
+	switch c.NameChangePolicy {
+	case "Immutable", "Rename":
+	default:
+		return fmt.Errorf("invalid nameChangePolicy %q, must be Immutable or Rename", c.NameChangePolicy)
+	}
+	if c.ShutdownTimeout.Duration < 0 {
+		return fmt.Errorf("shutdownTimeout must not be negative")
+	}
+
+	namespaces := map[string]bool{}
+	for _, namespace := range c.Scope.Namespaces {
+		if errs := validation.IsDNS1123Label(namespace); len(errs) > 0 {
+			return fmt.Errorf("invalid namespace %q in scope.namespaces: %s", namespace, strings.Join(errs, ", "))
+		}
+		if namespaces[namespace] {
+			return fmt.Errorf("namespace %q appears twice in scope.namespaces", namespace)
+		}
+		namespaces[namespace] = true
+	}
+	if _, err := labels.Parse(c.Scope.LabelSelector); err != nil {
+		return fmt.Errorf("invalid scope.labelSelector: %v", err)
+	}
+
+	if c.Cloud.APIServer == "" {
+		return fmt.Errorf("cloud.apiServer must be set")
+	}
+
+	r := c.RateLimits
+	if r.BaseDelay.Duration <= 0 || r.MaxDelay.Duration < r.BaseDelay.Duration {
+		return fmt.Errorf("rateLimits.baseDelay must be positive, and at most rateLimits.maxDelay")
+	}
+	if r.QPS <= 0 || r.Burst <= 0 {
+		return fmt.Errorf("rateLimits.qps and rateLimits.burst must be positive")
+	}
+	if r.KubeAPIQPS <= 0 || r.KubeAPIBurst <= 0 {
+		return fmt.Errorf("rateLimits.kubeAPIQPS and rateLimits.kubeAPIBurst must be positive")
+	}
+
+	// Sharding replaces the election, which is only checked when used.
+	if c.Sharding.Enabled {
+		if err := c.Sharding.Validate(); err != nil {
+			return fmt.Errorf("sharding: %v", err)
+		}
+	} else if c.LeaderElection.LeaderElect {
+		if err := c.LeaderElection.Validate(); err != nil {
+			return fmt.Errorf("leaderElection: %v", err)
+		}
+	}
+
+	s := c.StatusPoll
+	if s.Interval.Duration < 0 || s.Jitter < 0 {
+		return fmt.Errorf("statusPoll.interval and statusPoll.jitter must not be negative")
+	}
+	if s.CPUUtilizationThreshold < 0 {
+		return fmt.Errorf("statusPoll.cpuUtilizationThreshold must not be negative")
+	}
+
+	switch c.Orphans.Policy {
+	case "":
+	case OrphanPolicyReport, OrphanPolicyDelete:
+		if c.Orphans.ScanPeriod.Duration <= 0 {
+			return fmt.Errorf("orphans.scanPeriod must be positive")
+		}
+	default:
+		return fmt.Errorf("invalid orphans.policy %q, must be empty, %s or %s", c.Orphans.Policy, OrphanPolicyReport, OrphanPolicyDelete)
+	}
+
+	if c.Webhook.Address != "" && (c.Webhook.CertFile == "" || c.Webhook.KeyFile == "") {
+		return fmt.Errorf("webhook.certFile and webhook.keyFile must be set to serve the webhook")
+	}
+
+	if c.Health.CloudCheckInterval.Duration < 0 {
+		return fmt.Errorf("health.cloudCheckInterval must not be negative")
+	}
+	if c.Health.WorkerStuckTimeout.Duration <= 0 {
+		return fmt.Errorf("health.workerStuckTimeout must be positive")
+	}
+
+	for name := range c.FeatureGates {
+		if _, ok := defaultFeatureGates[name]; !ok {
+			return fmt.Errorf("unknown feature gate %q, known gates are %v", name, knownFeatureGates())
+		}
+	}
+	return nil
+}
+
+// Validate checks the configuration makes a working election.
+func (c *LeaderElectionConfiguration) Validate() error {
+	if c.LockName == "" || c.LockNamespace == "" {
+		return fmt.Errorf("the lock needs a name and a namespace")
+	}
+	switch c.LockType {
+	case LockTypeLease, LockTypeConfigMap, LockTypeEndpoints:
+	default:
+		return fmt.Errorf("invalid lock type %q, must be %s, %s or %s", c.LockType, LockTypeLease, LockTypeConfigMap, LockTypeEndpoints)
+	}
+	if c.RetryPeriod.Duration <= 0 {
+		return fmt.Errorf("the retry period must be positive")
+	}
+	if c.RenewDeadline.Duration <= time.Duration(leaderelection.JitterFactor*float64(c.RetryPeriod.Duration)) {
+		return fmt.Errorf("the renew deadline must be longer than %v times the retry period", leaderelection.JitterFactor)
+	}
+	if c.LeaseDuration.Duration <= c.RenewDeadline.Duration {
+		return fmt.Errorf("the lease duration must be longer than the renew deadline")
+	}
+	return nil
+}
+
+// Validate checks the configuration makes a working group.
+func (c *ShardingConfiguration) Validate() error {
+	if c.Group == "" || c.Namespace == "" {
+		return fmt.Errorf("the group needs a name and a namespace")
+	}
+	if c.RenewPeriod.Duration <= 0 {
+		return fmt.Errorf("the renew period must be positive")
+	}
+	if c.LeaseDuration.Duration <= c.RenewPeriod.Duration {
+		return fmt.Errorf("the lease duration must be longer than the renew period")
+	}
+	return nil
+}
+
+func knownFeatureGates() []string {
+	var names []string
+	for name := range defaultFeatureGates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
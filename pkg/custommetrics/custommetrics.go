@@ -0,0 +1,228 @@
+// Package custommetrics serves the guest metrics of VMs through the
+// custom.metrics.k8s.io API, so horizontal pod autoscalers and other
+// consumers can use them. It is meant to run behind the API aggregation
+// layer, registered with an APIService.
+package custommetrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+
+	samplev1alpha1 "k8s.io/sample-controller/pkg/apis/samplecontroller/v1alpha1"
+	listers "k8s.io/sample-controller/pkg/generated/listers/samplecontroller/v1alpha1"
+)
+
+const (
+	// GroupName is the API group served.
+	GroupName = "custom.metrics.k8s.io"
+	// Version is the API version served.
+	Version = "v1beta1"
+)
+
+// vmResource is how VMs are named in metric paths, the plural resource
+// qualified with its group.
+var vmResource = schema.GroupResource{Group: samplev1alpha1.SchemeGroupVersion.Group, Resource: "vms"}.String()
+
+// MetricValueList is a list of values of a metric, as defined by
+// custom.metrics.k8s.io/v1beta1.
+type MetricValueList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []MetricValue `json:"items"`
+}
+
+// MetricValue is the value of a metric for a single object, as defined by
+// custom.metrics.k8s.io/v1beta1.
+type MetricValue struct {
+	DescribedObject corev1.ObjectReference `json:"describedObject"`
+	MetricName      string                 `json:"metricName"`
+	Timestamp       metav1.Time            `json:"timestamp"`
+	// WindowSeconds is the span the value was averaged over, if it is an
+	// average.
+	WindowSeconds *int64            `json:"window,omitempty"`
+	Value         resource.Quantity `json:"value"`
+}
+
+// metric reads a metric from the status of a VM.
+type metric struct {
+	windowSeconds int64
+	value         func(*samplev1alpha1.VMMetrics) int64
+}
+
+// metrics are the metrics served, by name.
+var metrics = map[string]metric{
+	"cpu_utilization": {
+		value: func(m *samplev1alpha1.VMMetrics) int64 { return int64(m.CpuUtilization) },
+	},
+	"cpu_utilization_1m": {
+		windowSeconds: 60,
+		value:         func(m *samplev1alpha1.VMMetrics) int64 { return m.CpuUtilizationAverage.OneMinute },
+	},
+	"cpu_utilization_5m": {
+		windowSeconds: 5 * 60,
+		value:         func(m *samplev1alpha1.VMMetrics) int64 { return m.CpuUtilizationAverage.FiveMinutes },
+	},
+	"cpu_utilization_15m": {
+		windowSeconds: 15 * 60,
+		value:         func(m *samplev1alpha1.VMMetrics) int64 { return m.CpuUtilizationAverage.FifteenMinutes },
+	},
+}
+
+// Handler serves custom.metrics.k8s.io from the status of the VMs in a
+// lister.
+type Handler struct {
+	vmsLister listers.VMLister
+}
+
+// NewHandler returns a handler serving the metrics of the VMs in vmsLister.
+func NewHandler(vmsLister listers.VMLister) *Handler {
+	return &Handler{vmsLister: vmsLister}
+}
+
+// ServeHTTP serves discovery at /apis/custom.metrics.k8s.io/v1beta1, and
+// metric values at
+//
+//	/apis/custom.metrics.k8s.io/v1beta1/namespaces/{namespace}/vms.samplecontroller.k8s.io/{name}/{metric}
+//
+// where name may be "*" for all VMs matching the labelSelector parameter.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeStatus(w, errors.NewMethodNotSupported(schema.GroupResource{Group: GroupName}, r.Method))
+		return
+	}
+
+	prefix := "/apis/" + GroupName + "/" + Version
+	if r.URL.Path != prefix && !strings.HasPrefix(r.URL.Path, prefix+"/") {
+		writeStatus(w, errors.NewNotFound(schema.GroupResource{}, r.URL.Path))
+		return
+	}
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, prefix), "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "":
+		writeJSON(w, http.StatusOK, discovery())
+	case len(parts) == 5 && parts[0] == "namespaces" && parts[2] == vmResource:
+		h.serveMetric(w, r, parts[1], parts[3], parts[4])
+	case len(parts) == 3 && parts[0] == vmResource:
+		writeStatus(w, errors.NewBadRequest("VMs are namespaced"))
+	default:
+		writeStatus(w, errors.NewNotFound(schema.GroupResource{Group: GroupName}, r.URL.Path))
+	}
+}
+
+func (h *Handler) serveMetric(w http.ResponseWriter, r *http.Request, namespace, name, metricName string) {
+	m, ok := metrics[metricName]
+	if !ok {
+		writeStatus(w, errors.NewNotFound(schema.GroupResource{Group: GroupName, Resource: "metrics"}, metricName))
+		return
+	}
+
+	var vms []*samplev1alpha1.VM
+	if name == "*" {
+		selector, err := labels.Parse(r.URL.Query().Get("labelSelector"))
+		if err != nil {
+			writeStatus(w, errors.NewBadRequest(err.Error()))
+			return
+		}
+		vms, err = h.vmsLister.VMs(namespace).List(selector)
+		if err != nil {
+			writeStatus(w, errors.NewInternalError(err))
+			return
+		}
+	} else {
+		vm, err := h.vmsLister.VMs(namespace).Get(name)
+		if err != nil {
+			writeStatus(w, err)
+			return
+		}
+		if vm.Status.Metrics == nil {
+			writeStatus(w, errors.NewNotFound(schema.GroupResource{Group: GroupName, Resource: "metrics"},
+				fmt.Sprintf("%s for VM %s/%s", metricName, namespace, name)))
+			return
+		}
+		vms = append(vms, vm)
+	}
+
+	list := &MetricValueList{
+		TypeMeta: metav1.TypeMeta{Kind: "MetricValueList", APIVersion: GroupName + "/" + Version},
+		ListMeta: metav1.ListMeta{SelfLink: r.URL.Path},
+		Items:    []MetricValue{},
+	}
+	for _, vm := range vms {
+		// VMs without a sample yet have no value.
+		if vm.Status.Metrics == nil {
+			continue
+		}
+		value := MetricValue{
+			DescribedObject: corev1.ObjectReference{
+				APIVersion: samplev1alpha1.SchemeGroupVersion.String(),
+				Kind:       "VM",
+				Namespace:  vm.Namespace,
+				Name:       vm.Name,
+				UID:        vm.UID,
+			},
+			MetricName: metricName,
+			Timestamp:  vm.Status.Metrics.Timestamp,
+			Value:      *resource.NewQuantity(m.value(vm.Status.Metrics), resource.DecimalSI),
+		}
+		if m.windowSeconds > 0 {
+			window := m.windowSeconds
+			value.WindowSeconds = &window
+		}
+		list.Items = append(list.Items, value)
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// discovery returns the resources served, one per metric of VMs.
+func discovery() *metav1.APIResourceList {
+	list := &metav1.APIResourceList{
+		TypeMeta:     metav1.TypeMeta{Kind: "APIResourceList", APIVersion: "v1"},
+		GroupVersion: GroupName + "/" + Version,
+	}
+	var names []string
+	for name := range metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		list.APIResources = append(list.APIResources, metav1.APIResource{
+			Name:       vmResource + "/" + name,
+			Namespaced: true,
+			Kind:       "MetricValueList",
+			Verbs:      metav1.Verbs{"get"},
+		})
+	}
+	return list
+}
+
+// writeStatus writes err as a Status, the way the API server reports
+// errors.
+func writeStatus(w http.ResponseWriter, err error) {
+	status, ok := err.(errors.APIStatus)
+	if !ok {
+		status = errors.NewInternalError(err)
+	}
+	s := status.Status()
+	s.TypeMeta = metav1.TypeMeta{Kind: "Status", APIVersion: "v1"}
+	writeJSON(w, int(s.Code), &s)
+}
+
+func writeJSON(w http.ResponseWriter, code int, obj interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(obj); err != nil {
+		utilruntime.HandleError(fmt.Errorf("error writing response: %v", err))
+	}
+}
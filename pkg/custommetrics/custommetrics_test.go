@@ -0,0 +1,167 @@
+package custommetrics
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+
+	samplev1alpha1 "k8s.io/sample-controller/pkg/apis/samplecontroller/v1alpha1"
+	listers "k8s.io/sample-controller/pkg/generated/listers/samplecontroller/v1alpha1"
+)
+
+var sampleTime = metav1.NewTime(time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC))
+
+func newVM(name string, app string, cpu int) *samplev1alpha1.VM {
+	vm := &samplev1alpha1.VM{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: metav1.NamespaceDefault,
+			Labels:    map[string]string{"app": app},
+		},
+	}
+	if cpu >= 0 {
+		vm.Status.Metrics = &samplev1alpha1.VMMetrics{
+			Timestamp:      sampleTime,
+			CpuUtilization: cpu,
+			CpuUtilizationAverage: samplev1alpha1.MetricAverages{
+				OneMinute: int64(cpu), FiveMinutes: int64(cpu) / 2, FifteenMinutes: int64(cpu) / 4,
+			},
+		}
+	}
+	return vm
+}
+
+// newAggregator starts the adapter behind a stand-in for the API
+// aggregation layer, which proxies the requests for the group to it, and
+// returns the URL of the stand-in.
+func newAggregator(t *testing.T, vms ...*samplev1alpha1.VM) (string, func()) {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	for _, vm := range vms {
+		indexer.Add(vm)
+	}
+	adapter := httptest.NewServer(NewHandler(listers.NewVMLister(indexer)))
+
+	adapterURL, _ := url.Parse(adapter.URL)
+	proxy := httputil.NewSingleHostReverseProxy(adapterURL)
+	aggregator := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/apis/"+GroupName+"/"+Version) {
+			http.NotFound(w, r)
+			return
+		}
+		proxy.ServeHTTP(w, r)
+	}))
+
+	return aggregator.URL, func() {
+		aggregator.Close()
+		adapter.Close()
+	}
+}
+
+func get(t *testing.T, base, path string, expectedCode int, into interface{}) {
+	resp, err := http.Get(base + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != expectedCode {
+		t.Fatalf("GET %s: expected status %d, got %d", path, expectedCode, resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(into); err != nil {
+		t.Fatalf("GET %s: %v", path, err)
+	}
+}
+
+func TestDiscovery(t *testing.T) {
+	base, stop := newAggregator(t)
+	defer stop()
+
+	list := &metav1.APIResourceList{}
+	get(t, base, "/apis/custom.metrics.k8s.io/v1beta1", http.StatusOK, list)
+
+	if list.GroupVersion != "custom.metrics.k8s.io/v1beta1" {
+		t.Errorf("expected group version custom.metrics.k8s.io/v1beta1, got %s", list.GroupVersion)
+	}
+	var names []string
+	for _, r := range list.APIResources {
+		names = append(names, r.Name)
+		if !r.Namespaced || r.Kind != "MetricValueList" {
+			t.Errorf("unexpected resource %+v", r)
+		}
+	}
+	expected := "vms.samplecontroller.k8s.io/cpu_utilization vms.samplecontroller.k8s.io/cpu_utilization_15m " +
+		"vms.samplecontroller.k8s.io/cpu_utilization_1m vms.samplecontroller.k8s.io/cpu_utilization_5m"
+	if strings.Join(names, " ") != expected {
+		t.Errorf("expected resources %s, got %s", expected, strings.Join(names, " "))
+	}
+}
+
+func TestGetMetric(t *testing.T) {
+	base, stop := newAggregator(t, newVM("web-1", "web", 40))
+	defer stop()
+
+	list := &MetricValueList{}
+	get(t, base, "/apis/custom.metrics.k8s.io/v1beta1/namespaces/default/vms.samplecontroller.k8s.io/web-1/cpu_utilization", http.StatusOK, list)
+
+	if list.Kind != "MetricValueList" || len(list.Items) != 1 {
+		t.Fatalf("expected a single value, got %+v", list)
+	}
+	value := list.Items[0]
+	if value.DescribedObject.Kind != "VM" || value.DescribedObject.Name != "web-1" || value.DescribedObject.Namespace != "default" {
+		t.Errorf("unexpected described object %+v", value.DescribedObject)
+	}
+	if value.Value.Value() != 40 || value.WindowSeconds != nil || !value.Timestamp.Equal(&sampleTime) {
+		t.Errorf("unexpected value %+v", value)
+	}
+
+	get(t, base, "/apis/custom.metrics.k8s.io/v1beta1/namespaces/default/vms.samplecontroller.k8s.io/web-1/cpu_utilization_5m", http.StatusOK, list)
+	value = list.Items[0]
+	if value.Value.Value() != 20 || value.WindowSeconds == nil || *value.WindowSeconds != 300 {
+		t.Errorf("unexpected average %+v", value)
+	}
+}
+
+func TestGetMetricBySelector(t *testing.T) {
+	base, stop := newAggregator(t,
+		newVM("web-1", "web", 40),
+		newVM("web-2", "web", 60),
+		newVM("web-3", "web", -1),
+		newVM("db-1", "db", 90))
+	defer stop()
+
+	list := &MetricValueList{}
+	get(t, base, "/apis/custom.metrics.k8s.io/v1beta1/namespaces/default/vms.samplecontroller.k8s.io/*/cpu_utilization?labelSelector=app%3Dweb", http.StatusOK, list)
+
+	values := map[string]int64{}
+	for _, item := range list.Items {
+		values[item.DescribedObject.Name] = item.Value.Value()
+	}
+	if len(values) != 2 || values["web-1"] != 40 || values["web-2"] != 60 {
+		t.Errorf("expected the values of web-1 and web-2, got %v", values)
+	}
+}
+
+func TestGetMetricNotFound(t *testing.T) {
+	base, stop := newAggregator(t, newVM("web-1", "web", 40), newVM("web-2", "web", -1))
+	defer stop()
+
+	for _, path := range []string{
+		"/apis/custom.metrics.k8s.io/v1beta1/namespaces/default/vms.samplecontroller.k8s.io/missing/cpu_utilization",
+		"/apis/custom.metrics.k8s.io/v1beta1/namespaces/default/vms.samplecontroller.k8s.io/web-2/cpu_utilization",
+		"/apis/custom.metrics.k8s.io/v1beta1/namespaces/default/vms.samplecontroller.k8s.io/web-1/memory",
+		"/apis/custom.metrics.k8s.io/v1beta1/namespaces/default/pods/web-1/cpu_utilization",
+	} {
+		status := &metav1.Status{}
+		get(t, base, path, http.StatusNotFound, status)
+		if status.Kind != "Status" || status.Reason != metav1.StatusReasonNotFound {
+			t.Errorf("GET %s: expected a NotFound status, got %+v", path, status)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package custommetrics
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"k8s.io/klog"
+)
+
+// Serve serves h on address until stopCh is closed. With certFile and
+// keyFile it serves HTTPS, which the aggregation layer requires. With
+// clientCAFile it only accepts clients presenting a certificate signed by
+// that CA, such as the front proxy of the aggregator.
+func Serve(address, certFile, keyFile, clientCAFile string, h http.Handler, stopCh <-chan struct{}) error {
+	server := &http.Server{Addr: address, Handler: h}
+	if clientCAFile != "" {
+		pem, err := ioutil.ReadFile(clientCAFile)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", clientCAFile)
+		}
+		server.TLSConfig = &tls.Config{
+			ClientCAs:  pool,
+			ClientAuth: tls.RequireAndVerifyClientCert,
+		}
+	}
+
+	go func() {
+		<-stopCh
+		server.Close()
+	}()
+
+	var err error
+	if certFile != "" || keyFile != "" {
+		klog.Infof("Serving custom metrics on https://%s", address)
+		err = server.ListenAndServeTLS(certFile, keyFile)
+	} else {
+		if clientCAFile != "" {
+			return fmt.Errorf("a client CA needs a serving certificate")
+		}
+		klog.Infof("Serving custom metrics on http://%s", address)
+		err = server.ListenAndServe()
+	}
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
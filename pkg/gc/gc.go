@@ -0,0 +1,242 @@
+package gc
+
+import (
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog"
+
+	samplev1alpha1 "k8s.io/sample-controller/pkg/apis/samplecontroller/v1alpha1"
+	vmctl "k8s.io/sample-controller/pkg/cloud"
+	"k8s.io/sample-controller/pkg/config"
+	listers "k8s.io/sample-controller/pkg/generated/listers/samplecontroller/v1alpha1"
+	"k8s.io/sample-controller/pkg/metrics"
+)
+
+// Policy decides what the collector does with orphaned servers.
+type Policy string
+
+const (
+	// PolicyReport only reports orphaned servers.
+	PolicyReport Policy = config.OrphanPolicyReport
+	// PolicyDelete deletes orphaned servers once they have been orphaned
+	// for the grace period.
+	PolicyDelete Policy = config.OrphanPolicyDelete
+)
+
+const (
+	// OrphanedServer is used as part of the Event 'reason' when a server
+	// owned by this cluster has no VM
+	OrphanedServer = "OrphanedServer"
+
+	// DeletedOrphanedServer is used as part of the Event 'reason' when an
+	// orphaned server is deleted
+	DeletedOrphanedServer = "DeletedOrphanedServer"
+)
+
+// Collector periodically looks for servers owned by this cluster whose VM is
+// gone, typically because a deletion was missed.
+type Collector struct {
+	cloud     *vmctl.Cloud
+	vmsLister listers.VMLister
+	vmsSynced cache.InformerSynced
+	recorder  record.EventRecorder
+	metrics   *metrics.Metrics
+
+	clusterID   string
+	policy      Policy
+	interval    time.Duration
+	gracePeriod time.Duration
+
+	// owns, if set, tells whether this replica owns the VM with the given
+	// key. Servers of VMs owned by other replicas are left to them.
+	owns func(key string) bool
+
+	// scope identifies the VMs watched, only the servers created while
+	// watching the same VMs are collected. namespaces, if set, are the only
+	// namespaces watched, and selector selects the VMs watched in them.
+	// getVM, if set, looks up the VMs missing from the lister, which may
+	// only be out of the selector.
+	scope      string
+	namespaces map[string]bool
+	selector   labels.Selector
+	getVM      func(namespace, name string) (*samplev1alpha1.VM, error)
+
+	// orphanedSince records when each orphaned server was first seen, by
+	// server ID.
+	orphanedSince map[string]time.Time
+	now           func() time.Time
+}
+
+// NewCollector returns a collector for the servers owned by clusterID.
+func NewCollector(
+	cloud *vmctl.Cloud,
+	vmsLister listers.VMLister,
+	vmsSynced cache.InformerSynced,
+	recorder record.EventRecorder,
+	metrics *metrics.Metrics,
+	clusterID string,
+	policy Policy,
+	interval time.Duration,
+	gracePeriod time.Duration) *Collector {
+
+	return &Collector{
+		cloud:         cloud,
+		vmsLister:     vmsLister,
+		vmsSynced:     vmsSynced,
+		recorder:      recorder,
+		metrics:       metrics,
+		clusterID:     clusterID,
+		policy:        policy,
+		interval:      interval,
+		gracePeriod:   gracePeriod,
+		orphanedSince: map[string]time.Time{},
+		now:           time.Now,
+	}
+}
+
+// SetOwnership makes the collector only look at the servers of the VMs
+// owns reports owned, by namespace/name key, when VMs are sharded among
+// replicas.
+func (c *Collector) SetOwnership(owns func(key string) bool) {
+	c.owns = owns
+}
+
+// SetScope makes the collector only look at the servers of the VMs the
+// lister is restricted to: those in namespaces, if any, and matching
+// selector, and whose owner records scope. Controllers watching other VMs
+// may share the cluster ID, and only ever collect the servers they created.
+// A VM missing from the lister is looked up with getVM before its server is
+// deemed orphaned, as it may only be out of selector, left to another
+// controller.
+func (c *Collector) SetScope(scope string, namespaces []string, selector labels.Selector, getVM func(namespace, name string) (*samplev1alpha1.VM, error)) {
+	c.scope = scope
+	if len(namespaces) > 0 {
+		c.namespaces = map[string]bool{}
+		for _, namespace := range namespaces {
+			c.namespaces[namespace] = true
+		}
+	}
+	if selector == nil {
+		selector = labels.Everything()
+	}
+	c.selector = selector
+	c.getVM = getVM
+}
+
+// Run scans for orphaned servers every interval until stopCh is closed.
+func (c *Collector) Run(stopCh <-chan struct{}) {
+	defer utilruntime.HandleCrash()
+
+	// An unsynced lister would make every server look orphaned.
+	if ok := cache.WaitForCacheSync(stopCh, c.vmsSynced); !ok {
+		utilruntime.HandleError(fmt.Errorf("failed to wait for caches to sync"))
+		return
+	}
+
+	klog.Infof("Starting orphaned server collector, policy %s", c.policy)
+	wait.Until(func() {
+		if err := c.collect(); err != nil {
+			utilruntime.HandleError(fmt.Errorf("error collecting orphaned servers: %v", err))
+		}
+	}, c.interval, stopCh)
+}
+
+// collect runs a single scan.
+func (c *Collector) collect() error {
+	servers, err := c.cloud.ListServers()
+	if err != nil {
+		return err
+	}
+
+	orphanedSince := map[string]time.Time{}
+	for i := range servers {
+		server := &servers[i]
+		orphaned, err := c.isOrphaned(server)
+		if err != nil {
+			return err
+		}
+		if !orphaned {
+			continue
+		}
+
+		since, seen := c.orphanedSince[server.ID]
+		if !seen {
+			since = c.now()
+			owner := server.Owner()
+			klog.Warningf("Server '%s' (%s) is orphaned, its VM %s is gone", server.Name, server.ID, owner)
+			c.recorder.Eventf(ownerReference(owner), corev1.EventTypeWarning, OrphanedServer,
+				"Server %s (%s) is orphaned", server.Name, server.ID)
+		}
+		orphanedSince[server.ID] = since
+
+		if c.policy != PolicyDelete || c.now().Sub(since) < c.gracePeriod {
+			continue
+		}
+		err = c.cloud.DeleteServerByID(server.ID)
+		if err != nil && err != vmctl.ErrServerNotFound {
+			utilruntime.HandleError(fmt.Errorf("error deleting orphaned server %s: %v", server.ID, err))
+			continue
+		}
+		delete(orphanedSince, server.ID)
+		klog.Infof("Successfully deleted orphaned server '%s' (%s)", server.Name, server.ID)
+		c.recorder.Eventf(ownerReference(server.Owner()), corev1.EventTypeNormal, DeletedOrphanedServer,
+			"Deleted orphaned server %s (%s)", server.Name, server.ID)
+	}
+
+	c.orphanedSince = orphanedSince
+	c.metrics.SetOrphanedServers(len(orphanedSince))
+	return nil
+}
+
+// isOrphaned reports whether server is owned by this cluster, and created
+// while watching the same VMs, but its VM, as identified by namespace, name
+// and UID, no longer exists.
+func (c *Collector) isOrphaned(server *vmctl.Server) (bool, error) {
+	owner := server.Owner()
+	if owner.UID == "" || owner.ClusterID != c.clusterID || owner.Scope != c.scope || server.Retained() {
+		return false, nil
+	}
+	if c.owns != nil && !c.owns(owner.Namespace+"/"+owner.Name) {
+		return false, nil
+	}
+
+	if c.namespaces != nil && !c.namespaces[owner.Namespace] {
+		return false, nil
+	}
+
+	vm, err := c.vmsLister.VMs(owner.Namespace).Get(owner.Name)
+	if errors.IsNotFound(err) && c.getVM != nil {
+		vm, err = c.getVM(owner.Namespace, owner.Name)
+		if err == nil && !c.selector.Matches(labels.Set(vm.Labels)) {
+			return false, nil
+		}
+	}
+	if errors.IsNotFound(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return string(vm.UID) != owner.UID, nil
+}
+
+// ownerReference returns a reference to the VM recorded as owner, for
+// events about servers whose VM is gone.
+func ownerReference(owner vmctl.Owner) *corev1.ObjectReference {
+	return &corev1.ObjectReference{
+		APIVersion: samplev1alpha1.SchemeGroupVersion.String(),
+		Kind:       "VM",
+		Namespace:  owner.Namespace,
+		Name:       owner.Name,
+		UID:        types.UID(owner.UID),
+	}
+}
@@ -0,0 +1,225 @@
+package gc
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+
+	samplev1alpha1 "k8s.io/sample-controller/pkg/apis/samplecontroller/v1alpha1"
+	vmctl "k8s.io/sample-controller/pkg/cloud"
+	listers "k8s.io/sample-controller/pkg/generated/listers/samplecontroller/v1alpha1"
+	"k8s.io/sample-controller/pkg/metrics"
+)
+
+const testClusterID = "test-cluster"
+
+// fakeCloud serves the list and delete calls the collector makes.
+type fakeCloud struct {
+	mu      sync.Mutex
+	servers map[string]vmctl.Server
+	*httptest.Server
+}
+
+func newFakeCloud(servers ...vmctl.Server) *fakeCloud {
+	fc := &fakeCloud{servers: map[string]vmctl.Server{}}
+	for _, s := range servers {
+		fc.servers[s.ID] = s
+	}
+	fc.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fc.mu.Lock()
+		defer fc.mu.Unlock()
+
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		switch {
+		case len(parts) == 1 && r.Method == http.MethodGet:
+			servers := []vmctl.Server{}
+			for _, s := range fc.servers {
+				servers = append(servers, s)
+			}
+			json.NewEncoder(w).Encode(servers)
+		case len(parts) == 2 && r.Method == http.MethodDelete:
+			delete(fc.servers, parts[1])
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	return fc
+}
+
+func newVM(name string) *samplev1alpha1.VM {
+	return &samplev1alpha1.VM{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: metav1.NamespaceDefault,
+			UID:       types.UID(name + "-uid"),
+		},
+	}
+}
+
+func ownedServer(id string, vm *samplev1alpha1.VM) vmctl.Server {
+	return vmctl.Server{
+		ID:   id,
+		Name: id,
+		Metadata: vmctl.Owner{
+			ClusterID: testClusterID,
+			Namespace: vm.Namespace,
+			Name:      vm.Name,
+			UID:       string(vm.UID),
+		}.Metadata(),
+	}
+}
+
+// scopedServer returns a server owned by vm, created by a controller watching
+// the VMs identified by scope.
+func scopedServer(id string, vm *samplev1alpha1.VM, scope string) vmctl.Server {
+	server := ownedServer(id, vm)
+	server.Metadata[vmctl.OwnerScopeKey] = scope
+	return server
+}
+
+func newCollector(fc *fakeCloud, policy Policy, vms ...*samplev1alpha1.VM) *Collector {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	for _, vm := range vms {
+		indexer.Add(vm)
+	}
+	return NewCollector(&vmctl.Cloud{Address: fc.URL}, listers.NewVMLister(indexer), func() bool { return true },
+		&record.FakeRecorder{}, metrics.New(), testClusterID, policy, time.Minute, time.Hour)
+}
+
+func TestReportsOrphans(t *testing.T) {
+	live := newVM("live")
+	recreated := newVM("recreated")
+	gone := newVM("gone")
+
+	stale := ownedServer("stale", recreated)
+	recreated.UID = "new-uid"
+
+	retained := ownedServer("retained", gone)
+	retained.Metadata[vmctl.RetainedKey] = "true"
+
+	foreign := ownedServer("foreign", gone)
+	foreign.Metadata[vmctl.OwnerClusterIDKey] = "other-cluster"
+
+	fc := newFakeCloud(
+		ownedServer("live", live),
+		stale,
+		ownedServer("orphan", gone),
+		retained,
+		foreign,
+		vmctl.Server{ID: "unowned", Name: "unowned"},
+	)
+	defer fc.Close()
+
+	c := newCollector(fc, PolicyReport, live, recreated)
+	if err := c.collect(); err != nil {
+		t.Fatalf("error collecting: %v", err)
+	}
+
+	if len(c.orphanedSince) != 2 {
+		t.Errorf("expected stale and orphan to be orphaned, got %v", c.orphanedSince)
+	}
+	for _, id := range []string{"stale", "orphan"} {
+		if _, ok := c.orphanedSince[id]; !ok {
+			t.Errorf("expected %s to be orphaned", id)
+		}
+	}
+	if len(fc.servers) != 6 {
+		t.Errorf("expected no server to be deleted, got %v", fc.servers)
+	}
+}
+
+func TestDeletesOrphansAfterGracePeriod(t *testing.T) {
+	fc := newFakeCloud(ownedServer("orphan", newVM("gone")))
+	defer fc.Close()
+
+	now := time.Now()
+	c := newCollector(fc, PolicyDelete)
+	c.now = func() time.Time { return now }
+
+	if err := c.collect(); err != nil {
+		t.Fatalf("error collecting: %v", err)
+	}
+	if len(fc.servers) != 1 {
+		t.Fatalf("expected orphan to survive the grace period, got %v", fc.servers)
+	}
+
+	now = now.Add(time.Hour)
+	if err := c.collect(); err != nil {
+		t.Fatalf("error collecting: %v", err)
+	}
+	if len(fc.servers) != 0 {
+		t.Errorf("expected orphan to be deleted, got %v", fc.servers)
+	}
+	if len(c.orphanedSince) != 0 {
+		t.Errorf("expected deleted orphan to be forgotten, got %v", c.orphanedSince)
+	}
+}
+
+func TestOnlyCollectsOwnedServers(t *testing.T) {
+	fc := newFakeCloud(ownedServer("mine", newVM("mine")), ownedServer("theirs", newVM("theirs")))
+	defer fc.Close()
+
+	c := newCollector(fc, PolicyReport)
+	c.SetOwnership(func(key string) bool { return key == "default/mine" })
+	if err := c.collect(); err != nil {
+		t.Fatalf("error collecting: %v", err)
+	}
+
+	if _, ok := c.orphanedSince["mine"]; !ok || len(c.orphanedSince) != 1 {
+		t.Errorf("expected only the server of an owned VM to be orphaned, got %v", c.orphanedSince)
+	}
+}
+
+func TestOnlyCollectsServersInScope(t *testing.T) {
+	otherNamespace := newVM("elsewhere")
+	otherNamespace.Namespace = "team-b"
+	otherTeam := newVM("other-team")
+	otherTeam.Labels = map[string]string{"team": "b"}
+	recreated := newVM("recreated")
+	recreated.Labels = map[string]string{"team": "a"}
+	stale := scopedServer("stale", recreated, "team-a")
+	recreated.UID = "new-uid"
+
+	fc := newFakeCloud(
+		scopedServer("elsewhere", otherNamespace, "team-a"),
+		scopedServer("other-team", otherTeam, "team-a"),
+		scopedServer("gone", newVM("gone"), "team-a"),
+		stale,
+		// Servers of VMs gone, created by controllers watching other VMs.
+		scopedServer("gone-team-b", newVM("gone-team-b"), "team-b"),
+		ownedServer("gone-unscoped", newVM("gone-unscoped")),
+	)
+	defer fc.Close()
+
+	c := newCollector(fc, PolicyReport)
+	selector, _ := labels.Parse("team=a")
+	c.SetScope("team-a", []string{metav1.NamespaceDefault}, selector, func(namespace, name string) (*samplev1alpha1.VM, error) {
+		for _, vm := range []*samplev1alpha1.VM{otherNamespace, otherTeam, recreated} {
+			if vm.Namespace == namespace && vm.Name == name {
+				return vm, nil
+			}
+		}
+		return nil, errors.NewNotFound(samplev1alpha1.Resource("vms"), name)
+	})
+	if err := c.collect(); err != nil {
+		t.Fatalf("error collecting: %v", err)
+	}
+
+	_, goneOrphaned := c.orphanedSince["gone"]
+	_, staleOrphaned := c.orphanedSince["stale"]
+	if !goneOrphaned || !staleOrphaned || len(c.orphanedSince) != 2 {
+		t.Errorf("expected only the servers of VMs in scope to be orphaned, got %v", c.orphanedSince)
+	}
+}
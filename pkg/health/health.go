@@ -0,0 +1,75 @@
+// Package health serves the liveness and readiness of the controller as
+// lists of named checks, the way Kubernetes components serve /healthz and
+// /readyz.
+package health
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+)
+
+// Check is a named check, passing when it returns no error.
+type Check struct {
+	Name  string
+	Check func() error
+}
+
+// Handler serves the result of checks, 200 if they all pass and 503
+// otherwise. Failed checks are listed with their error, passing ones only
+// when the verbose parameter is set.
+func Handler(checks ...Check) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, verbose := r.URL.Query()["verbose"]
+		var out bytes.Buffer
+		failed := false
+		for _, check := range checks {
+			if err := check.Check(); err != nil {
+				failed = true
+				fmt.Fprintf(&out, "[-]%s failed: %v\n", check.Name, err)
+				klog.V(2).Infof("%s check %s failed: %v", r.URL.Path, check.Name, err)
+				continue
+			}
+			if verbose {
+				fmt.Fprintf(&out, "[+]%s ok\n", check.Name)
+			}
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		if failed {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(&out, "%s check failed\n", r.URL.Path)
+		} else if verbose {
+			fmt.Fprintf(&out, "%s check passed\n", r.URL.Path)
+		} else {
+			out.WriteString("ok")
+		}
+		w.Write(out.Bytes())
+	})
+}
+
+// Cached returns check, run at most once every ttl. Checks in between get
+// the last result, so that probes do not hammer what is checked.
+func Cached(check func() error, ttl time.Duration) func() error {
+	return cached(check, ttl, time.Now)
+}
+
+func cached(check func() error, ttl time.Duration, now func() time.Time) func() error {
+	var lock sync.Mutex
+	var checked time.Time
+	var last error
+	return func() error {
+		lock.Lock()
+		defer lock.Unlock()
+		if checked.IsZero() || now().Sub(checked) >= ttl {
+			last = check()
+			checked = now()
+		}
+		return last
+	}
+}
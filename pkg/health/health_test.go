@@ -0,0 +1,58 @@
+package health
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func serve(h http.Handler, path string) (int, string) {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	return w.Code, w.Body.String()
+}
+
+func TestHandler(t *testing.T) {
+	var cloudErr error
+	h := Handler(
+		Check{Name: "informers", Check: func() error { return nil }},
+		Check{Name: "cloud", Check: func() error { return cloudErr }},
+	)
+
+	if code, body := serve(h, "/readyz"); code != http.StatusOK || body != "ok" {
+		t.Errorf("expected 200 ok, got %d %q", code, body)
+	}
+	expected := "[+]informers ok\n[+]cloud ok\n/readyz check passed\n"
+	if code, body := serve(h, "/readyz?verbose"); code != http.StatusOK || body != expected {
+		t.Errorf("expected 200 %q, got %d %q", expected, code, body)
+	}
+
+	cloudErr = fmt.Errorf("connection refused")
+	expected = "[-]cloud failed: connection refused\n/readyz check failed\n"
+	if code, body := serve(h, "/readyz"); code != http.StatusServiceUnavailable || body != expected {
+		t.Errorf("expected 503 %q, got %d %q", expected, code, body)
+	}
+}
+
+func TestCached(t *testing.T) {
+	now := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	calls := 0
+	check := cached(func() error {
+		calls++
+		return fmt.Errorf("call %d", calls)
+	}, 10*time.Second, func() time.Time { return now })
+
+	if err := check(); err == nil || err.Error() != "call 1" {
+		t.Errorf("expected the first call to run the check, got %v", err)
+	}
+	now = now.Add(5 * time.Second)
+	if err := check(); err == nil || err.Error() != "call 1" {
+		t.Errorf("expected the cached result, got %v", err)
+	}
+	now = now.Add(5 * time.Second)
+	if err := check(); err == nil || err.Error() != "call 2" {
+		t.Errorf("expected the check to run again once the result expired, got %v", err)
+	}
+}
@@ -0,0 +1,34 @@
+package leader
+
+import (
+	"testing"
+
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestElection(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	first := newTestLeader(t, client, "replica-1")
+	firstEvents, unsubscribeFirst := first.Subscribe()
+	defer unsubscribeFirst()
+	first.StartElection()
+	expectEventsInAnyOrder(t, firstEvents, Event{Type: NewLeader, Identity: "replica-1"}, Event{Type: Acquired})
+
+	second := newTestLeader(t, client, "replica-2")
+	secondEvents, unsubscribeSecond := second.Subscribe()
+	defer unsubscribeSecond()
+	second.StartElection()
+	defer second.Clean()
+	expectEvents(t, secondEvents, Event{Type: NewLeader, Identity: "replica-1"})
+	if !first.IsLeader() || second.IsLeader() {
+		t.Fatalf("expected replica-1 to lead alone")
+	}
+
+	// The lease is released when the leader leaves, and taken over.
+	first.Clean()
+	expectEvents(t, firstEvents, Event{Type: Lost})
+	expectEventsInAnyOrder(t, secondEvents, Event{Type: NewLeader, Identity: "replica-2"}, Event{Type: Acquired})
+	if first.IsLeader() || !second.IsLeader() || second.LeaderIdentity() != "replica-2" {
+		t.Errorf("expected replica-2 to lead alone")
+	}
+}
@@ -0,0 +1,96 @@
+package leader
+
+import (
+	"fmt"
+	"sync"
+)
+
+// EventType is the kind of change in leadership an event reports.
+type EventType int
+
+const (
+	// Acquired means this replica became the leader.
+	Acquired EventType = iota
+	// Lost means this replica is no longer the leader.
+	Lost
+	// NewLeader means a replica, maybe this one, was seen leading.
+	NewLeader
+)
+
+func (t EventType) String() string {
+	switch t {
+	case Acquired:
+		return "Acquired"
+	case Lost:
+		return "Lost"
+	case NewLeader:
+		return "NewLeader"
+	}
+	return fmt.Sprintf("EventType(%d)", int(t))
+}
+
+// Event is a change in leadership.
+type Event struct {
+	Type EventType
+	// Identity is the identity of the new leader, for NewLeader events.
+	Identity string
+}
+
+// subscriber queues events for one subscription, so a slow subscriber
+// never blocks the election nor misses an event.
+type subscriber struct {
+	ch   chan Event
+	wake chan struct{}
+	stop chan struct{}
+
+	lock    sync.Mutex
+	pending []Event
+}
+
+func newSubscriber() *subscriber {
+	s := &subscriber{
+		ch:   make(chan Event),
+		wake: make(chan struct{}, 1),
+		stop: make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// publish queues an event, it never blocks.
+func (s *subscriber) publish(e Event) {
+	s.lock.Lock()
+	s.pending = append(s.pending, e)
+	s.lock.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run hands the queued events over in order until stopped, then closes the
+// channel.
+func (s *subscriber) run() {
+	defer close(s.ch)
+	for {
+		s.lock.Lock()
+		events := s.pending
+		s.pending = nil
+		s.lock.Unlock()
+
+		for _, e := range events {
+			select {
+			case s.ch <- e:
+			case <-s.stop:
+				return
+			}
+		}
+
+		select {
+		case <-s.wake:
+		case <-s.stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package leader
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newTestLeader(t *testing.T, client kubernetes.Interface, identity string) *Leader {
+	config := DefaultConfig()
+	config.Identity = identity
+	config.LockNamespace = "default"
+	config.LeaseDuration, config.RenewDeadline, config.RetryPeriod = 600*time.Millisecond, 400*time.Millisecond, 100*time.Millisecond
+	l, err := LeaderInit(client, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+// expectEvents receives events until the expected ones came, failing if
+// another one comes first.
+func expectEvents(t *testing.T, events <-chan Event, expected ...Event) {
+	for _, e := range expected {
+		select {
+		case got, ok := <-events:
+			if !ok {
+				t.Fatalf("expected %+v, the subscription ended", e)
+			}
+			if got != e {
+				t.Fatalf("expected %+v, got %+v", e, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %+v", e)
+		}
+	}
+}
+
+// expectEventsInAnyOrder is expectEvents for events the elector sends from
+// goroutines of its own, which may come in any order.
+func expectEventsInAnyOrder(t *testing.T, events <-chan Event, expected ...Event) {
+	missing := map[Event]int{}
+	for _, e := range expected {
+		missing[e]++
+	}
+	for range expected {
+		select {
+		case got, ok := <-events:
+			if !ok {
+				t.Fatalf("expected %v, the subscription ended", expected)
+			}
+			if missing[got] == 0 {
+				t.Fatalf("expected %v, got %+v", expected, got)
+			}
+			missing[got]--
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %v", expected)
+		}
+	}
+}
+
+func expectNoEvent(t *testing.T, events <-chan Event) {
+	select {
+	case e := <-events:
+		t.Fatalf("expected no event, got %+v", e)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestCallbacks(t *testing.T) {
+	l := newTestLeader(t, fake.NewSimpleClientset(), "replica-1")
+	events, unsubscribe := l.Subscribe()
+	defer unsubscribe()
+	callbacks := l.callbacks()
+
+	if err := l.Check(); err == nil {
+		t.Errorf("expected the check to fail before a leader is known")
+	}
+
+	// The elector stops leading after every term, even one it did not lead.
+	callbacks.OnNewLeader("replica-2")
+	callbacks.OnStoppedLeading()
+	expectEvents(t, events, Event{Type: NewLeader, Identity: "replica-2"})
+	expectNoEvent(t, events)
+	if l.IsLeader() || l.LeaderIdentity() != "replica-2" {
+		t.Errorf("expected replica-2 to lead, got leader %v, identity %s", l.IsLeader(), l.LeaderIdentity())
+	}
+	if err := l.Check(); err != nil {
+		t.Errorf("expected the check to pass with another leader, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	callbacks.OnNewLeader("replica-1")
+	callbacks.OnStartedLeading(ctx)
+	expectEvents(t, events, Event{Type: NewLeader, Identity: "replica-1"}, Event{Type: Acquired})
+	if !l.IsLeader() || l.LeaderIdentity() != "replica-1" {
+		t.Errorf("expected to lead, got leader %v, identity %s", l.IsLeader(), l.LeaderIdentity())
+	}
+
+	cancel()
+	callbacks.OnStoppedLeading()
+	expectEvents(t, events, Event{Type: Lost})
+	if l.IsLeader() {
+		t.Errorf("expected not to lead any more")
+	}
+
+	// OnStartedLeading runs in a goroutine, and may only run once the term
+	// is over.
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	callbacks.OnStoppedLeading()
+	callbacks.OnStartedLeading(ctx)
+	expectNoEvent(t, events)
+	if l.IsLeader() {
+		t.Errorf("expected not to lead after a term that was over")
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	l := newTestLeader(t, fake.NewSimpleClientset(), "replica-1")
+	callbacks := l.callbacks()
+
+	// Subscribers that do not receive do not hold up the election nor
+	// miss events.
+	events, unsubscribe := l.Subscribe()
+	other, unsubscribeOther := l.Subscribe()
+	var expected []Event
+	for i := 0; i < 50; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		callbacks.OnStartedLeading(ctx)
+		cancel()
+		callbacks.OnStoppedLeading()
+		expected = append(expected, Event{Type: Acquired}, Event{Type: Lost})
+	}
+	expectEvents(t, events, expected...)
+	expectEvents(t, other, expected...)
+
+	unsubscribeOther()
+	unsubscribeOther()
+	if _, ok := <-other; ok {
+		t.Errorf("expected the channel to be closed on unsubscribe")
+	}
+	callbacks.OnNewLeader("replica-2")
+	expectEvents(t, events, Event{Type: NewLeader, Identity: "replica-2"})
+
+	// Events pending when unsubscribing are dropped.
+	callbacks.OnNewLeader("replica-3")
+	unsubscribe()
+	for range events {
+	}
+}
+
+func TestConcurrentState(t *testing.T) {
+	l := newTestLeader(t, fake.NewSimpleClientset(), "replica-1")
+	callbacks := l.callbacks()
+	events, unsubscribe := l.Subscribe()
+	defer unsubscribe()
+
+	var wg sync.WaitGroup
+	stopCh := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stopCh:
+					return
+				default:
+					l.IsLeader()
+					l.LeaderIdentity()
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 100; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		// The elector calls the callbacks from goroutines of its own.
+		var terms sync.WaitGroup
+		terms.Add(2)
+		go func() {
+			defer terms.Done()
+			callbacks.OnNewLeader("replica-1")
+		}()
+		go func() {
+			defer terms.Done()
+			callbacks.OnStartedLeading(ctx)
+		}()
+		terms.Wait()
+		cancel()
+		callbacks.OnStoppedLeading()
+	}
+	close(stopCh)
+	wg.Wait()
+
+	// Whatever the order of the callbacks, Acquired and Lost alternate.
+	leading := false
+	for i := 0; i < 200; {
+		select {
+		case e := <-events:
+			switch e.Type {
+			case Acquired:
+				if leading {
+					t.Fatalf("acquired twice in a row")
+				}
+				leading = true
+				i++
+			case Lost:
+				if !leading {
+					t.Fatalf("lost without acquiring")
+				}
+				leading = false
+				i++
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out after %d events", i)
+		}
+	}
+}
@@ -2,6 +2,8 @@ package leader
 
 import (
 	"context"
+	"os"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
@@ -11,46 +13,150 @@ import (
 	"k8s.io/client-go/tools/leaderelection"
 	"k8s.io/client-go/tools/leaderelection/resourcelock"
 	"k8s.io/klog"
+
+	"k8s.io/sample-controller/pkg/config"
 )
 
-var (
-	leaseLockName      = "simple-controller-lock"
-	leaseLockNamespace = "kube-system"
+// LockType is the kind of object the lock is held on.
+type LockType string
+
+const (
+	LockTypeLease     LockType = config.LockTypeLease
+	LockTypeConfigMap LockType = config.LockTypeConfigMap
+	LockTypeEndpoints LockType = config.LockTypeEndpoints
 )
 
+// resourceLockTypes maps lock types to the names client-go knows them by.
+var resourceLockTypes = map[LockType]string{
+	LockTypeLease:     resourcelock.LeasesResourceLock,
+	LockTypeConfigMap: resourcelock.ConfigMapsResourceLock,
+	LockTypeEndpoints: resourcelock.EndpointsResourceLock,
+}
+
+// Config configures the election.
+type Config struct {
+	LockName      string
+	LockNamespace string
+	LockType      LockType
+	// Identity tells the candidates apart, it must be unique among them.
+	Identity string
+
+	LeaseDuration time.Duration
+	RenewDeadline time.Duration
+	RetryPeriod   time.Duration
+}
+
+// DefaultConfig returns the configuration used unless told otherwise, that
+// of the default controller configuration.
+func DefaultConfig() Config {
+	return NewConfig(config.Default().LeaderElection)
+}
+
+// NewConfig returns the configuration of the election described in the
+// controller configuration.
+func NewConfig(c config.LeaderElectionConfiguration) Config {
+	return Config{
+		LockName:      c.LockName,
+		LockNamespace: c.LockNamespace,
+		LockType:      LockType(c.LockType),
+		Identity:      c.Identity,
+		LeaseDuration: c.LeaseDuration.Duration,
+		RenewDeadline: c.RenewDeadline.Duration,
+		RetryPeriod:   c.RetryPeriod.Duration,
+	}
+}
+
+// DefaultIdentity returns the name of the pod, taken from POD_NAME, or the
+// host name. A random identity is made up if neither is known.
+func DefaultIdentity() string {
+	if name := os.Getenv("POD_NAME"); name != "" {
+		return name
+	}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		return hostname
+	}
+	return uuid.New().String()
+}
+
+// Validate checks the configuration makes a working election, by the rules
+// of the controller configuration.
+func (c *Config) Validate() error {
+	configuration := config.LeaderElectionConfiguration{
+		LockName:      c.LockName,
+		LockNamespace: c.LockNamespace,
+		LockType:      string(c.LockType),
+		LeaseDuration: metav1.Duration{Duration: c.LeaseDuration},
+		RenewDeadline: metav1.Duration{Duration: c.RenewDeadline},
+		RetryPeriod:   metav1.Duration{Duration: c.RetryPeriod},
+	}
+	return configuration.Validate()
+}
+
+// Leader is a candidate in the election. Its state is safe to read from any
+// goroutine.
 type Leader struct {
 	kubeClientSet kubernetes.Interface
-	uuid          string
-	isLeader      bool
+	config        Config
+	identity      string
 	cancel        context.CancelFunc
-	lock          *resourcelock.LeaseLock
+	done          chan struct{}
+	lock          resourcelock.Interface
+
+	// leaveLock guards leaving, set by Clean to refuse the next attempt of
+	// the elector to read the lock. refused is closed once it is refused.
+	leaveLock sync.Mutex
+	leaving   bool
+	refused   chan struct{}
+
+	// stateLock guards the state below and orders the events, so that
+	// subscribers see them in the order the state changed.
+	stateLock      sync.Mutex
+	isLeader       bool
+	leader         string
+	transitions    int
+	lastRenewal    time.Time
+	failedRenewals int
+	subscribers    map[*subscriber]bool
 }
 
-func LeaderInit(kubeclientset kubernetes.Interface) *Leader {
-	uuid := uuid.New().String()
-	lock := &resourcelock.LeaseLock{
-		LeaseMeta: metav1.ObjectMeta{
-			Name:      leaseLockName,
-			Namespace: leaseLockNamespace,
-		},
-		Client: kubeclientset.CoordinationV1(),
-		LockConfig: resourcelock.ResourceLockConfig{
-			Identity: uuid,
-		},
+// LeaderInit returns a candidate for the election described by config. An
+// empty identity is replaced by DefaultIdentity.
+func LeaderInit(kubeclientset kubernetes.Interface, config Config) (*Leader, error) {
+	if config.Identity == "" {
+		config.Identity = DefaultIdentity()
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
 	}
-	return &Leader{
+	lock, err := resourcelock.New(resourceLockTypes[config.LockType],
+		config.LockNamespace, config.LockName,
+		kubeclientset.CoreV1(), kubeclientset.CoordinationV1(),
+		resourcelock.ResourceLockConfig{Identity: config.Identity})
+	if err != nil {
+		return nil, err
+	}
+	l := &Leader{
 		kubeClientSet: kubeclientset,
-		uuid:          uuid,
-		lock:          lock,
-		isLeader:      false,
+		config:        config,
+		identity:      config.Identity,
+		subscribers:   map[*subscriber]bool{},
 	}
+	l.lock = observedLock{Interface: lock, l: l}
+	return l, nil
 }
-func (l *Leader) StartElection(notify chan int) {
+
+// StartElection stands for election until Clean is called. Changes in
+// leadership are reported to subscribers.
+func (l *Leader) StartElection() {
 	ctx, cancel := context.WithCancel(context.Background())
 	// Need to keep host of this to release the lease on controller.Run()'s exit
 	l.cancel = cancel
+	l.leaveLock.Lock()
+	l.leaving = false
+	l.refused = make(chan struct{})
+	l.leaveLock.Unlock()
 
-	go leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+	config := leaderelection.LeaderElectionConfig{
 		Lock: l.lock,
 		// IMPORTANT: you MUST ensure that any code you have that
 		// is protected by the lease must terminate **before**
@@ -59,39 +165,146 @@ func (l *Leader) StartElection(notify chan int) {
 		// get elected before your background loop finished, violating
 		// the stated goal of the lease.
 		ReleaseOnCancel: true,
-		LeaseDuration:   5 * time.Second,
-		RenewDeadline:   2 * time.Second,
-		RetryPeriod:     1 * time.Second,
-		Callbacks: leaderelection.LeaderCallbacks{
-			OnStartedLeading: func(ctx context.Context) {
-				l.isLeader = true
-				klog.Infof("%s: leading", l.uuid)
-				notify <- 1
-			},
-			OnStoppedLeading: func() {
-				l.isLeader = false
-				klog.Infof("%s: lost lease", l.uuid)
-				notify <- 1
-			},
-			OnNewLeader: func(identity string) {
-				// we're notified when new leader elected
-				if identity == l.uuid {
-					l.isLeader = true
-					notify <- 1
-				}
-				klog.Infof("new leader elected: %v", identity)
-			},
+		LeaseDuration:   l.config.LeaseDuration,
+		RenewDeadline:   l.config.RenewDeadline,
+		RetryPeriod:     l.config.RetryPeriod,
+		Callbacks:       l.callbacks(),
+	}
+
+	// RunOrDie returns when the lease is lost, stand for election again
+	// until cancelled.
+	l.done = make(chan struct{})
+	go func() {
+		defer close(l.done)
+		for ctx.Err() == nil {
+			leaderelection.RunOrDie(ctx, config)
+		}
+	}()
+}
+
+// callbacks turns the callbacks of the elector into state changes and
+// events. OnStartedLeading is run in a goroutine of its own, so it may come
+// after OnStoppedLeading for the same term; its context is cancelled by then,
+// which is how it is told apart.
+func (l *Leader) callbacks() leaderelection.LeaderCallbacks {
+	return leaderelection.LeaderCallbacks{
+		OnStartedLeading: func(ctx context.Context) {
+			l.stateLock.Lock()
+			defer l.stateLock.Unlock()
+			if ctx.Err() != nil || l.isLeader {
+				return
+			}
+			l.isLeader = true
+			klog.Infof("%s: leading", l.identity)
+			l.publish(Event{Type: Acquired})
 		},
-	})
-	return
+		OnStoppedLeading: func() {
+			l.stateLock.Lock()
+			defer l.stateLock.Unlock()
+			// The elector calls this after every term, led or not.
+			if !l.isLeader {
+				return
+			}
+			l.isLeader = false
+			klog.Infof("%s: lost lease", l.identity)
+			l.publish(Event{Type: Lost})
+		},
+		OnNewLeader: func(identity string) {
+			l.stateLock.Lock()
+			defer l.stateLock.Unlock()
+			l.leader = identity
+			klog.Infof("new leader elected: %v", identity)
+			l.publish(Event{Type: NewLeader, Identity: identity})
+		},
+	}
 }
 
+// publish sends an event to every subscriber. stateLock must be held.
+func (l *Leader) publish(e Event) {
+	for s := range l.subscribers {
+		s.publish(e)
+	}
+}
+
+// Subscribe returns a channel receiving every change in leadership from now
+// on, in order, and a function ending the subscription and closing the
+// channel. A subscriber that is slow to receive does not hold up the
+// election.
+func (l *Leader) Subscribe() (<-chan Event, func()) {
+	s := newSubscriber()
+
+	l.stateLock.Lock()
+	l.subscribers[s] = true
+	l.stateLock.Unlock()
+
+	var once sync.Once
+	return s.ch, func() {
+		once.Do(func() {
+			l.stateLock.Lock()
+			delete(l.subscribers, s)
+			l.stateLock.Unlock()
+			close(s.stop)
+		})
+	}
+}
+
+// IsLeader reports whether this replica leads.
 func (l *Leader) IsLeader() bool {
+	l.stateLock.Lock()
+	defer l.stateLock.Unlock()
 	return l.isLeader
 }
 
+// LeaderIdentity returns the identity of the last replica seen leading, empty
+// if none was seen yet.
+func (l *Leader) LeaderIdentity() string {
+	l.stateLock.Lock()
+	defer l.stateLock.Unlock()
+	return l.leader
+}
+
+// Identity returns the identity of this replica.
+func (l *Leader) Identity() string {
+	return l.identity
+}
+
+// Clean leaves the election, and returns once the lease is released if it
+// was held. Whatever the lease protects must be stopped before.
 func (l *Leader) Clean() {
+	if l.cancel == nil {
+		return
+	}
+	// The elector renews the lease in a goroutine it leaves running when
+	// its context is cancelled, and both write the record it observed.
+	// Attempts are made one at a time: once the next one is refused, which
+	// leaves the record alone, the last one is over and cancelling is safe.
+	// An attempt still running after the renew deadline is given up on by
+	// the elector anyway.
+	l.leaveLock.Lock()
+	l.leaving = true
+	l.leaveLock.Unlock()
+	select {
+	case <-l.refused:
+	case <-time.After(l.config.RenewDeadline):
+	}
 	l.cancel()
+	<-l.done
+}
+
+// refuseAttempt reports whether the elector is to be kept from reading the
+// lock, because this replica is leaving the election.
+func (l *Leader) refuseAttempt() bool {
+	l.leaveLock.Lock()
+	defer l.leaveLock.Unlock()
+	if !l.leaving {
+		return false
+	}
+	select {
+	case <-l.refused:
+	default:
+		close(l.refused)
+	}
+	return true
 }
 
 /*
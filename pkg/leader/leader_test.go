@@ -0,0 +1,165 @@
+package leader
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	core "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+func TestLeaderInitLockTypes(t *testing.T) {
+	for _, test := range []struct {
+		lockType LockType
+		kind     interface{}
+	}{
+		{LockTypeLease, &resourcelock.LeaseLock{}},
+		{LockTypeConfigMap, &resourcelock.ConfigMapLock{}},
+		{LockTypeEndpoints, &resourcelock.EndpointsLock{}},
+	} {
+		config := DefaultConfig()
+		config.LockType = test.lockType
+		config.LockName = "lock"
+		config.LockNamespace = "ns"
+		config.Identity = "replica-1"
+
+		l, err := LeaderInit(fake.NewSimpleClientset(), config)
+		if err != nil {
+			t.Fatalf("%s: %v", test.lockType, err)
+		}
+		lock := l.lock.(observedLock).Interface
+		if reflect.TypeOf(lock) != reflect.TypeOf(test.kind) {
+			t.Errorf("%s: expected a %T, got %T", test.lockType, test.kind, lock)
+		}
+		if l.lock.Describe() != "ns/lock" {
+			t.Errorf("%s: expected the lock ns/lock, got %s", test.lockType, l.lock.Describe())
+		}
+		if l.lock.Identity() != "replica-1" {
+			t.Errorf("%s: expected identity replica-1, got %s", test.lockType, l.lock.Identity())
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for name, mutate := range map[string]func(*Config){
+		"unknown lock type":          func(c *Config) { c.LockType = "Secret" },
+		"no lock name":               func(c *Config) { c.LockName = "" },
+		"renew deadline over lease":  func(c *Config) { c.RenewDeadline = c.LeaseDuration },
+		"retry period over deadline": func(c *Config) { c.RetryPeriod = c.RenewDeadline },
+		"retry period not positive":  func(c *Config) { c.RetryPeriod = 0 },
+	} {
+		config := DefaultConfig()
+		mutate(&config)
+		if err := config.Validate(); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	config := DefaultConfig()
+	config.LeaseDuration, config.RenewDeadline, config.RetryPeriod = 15*time.Second, 10*time.Second, 2*time.Second
+	if err := config.Validate(); err != nil {
+		t.Errorf("expected a valid configuration, got %v", err)
+	}
+}
+
+func TestDefaults(t *testing.T) {
+	defer os.Unsetenv("POD_NAME")
+	defer os.Unsetenv("POD_NAMESPACE")
+
+	os.Setenv("POD_NAME", "sample-controller-1")
+	os.Setenv("POD_NAMESPACE", "controllers")
+	if identity := DefaultIdentity(); identity != "sample-controller-1" {
+		t.Errorf("expected the pod name as identity, got %s", identity)
+	}
+	if namespace := DefaultConfig().LockNamespace; namespace != "controllers" {
+		t.Errorf("expected the pod namespace for the lock, got %s", namespace)
+	}
+
+	os.Unsetenv("POD_NAME")
+	os.Unsetenv("POD_NAMESPACE")
+	hostname, _ := os.Hostname()
+	if identity := DefaultIdentity(); identity != hostname {
+		t.Errorf("expected the host name %s as identity, got %s", hostname, identity)
+	}
+	if namespace := DefaultConfig().LockNamespace; namespace != "kube-system" {
+		t.Errorf("expected kube-system for the lock, got %s", namespace)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	l := newTestLeader(t, client, "replica-1")
+	callbacks := l.callbacks()
+
+	renewed := metav1.NewTime(time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC))
+	record := resourcelock.LeaderElectionRecord{HolderIdentity: "replica-1", RenewTime: renewed, LeaderTransitions: 3}
+	if err := l.lock.Create(record); err != nil {
+		t.Fatal(err)
+	}
+	callbacks.OnNewLeader("replica-1")
+	callbacks.OnStartedLeading(context.Background())
+
+	// Failing to reach the lock while leading is a failed renewal.
+	unreachable := true
+	client.PrependReactor("get", "leases", func(action core.Action) (bool, runtime.Object, error) {
+		if unreachable {
+			return true, nil, fmt.Errorf("unreachable")
+		}
+		return false, nil, nil
+	})
+	if _, err := l.lock.Get(); err == nil {
+		t.Fatalf("expected an error")
+	}
+	unreachable = false
+
+	expected := Status{
+		Identity:       "replica-1",
+		IsLeader:       true,
+		Leader:         "replica-1",
+		Transitions:    3,
+		LastRenewal:    renewed.Time,
+		FailedRenewals: 1,
+	}
+	if status := l.Status(); !reflect.DeepEqual(status, expected) {
+		t.Errorf("expected status %+v, got %+v", expected, status)
+	}
+
+	recorder := httptest.NewRecorder()
+	l.ServeHTTP(recorder, httptest.NewRequest("GET", "/leader", nil))
+	status := Status{}
+	if err := json.NewDecoder(recorder.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if !status.LastRenewal.Equal(expected.LastRenewal) {
+		t.Errorf("expected last renewal %v, got %v", expected.LastRenewal, status.LastRenewal)
+	}
+	status.LastRenewal = expected.LastRenewal
+	if !reflect.DeepEqual(status, expected) {
+		t.Errorf("expected served status %+v, got %+v", expected, status)
+	}
+
+	// Releasing the lease is no renewal, and other candidates failing to
+	// take it are no failed renewals.
+	callbacks.OnStoppedLeading()
+	if _, err := l.lock.Get(); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.lock.Update(resourcelock.LeaderElectionRecord{LeaderTransitions: 4}); err != nil {
+		t.Fatal(err)
+	}
+	unreachable = true
+	l.lock.Get()
+	status = l.Status()
+	if status.IsLeader || status.Transitions != 4 || !status.LastRenewal.Equal(renewed.Time) || status.FailedRenewals != 1 {
+		t.Errorf("unexpected status after release %+v", status)
+	}
+}
@@ -0,0 +1,117 @@
+package leader
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// Status is the state of the election as seen by this replica.
+type Status struct {
+	// Identity is the identity of this replica.
+	Identity string `json:"identity"`
+	IsLeader bool   `json:"isLeader"`
+	// Leader is the identity of the last replica seen leading.
+	Leader string `json:"leader"`
+	// Transitions is the number of times the lease changed hands, as
+	// recorded in the lock.
+	Transitions int `json:"transitions"`
+	// LastRenewal is when this replica last acquired or renewed the lease,
+	// zero if it never did.
+	LastRenewal time.Time `json:"lastRenewal,omitempty"`
+	// FailedRenewals is the number of times this replica failed to renew
+	// the lease while leading.
+	FailedRenewals int `json:"failedRenewals"`
+}
+
+// Status returns the state of the election.
+func (l *Leader) Status() Status {
+	l.stateLock.Lock()
+	defer l.stateLock.Unlock()
+	return Status{
+		Identity:       l.identity,
+		IsLeader:       l.isLeader,
+		Leader:         l.leader,
+		Transitions:    l.transitions,
+		LastRenewal:    l.lastRenewal,
+		FailedRenewals: l.failedRenewals,
+	}
+}
+
+// Check fails while no replica, this one or another, is known to lead, as
+// then nothing reconciles.
+func (l *Leader) Check() error {
+	if l.LeaderIdentity() == "" && !l.IsLeader() {
+		return fmt.Errorf("no leader elected")
+	}
+	return nil
+}
+
+// ServeHTTP serves the status of the election as JSON.
+func (l *Leader) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(l.Status()); err != nil {
+		utilruntime.HandleError(fmt.Errorf("error writing leader status: %v", err))
+	}
+}
+
+// observedLock records the renewals of the lease, which the elector does not
+// report, as it reads and writes the lock.
+type observedLock struct {
+	resourcelock.Interface
+	l *Leader
+}
+
+func (o observedLock) Get() (*resourcelock.LeaderElectionRecord, error) {
+	if o.l.refuseAttempt() {
+		return nil, fmt.Errorf("%s is leaving the election", o.l.identity)
+	}
+	record, err := o.Interface.Get()
+	if err != nil {
+		o.l.observeRenewal(nil, err)
+		return nil, err
+	}
+	o.l.observeRecord(record)
+	return record, nil
+}
+
+func (o observedLock) Create(record resourcelock.LeaderElectionRecord) error {
+	err := o.Interface.Create(record)
+	o.l.observeRenewal(&record, err)
+	return err
+}
+
+func (o observedLock) Update(record resourcelock.LeaderElectionRecord) error {
+	err := o.Interface.Update(record)
+	o.l.observeRenewal(&record, err)
+	return err
+}
+
+func (l *Leader) observeRecord(record *resourcelock.LeaderElectionRecord) {
+	l.stateLock.Lock()
+	defer l.stateLock.Unlock()
+	l.transitions = record.LeaderTransitions
+}
+
+// observeRenewal records a write of the lock, or a failure to read or write
+// it. Failures only count as failed renewals while leading, other candidates
+// fail to take the lease all the time.
+func (l *Leader) observeRenewal(record *resourcelock.LeaderElectionRecord, err error) {
+	l.stateLock.Lock()
+	defer l.stateLock.Unlock()
+	if err != nil {
+		if l.isLeader {
+			l.failedRenewals++
+		}
+		return
+	}
+	l.transitions = record.LeaderTransitions
+	// The lease is released by writing a record without a holder.
+	if record.HolderIdentity == l.identity {
+		l.lastRenewal = record.RenewTime.Time
+	}
+}
@@ -0,0 +1,312 @@
+package metrics
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// clientGoMetrics are the metrics of the workqueues of client-go, and of the
+// lists and watches of informers, labeled by the name of the queue or
+// informer.
+type clientGoMetrics struct {
+	queueDepth                   *prometheus.GaugeVec
+	queueAdds                    *prometheus.CounterVec
+	queueLatency                 *prometheus.HistogramVec
+	queueWorkDuration            *prometheus.HistogramVec
+	queueUnfinishedWork          *prometheus.GaugeVec
+	queueLongestRunning          *prometheus.GaugeVec
+	queueRetries                 *prometheus.CounterVec
+	reflectorLists               *prometheus.CounterVec
+	reflectorListDuration        *prometheus.SummaryVec
+	reflectorItemsInList         *prometheus.SummaryVec
+	reflectorWatches             *prometheus.CounterVec
+	reflectorShortWatches        *prometheus.CounterVec
+	reflectorWatchDuration       *prometheus.SummaryVec
+	reflectorItemsInWatch        *prometheus.SummaryVec
+	reflectorLastResourceVersion *prometheus.GaugeVec
+}
+
+func newClientGoMetrics() *clientGoMetrics {
+	name := []string{"name"}
+	return &clientGoMetrics{
+		queueDepth: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "workqueue_depth",
+			Help: "The current depth of a workqueue",
+		}, name),
+		queueAdds: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "workqueue_adds_total",
+			Help: "The total number of items added to a workqueue",
+		}, name),
+		queueLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "workqueue_queue_duration_seconds",
+			Help:    "How long items stay in a workqueue before being processed",
+			Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+		}, name),
+		queueWorkDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "workqueue_work_duration_seconds",
+			Help:    "How long processing an item from a workqueue takes",
+			Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+		}, name),
+		queueUnfinishedWork: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "workqueue_unfinished_work_seconds",
+			Help: "The total time the items of a workqueue that are still being processed have been in progress",
+		}, name),
+		queueLongestRunning: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "workqueue_longest_running_processor_seconds",
+			Help: "How long the longest running processor of a workqueue has been running",
+		}, name),
+		queueRetries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "workqueue_retries_total",
+			Help: "The total number of retries handled by a workqueue",
+		}, name),
+		reflectorLists: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "reflector_lists_total",
+			Help: "The total number of lists done by a reflector",
+		}, name),
+		reflectorListDuration: prometheus.NewSummaryVec(prometheus.SummaryOpts{
+			Name: "reflector_list_duration_seconds",
+			Help: "How long the lists of a reflector take",
+		}, name),
+		reflectorItemsInList: prometheus.NewSummaryVec(prometheus.SummaryOpts{
+			Name: "reflector_items_per_list",
+			Help: "How many items the lists of a reflector return",
+		}, name),
+		reflectorWatches: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "reflector_watches_total",
+			Help: "The total number of watches started by a reflector",
+		}, name),
+		reflectorShortWatches: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "reflector_short_watches_total",
+			Help: "The total number of watches of a reflector that ended early",
+		}, name),
+		reflectorWatchDuration: prometheus.NewSummaryVec(prometheus.SummaryOpts{
+			Name: "reflector_watch_duration_seconds",
+			Help: "How long the watches of a reflector last",
+		}, name),
+		reflectorItemsInWatch: prometheus.NewSummaryVec(prometheus.SummaryOpts{
+			Name: "reflector_items_per_watch",
+			Help: "How many items the watches of a reflector receive",
+		}, name),
+		reflectorLastResourceVersion: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "reflector_last_resource_version",
+			Help: "The last resource version seen by a reflector",
+		}, name),
+	}
+}
+
+func (m *clientGoMetrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.queueDepth, m.queueAdds, m.queueLatency, m.queueWorkDuration,
+		m.queueUnfinishedWork, m.queueLongestRunning, m.queueRetries,
+		m.reflectorLists, m.reflectorListDuration, m.reflectorItemsInList,
+		m.reflectorWatches, m.reflectorShortWatches, m.reflectorWatchDuration,
+		m.reflectorItemsInWatch, m.reflectorLastResourceVersion,
+	}
+}
+
+// InstallClientGoProviders makes the workqueues created from now on report
+// to these metrics. client-go only takes the first provider it is given, so
+// only the first call in a process has an effect, and it must come before
+// the workqueues are created. The client-go this is built with never reports
+// the metrics of reflectors, which InstrumentListerWatcher reports instead.
+func (m *Metrics) InstallClientGoProviders() {
+	workqueue.SetProvider(workqueueProvider{m.clientGo})
+}
+
+// workqueueProvider implements workqueue.MetricsProvider. The deprecated
+// metrics are not exported.
+type workqueueProvider struct {
+	m *clientGoMetrics
+}
+
+func (p workqueueProvider) NewDepthMetric(name string) workqueue.GaugeMetric {
+	return p.m.queueDepth.WithLabelValues(name)
+}
+
+func (p workqueueProvider) NewAddsMetric(name string) workqueue.CounterMetric {
+	return p.m.queueAdds.WithLabelValues(name)
+}
+
+func (p workqueueProvider) NewLatencyMetric(name string) workqueue.HistogramMetric {
+	return p.m.queueLatency.WithLabelValues(name)
+}
+
+func (p workqueueProvider) NewWorkDurationMetric(name string) workqueue.HistogramMetric {
+	return p.m.queueWorkDuration.WithLabelValues(name)
+}
+
+func (p workqueueProvider) NewUnfinishedWorkSecondsMetric(name string) workqueue.SettableGaugeMetric {
+	return p.m.queueUnfinishedWork.WithLabelValues(name)
+}
+
+func (p workqueueProvider) NewLongestRunningProcessorSecondsMetric(name string) workqueue.SettableGaugeMetric {
+	return p.m.queueLongestRunning.WithLabelValues(name)
+}
+
+func (p workqueueProvider) NewRetriesMetric(name string) workqueue.CounterMetric {
+	return p.m.queueRetries.WithLabelValues(name)
+}
+
+func (workqueueProvider) NewDeprecatedDepthMetric(name string) workqueue.GaugeMetric {
+	return noopMetric{}
+}
+
+func (workqueueProvider) NewDeprecatedAddsMetric(name string) workqueue.CounterMetric {
+	return noopMetric{}
+}
+
+func (workqueueProvider) NewDeprecatedLatencyMetric(name string) workqueue.SummaryMetric {
+	return noopMetric{}
+}
+
+func (workqueueProvider) NewDeprecatedWorkDurationMetric(name string) workqueue.SummaryMetric {
+	return noopMetric{}
+}
+
+func (workqueueProvider) NewDeprecatedUnfinishedWorkSecondsMetric(name string) workqueue.SettableGaugeMetric {
+	return noopMetric{}
+}
+
+func (workqueueProvider) NewDeprecatedLongestRunningProcessorMicrosecondsMetric(name string) workqueue.SettableGaugeMetric {
+	return noopMetric{}
+}
+
+func (workqueueProvider) NewDeprecatedRetriesMetric(name string) workqueue.CounterMetric {
+	return noopMetric{}
+}
+
+// InstrumentListerWatcher returns lw reporting its lists and watches to the
+// reflector metrics under name. Informers built on it report the metrics
+// their reflector would.
+func (m *Metrics) InstrumentListerWatcher(name string, lw cache.ListerWatcher) cache.ListerWatcher {
+	return &instrumentedListerWatcher{
+		ListerWatcher:       lw,
+		lists:               m.clientGo.reflectorLists.WithLabelValues(name),
+		listDuration:        m.clientGo.reflectorListDuration.WithLabelValues(name),
+		itemsInList:         m.clientGo.reflectorItemsInList.WithLabelValues(name),
+		watches:             m.clientGo.reflectorWatches.WithLabelValues(name),
+		shortWatches:        m.clientGo.reflectorShortWatches.WithLabelValues(name),
+		watchDuration:       m.clientGo.reflectorWatchDuration.WithLabelValues(name),
+		itemsInWatch:        m.clientGo.reflectorItemsInWatch.WithLabelValues(name),
+		lastResourceVersion: m.clientGo.reflectorLastResourceVersion.WithLabelValues(name),
+	}
+}
+
+// shortWatch is how long a watch receiving nothing must last not to be
+// counted as ending early, as in the reflector.
+const shortWatch = time.Second
+
+type instrumentedListerWatcher struct {
+	cache.ListerWatcher
+
+	lists               prometheus.Counter
+	listDuration        prometheus.Observer
+	itemsInList         prometheus.Observer
+	watches             prometheus.Counter
+	shortWatches        prometheus.Counter
+	watchDuration       prometheus.Observer
+	itemsInWatch        prometheus.Observer
+	lastResourceVersion prometheus.Gauge
+}
+
+func (lw *instrumentedListerWatcher) List(options metav1.ListOptions) (runtime.Object, error) {
+	start := time.Now()
+	list, err := lw.ListerWatcher.List(options)
+	if err != nil {
+		return nil, err
+	}
+	lw.lists.Inc()
+	lw.listDuration.Observe(time.Since(start).Seconds())
+	lw.itemsInList.Observe(float64(meta.LenList(list)))
+	if accessor, err := meta.ListAccessor(list); err == nil {
+		lw.setResourceVersion(accessor.GetResourceVersion())
+	}
+	return list, nil
+}
+
+func (lw *instrumentedListerWatcher) Watch(options metav1.ListOptions) (watch.Interface, error) {
+	w, err := lw.ListerWatcher.Watch(options)
+	if err != nil {
+		return nil, err
+	}
+	lw.watches.Inc()
+	instrumented := &instrumentedWatch{
+		lw:      lw,
+		watch:   w,
+		result:  make(chan watch.Event),
+		stopped: make(chan struct{}),
+	}
+	go instrumented.receive()
+	return instrumented, nil
+}
+
+// setResourceVersion records version, if it is a number, as resource
+// versions are meant to be opaque.
+func (lw *instrumentedListerWatcher) setResourceVersion(version string) {
+	if value, err := strconv.ParseFloat(version, 64); err == nil {
+		lw.lastResourceVersion.Set(value)
+	}
+}
+
+// instrumentedWatch passes on the events of a watch, counting them, until
+// the watch ends or is stopped.
+type instrumentedWatch struct {
+	lw       *instrumentedListerWatcher
+	watch    watch.Interface
+	result   chan watch.Event
+	stopped  chan struct{}
+	stopOnce sync.Once
+}
+
+func (w *instrumentedWatch) ResultChan() <-chan watch.Event {
+	return w.result
+}
+
+func (w *instrumentedWatch) Stop() {
+	w.stopOnce.Do(func() {
+		close(w.stopped)
+		w.watch.Stop()
+	})
+}
+
+func (w *instrumentedWatch) receive() {
+	defer close(w.result)
+	start := time.Now()
+	items := 0
+	defer func() {
+		duration := time.Since(start)
+		w.lw.watchDuration.Observe(duration.Seconds())
+		w.lw.itemsInWatch.Observe(float64(items))
+		if duration < shortWatch && items == 0 {
+			w.lw.shortWatches.Inc()
+		}
+	}()
+
+	for event := range w.watch.ResultChan() {
+		items++
+		if accessor, err := meta.Accessor(event.Object); err == nil {
+			w.lw.setResourceVersion(accessor.GetResourceVersion())
+		}
+		select {
+		case w.result <- event:
+		case <-w.stopped:
+			return
+		}
+	}
+}
+
+type noopMetric struct{}
+
+func (noopMetric) Inc()            {}
+func (noopMetric) Dec()            {}
+func (noopMetric) Observe(float64) {}
+func (noopMetric) Set(float64)     {}
@@ -0,0 +1,83 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+func TestWorkqueueMetrics(t *testing.T) {
+	m := New()
+	m.InstallClientGoProviders()
+
+	queue := workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "test")
+	defer queue.ShutDown()
+	queue.Add("a")
+	queue.Add("b")
+	queue.AddRateLimited("c")
+
+	if value := testutil.ToFloat64(m.clientGo.queueAdds.WithLabelValues("test")); value != 2 {
+		t.Errorf("expected 2 adds, got %v", value)
+	}
+	if value := testutil.ToFloat64(m.clientGo.queueDepth.WithLabelValues("test")); value != 2 {
+		t.Errorf("expected a depth of 2, got %v", value)
+	}
+	if value := testutil.ToFloat64(m.clientGo.queueRetries.WithLabelValues("test")); value != 1 {
+		t.Errorf("expected 1 retry, got %v", value)
+	}
+
+	item, _ := queue.Get()
+	queue.Done(item)
+	if value := testutil.ToFloat64(m.clientGo.queueDepth.WithLabelValues("test")); value != 1 {
+		t.Errorf("expected a depth of 1, got %v", value)
+	}
+}
+
+func TestInformerMetrics(t *testing.T) {
+	m := New()
+	watcher := watch.NewFake()
+	lw := m.InstrumentListerWatcher("test", &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			return &corev1.ConfigMapList{
+				ListMeta: metav1.ListMeta{ResourceVersion: "10"},
+				Items:    []corev1.ConfigMap{{ObjectMeta: metav1.ObjectMeta{Name: "a"}}, {ObjectMeta: metav1.ObjectMeta{Name: "b"}}},
+			}, nil
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			return watcher, nil
+		},
+	})
+	informer := cache.NewSharedIndexInformer(lw, &corev1.ConfigMap{}, 0, cache.Indexers{})
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go informer.Run(stopCh)
+	if !cache.WaitForCacheSync(stopCh, informer.HasSynced) {
+		t.Fatalf("expected the informer to sync")
+	}
+
+	if value := testutil.ToFloat64(m.clientGo.reflectorLists.WithLabelValues("test")); value != 1 {
+		t.Errorf("expected 1 list, got %v", value)
+	}
+	if value := testutil.ToFloat64(m.clientGo.reflectorLastResourceVersion.WithLabelValues("test")); value != 10 {
+		t.Errorf("expected resource version 10, got %v", value)
+	}
+
+	watcher.Add(&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "c", ResourceVersion: "11"}})
+	err := wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		return testutil.ToFloat64(m.clientGo.reflectorLastResourceVersion.WithLabelValues("test")) == 11, nil
+	})
+	if err != nil {
+		t.Errorf("expected the resource version of the watched event to be recorded")
+	}
+	if value := testutil.ToFloat64(m.clientGo.reflectorWatches.WithLabelValues("test")); value != 1 {
+		t.Errorf("expected 1 watch, got %v", value)
+	}
+}
@@ -0,0 +1,74 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"k8s.io/sample-controller/pkg/leader"
+)
+
+// ReportLeaderElection sets the function the state of the election is taken
+// from on every scrape.
+func (m *Metrics) ReportLeaderElection(status func() leader.Status) {
+	m.leader.setStatus(status)
+}
+
+// leaderCollector reports the state of the election, read when scraped.
+type leaderCollector struct {
+	lock   sync.Mutex
+	status func() leader.Status
+	now    func() time.Time
+}
+
+func (c *leaderCollector) setStatus(status func() leader.Status) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.status = status
+}
+
+func (c *leaderCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- leaderIsLeader
+	ch <- leaderInfo
+	ch <- leaderTransitions
+	ch <- leaderSinceRenewal
+	ch <- leaderFailedRenewals
+}
+
+func (c *leaderCollector) Collect(ch chan<- prometheus.Metric) {
+	c.lock.Lock()
+	status := c.status
+	c.lock.Unlock()
+	if status == nil {
+		return
+	}
+
+	s := status()
+	isLeader := 0.0
+	if s.IsLeader {
+		isLeader = 1
+	}
+	ch <- prometheus.MustNewConstMetric(leaderIsLeader, prometheus.GaugeValue, isLeader, s.Identity)
+	if s.Leader != "" {
+		ch <- prometheus.MustNewConstMetric(leaderInfo, prometheus.GaugeValue, 1, s.Leader)
+	}
+	ch <- prometheus.MustNewConstMetric(leaderTransitions, prometheus.CounterValue, float64(s.Transitions))
+	if !s.LastRenewal.IsZero() {
+		ch <- prometheus.MustNewConstMetric(leaderSinceRenewal, prometheus.GaugeValue, c.now().Sub(s.LastRenewal).Seconds())
+	}
+	ch <- prometheus.MustNewConstMetric(leaderFailedRenewals, prometheus.CounterValue, float64(s.FailedRenewals))
+}
+
+var (
+	leaderIsLeader = prometheus.NewDesc("leader_election_is_leader",
+		"Whether this replica leads, 1 if it does", []string{"identity"}, nil)
+	leaderInfo = prometheus.NewDesc("leader_election_leader",
+		"The identity of the replica leading, always 1", []string{"identity"}, nil)
+	leaderTransitions = prometheus.NewDesc("leader_election_transitions_total",
+		"The total number of times the lease changed hands", nil, nil)
+	leaderSinceRenewal = prometheus.NewDesc("leader_election_seconds_since_last_renewal",
+		"The time since this replica last acquired or renewed the lease", nil, nil)
+	leaderFailedRenewals = prometheus.NewDesc("leader_election_failed_renewals_total",
+		"The total number of times this replica failed to renew the lease while leading", nil, nil)
+)
@@ -0,0 +1,84 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"k8s.io/sample-controller/pkg/leader"
+)
+
+func TestReportLeaderElection(t *testing.T) {
+	m := New()
+	now := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	m.leader.now = func() time.Time { return now }
+
+	// Nothing is reported without an election.
+	if err := testutil.CollectAndCompare(m.leader, strings.NewReader("")); err != nil {
+		t.Error(err)
+	}
+
+	status := leader.Status{
+		Identity:       "replica-1",
+		IsLeader:       true,
+		Leader:         "replica-1",
+		Transitions:    3,
+		LastRenewal:    now.Add(-2 * time.Second),
+		FailedRenewals: 1,
+	}
+	m.ReportLeaderElection(func() leader.Status { return status })
+	if err := testutil.CollectAndCompare(m.leader, strings.NewReader(`
+# HELP leader_election_failed_renewals_total The total number of times this replica failed to renew the lease while leading
+# TYPE leader_election_failed_renewals_total counter
+leader_election_failed_renewals_total 1
+# HELP leader_election_is_leader Whether this replica leads, 1 if it does
+# TYPE leader_election_is_leader gauge
+leader_election_is_leader{identity="replica-1"} 1
+# HELP leader_election_leader The identity of the replica leading, always 1
+# TYPE leader_election_leader gauge
+leader_election_leader{identity="replica-1"} 1
+# HELP leader_election_seconds_since_last_renewal The time since this replica last acquired or renewed the lease
+# TYPE leader_election_seconds_since_last_renewal gauge
+leader_election_seconds_since_last_renewal 2
+# HELP leader_election_transitions_total The total number of times the lease changed hands
+# TYPE leader_election_transitions_total counter
+leader_election_transitions_total 3
+`)); err != nil {
+		t.Error(err)
+	}
+
+	// A replica that never led has no renewal to report.
+	status = leader.Status{Identity: "replica-2", Leader: "replica-1", Transitions: 3}
+	if err := testutil.CollectAndCompare(m.leader, strings.NewReader(`
+# HELP leader_election_is_leader Whether this replica leads, 1 if it does
+# TYPE leader_election_is_leader gauge
+leader_election_is_leader{identity="replica-2"} 0
+# HELP leader_election_leader The identity of the replica leading, always 1
+# TYPE leader_election_leader gauge
+leader_election_leader{identity="replica-1"} 1
+`), "leader_election_is_leader", "leader_election_leader", "leader_election_seconds_since_last_renewal"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHandle(t *testing.T) {
+	m := New()
+	m.Handle("/leader", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("replica-1"))
+	}))
+
+	w := httptest.NewRecorder()
+	m.mux.ServeHTTP(w, httptest.NewRequest("GET", "/leader", nil))
+	if w.Body.String() != "replica-1" {
+		t.Errorf("expected the added handler to serve /leader, got %q", w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	m.mux.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(w.Body.String(), "go_goroutines") {
+		t.Errorf("expected the metrics at /metrics, got:\n%s", w.Body.String())
+	}
+}
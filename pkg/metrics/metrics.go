@@ -2,32 +2,297 @@ package metrics
 
 import (
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/klog"
+
+	vmctl "k8s.io/sample-controller/pkg/cloud"
+)
+
+// Types of informer events counted by EventReceived.
+const (
+	EventAdd    = "add"
+	EventUpdate = "update"
+	EventDelete = "delete"
+)
+
+// Outcomes of a reconcile counted by ObserveReconcile.
+const (
+	OutcomeSuccess = "success"
+	OutcomeError   = "error"
 )
 
+// Metrics holds the metrics of the controller, in a registry of its own so
+// that any number of controllers, and tests, can have theirs.
 type Metrics struct {
-	k8sEventCounter prometheus.Gauge
+	registry *prometheus.Registry
+	mux      *http.ServeMux
+
+	events            *prometheus.CounterVec
+	reconciles        *prometheus.CounterVec
+	reconcileDuration *prometheus.HistogramVec
+	orphanedServers   prometheus.Gauge
+	driftDetected     *prometheus.CounterVec
+
+	// The guest metrics of each VM, labeled by namespace, VM name and
+	// server ID.
+	vmCPUUtilization *prometheus.GaugeVec
+	vmMemoryUsage    *prometheus.GaugeVec
+	vmDiskRead       *prometheus.GaugeVec
+	vmDiskWrite      *prometheus.GaugeVec
+	vmNetworkRx      *prometheus.GaugeVec
+	vmNetworkTx      *prometheus.GaugeVec
+	vmUptime         *prometheus.GaugeVec
+
+	// vmIDs records the server ID each VM is exported with, by
+	// namespace/name, so its series can be deleted.
+	vmIDsLock sync.Mutex
+	vmIDs     map[string]string
+
+	phases *phaseCollector
+	leader *leaderCollector
+
+	clientGo *clientGoMetrics
+}
+
+// New returns metrics registered in a new registry, along with the Go
+// runtime and process metrics.
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		mux:      http.NewServeMux(),
+
+		events:            prometheus.NewCounterVec(events, []string{"type"}),
+		reconciles:        prometheus.NewCounterVec(reconciles, []string{"outcome"}),
+		reconcileDuration: prometheus.NewHistogramVec(reconcileDuration, []string{"outcome"}),
+		orphanedServers:   prometheus.NewGauge(orphanedServers),
+		driftDetected:     prometheus.NewCounterVec(driftDetected, []string{"type"}),
+
+		vmCPUUtilization: prometheus.NewGaugeVec(vmCPUUtilization, vmLabels),
+		vmMemoryUsage:    prometheus.NewGaugeVec(vmMemoryUsage, vmLabels),
+		vmDiskRead:       prometheus.NewGaugeVec(vmDiskRead, vmLabels),
+		vmDiskWrite:      prometheus.NewGaugeVec(vmDiskWrite, vmLabels),
+		vmNetworkRx:      prometheus.NewGaugeVec(vmNetworkRx, vmLabels),
+		vmNetworkTx:      prometheus.NewGaugeVec(vmNetworkTx, vmLabels),
+		vmUptime:         prometheus.NewGaugeVec(vmUptime, vmLabels),
+		vmIDs:            map[string]string{},
+
+		phases:   &phaseCollector{},
+		leader:   &leaderCollector{now: time.Now},
+		clientGo: newClientGoMetrics(),
+	}
+	m.registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		m.events,
+		m.reconciles,
+		m.reconcileDuration,
+		m.orphanedServers,
+		m.driftDetected,
+		m.vmCPUUtilization,
+		m.vmMemoryUsage,
+		m.vmDiskRead,
+		m.vmDiskWrite,
+		m.vmNetworkRx,
+		m.vmNetworkTx,
+		m.vmUptime,
+		m.phases,
+		m.leader,
+	)
+	m.registry.MustRegister(m.clientGo.collectors()...)
+	m.mux.Handle("/metrics", m.Handler())
+	return m
+}
+
+// Registry returns the registry of the metrics, to register more
+// collectors with.
+func (m *Metrics) Registry() *prometheus.Registry {
+	return m.registry
+}
+
+// Handler returns a handler serving the metrics in the Prometheus format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// Handle serves handler at pattern next to the metrics, for debug and
+// health endpoints.
+func (m *Metrics) Handle(pattern string, handler http.Handler) {
+	m.mux.Handle(pattern, handler)
+}
+
+// Serve serves the metrics at /metrics, and the handlers given to Handle, on
+// address until stopCh is closed.
+func (m *Metrics) Serve(address string, stopCh <-chan struct{}) error {
+	server := &http.Server{Addr: address, Handler: m.mux}
+	go func() {
+		<-stopCh
+		server.Close()
+	}()
+
+	klog.Infof("Serving metrics on %s", address)
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// EventReceived counts an informer event of the given type.
+func (m *Metrics) EventReceived(eventType string) {
+	m.events.WithLabelValues(eventType).Inc()
+}
+
+// ObserveReconcile counts a reconcile with the given outcome and records how
+// long it took.
+func (m *Metrics) ObserveReconcile(outcome string, duration time.Duration) {
+	m.reconciles.WithLabelValues(outcome).Inc()
+	m.reconcileDuration.WithLabelValues(outcome).Observe(duration.Seconds())
+}
+
+// SetOrphanedServers records how many servers owned by this cluster have no
+// VM left.
+func (m *Metrics) SetOrphanedServers(n int) {
+	m.orphanedServers.Set(float64(n))
 }
 
-func (m *Metrics) K8sEventUpdate() {
-	m.k8sEventCounter.SetToCurrentTime()
+// DriftDetected counts a drift of the given kind between a VM and its cloud
+// server.
+func (m *Metrics) DriftDetected(kind string) {
+	m.driftDetected.WithLabelValues(kind).Inc()
 }
 
-func InitMetrics(address string) *Metrics {
-	http.Handle("/metrics", promhttp.Handler())
-	go http.ListenAndServe(":2112", nil)
-	return &Metrics{
-		k8sEventCounter: promauto.NewGauge(k8sEventCounter),
+// CountVMsByPhase sets the function the number of VMs in each phase is taken
+// from on every scrape.
+func (m *Metrics) CountVMsByPhase(count func() map[string]int) {
+	m.phases.setCount(count)
+}
+
+// SetVMStatus exports the guest metrics of the server of a VM. Series of a
+// server the VM had before are deleted.
+func (m *Metrics) SetVMStatus(namespace, name, vmid string, status vmctl.ServerStatus) {
+	m.vmIDsLock.Lock()
+	defer m.vmIDsLock.Unlock()
+
+	key := namespace + "/" + name
+	if old, ok := m.vmIDs[key]; ok && old != vmid {
+		m.deleteVMSeries(namespace, name, old)
+	}
+	m.vmIDs[key] = vmid
+
+	m.vmCPUUtilization.WithLabelValues(namespace, name, vmid).Set(float64(status.CpuUtilization))
+	m.vmMemoryUsage.WithLabelValues(namespace, name, vmid).Set(float64(status.MemoryUsageBytes))
+	m.vmDiskRead.WithLabelValues(namespace, name, vmid).Set(float64(status.DiskReadBytes))
+	m.vmDiskWrite.WithLabelValues(namespace, name, vmid).Set(float64(status.DiskWriteBytes))
+	m.vmNetworkRx.WithLabelValues(namespace, name, vmid).Set(float64(status.NetworkRxBytes))
+	m.vmNetworkTx.WithLabelValues(namespace, name, vmid).Set(float64(status.NetworkTxBytes))
+	m.vmUptime.WithLabelValues(namespace, name, vmid).Set(float64(status.UptimeSeconds))
+}
+
+// DeleteVM stops exporting the guest metrics of a VM.
+func (m *Metrics) DeleteVM(namespace, name string) {
+	m.vmIDsLock.Lock()
+	defer m.vmIDsLock.Unlock()
+
+	key := namespace + "/" + name
+	if vmid, ok := m.vmIDs[key]; ok {
+		m.deleteVMSeries(namespace, name, vmid)
+		delete(m.vmIDs, key)
 	}
+}
+
+func (m *Metrics) deleteVMSeries(namespace, name, vmid string) {
+	for _, gauge := range []*prometheus.GaugeVec{
+		m.vmCPUUtilization, m.vmMemoryUsage, m.vmDiskRead, m.vmDiskWrite,
+		m.vmNetworkRx, m.vmNetworkTx, m.vmUptime,
+	} {
+		gauge.DeleteLabelValues(namespace, name, vmid)
+	}
+}
+
+// phaseCollector reports the number of VMs in each phase, counted when
+// scraped so it never goes stale.
+type phaseCollector struct {
+	lock  sync.Mutex
+	count func() map[string]int
+}
+
+func (c *phaseCollector) setCount(count func() map[string]int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.count = count
+}
 
+func (c *phaseCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- vmPhases
+}
+
+func (c *phaseCollector) Collect(ch chan<- prometheus.Metric) {
+	c.lock.Lock()
+	count := c.count
+	c.lock.Unlock()
+	if count == nil {
+		return
+	}
+	for phase, n := range count() {
+		ch <- prometheus.MustNewConstMetric(vmPhases, prometheus.GaugeValue, float64(n), phase)
+	}
 }
 
 var (
-	k8sEventCounter = prometheus.GaugeOpts{
-		Name: "k8s_processed_ops_total",
-		Help: "The total number of processed events",
+	events = prometheus.CounterOpts{
+		Name: "vm_events_total",
+		Help: "The total number of VM events received from the informer, by type",
+	}
+	reconciles = prometheus.CounterOpts{
+		Name: "vm_reconciles_total",
+		Help: "The total number of VM reconciles, by outcome",
+	}
+	reconcileDuration = prometheus.HistogramOpts{
+		Name:    "vm_reconcile_duration_seconds",
+		Help:    "How long VM reconciles took, by outcome",
+		Buckets: prometheus.ExponentialBuckets(0.005, 2, 14),
+	}
+	vmPhases = prometheus.NewDesc("vm_phase_count",
+		"The number of VMs in each phase", []string{"phase"}, nil)
+	orphanedServers = prometheus.GaugeOpts{
+		Name: "vm_orphaned_servers",
+		Help: "The number of cloud servers owned by this cluster without a VM",
+	}
+	driftDetected = prometheus.CounterOpts{
+		Name: "vm_drift_detected_total",
+		Help: "The total number of times a cloud server was found to differ from its VM, by type of drift",
+	}
+
+	vmLabels         = []string{"namespace", "vm", "vmid"}
+	vmCPUUtilization = prometheus.GaugeOpts{
+		Name: "vm_cpu_utilization_percent",
+		Help: "The CPU utilization of the cloud server of a VM",
+	}
+	vmMemoryUsage = prometheus.GaugeOpts{
+		Name: "vm_memory_usage_bytes",
+		Help: "The memory in use on the cloud server of a VM",
+	}
+	vmDiskRead = prometheus.GaugeOpts{
+		Name: "vm_disk_read_bytes",
+		Help: "The bytes read from disk by the cloud server of a VM since it booted",
+	}
+	vmDiskWrite = prometheus.GaugeOpts{
+		Name: "vm_disk_written_bytes",
+		Help: "The bytes written to disk by the cloud server of a VM since it booted",
+	}
+	vmNetworkRx = prometheus.GaugeOpts{
+		Name: "vm_network_receive_bytes",
+		Help: "The bytes received by the cloud server of a VM since it booted",
+	}
+	vmNetworkTx = prometheus.GaugeOpts{
+		Name: "vm_network_transmit_bytes",
+		Help: "The bytes sent by the cloud server of a VM since it booted",
+	}
+	vmUptime = prometheus.GaugeOpts{
+		Name: "vm_uptime_seconds",
+		Help: "The time since the cloud server of a VM booted",
 	}
 )
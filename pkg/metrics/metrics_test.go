@@ -0,0 +1,126 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	vmctl "k8s.io/sample-controller/pkg/cloud"
+)
+
+const cpuHeader = `
+# HELP vm_cpu_utilization_percent The CPU utilization of the cloud server of a VM
+# TYPE vm_cpu_utilization_percent gauge
+`
+
+func TestSetVMStatus(t *testing.T) {
+	m := New()
+	m.SetVMStatus("default", "a", "id-1", vmctl.ServerStatus{CpuUtilization: 10, MemoryUsageBytes: 1024})
+	m.SetVMStatus("default", "b", "id-2", vmctl.ServerStatus{CpuUtilization: 20})
+
+	expected := cpuHeader + `
+vm_cpu_utilization_percent{namespace="default",vm="a",vmid="id-1"} 10
+vm_cpu_utilization_percent{namespace="default",vm="b",vmid="id-2"} 20
+`
+	if err := testutil.CollectAndCompare(m.vmCPUUtilization, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+	if value := testutil.ToFloat64(m.vmMemoryUsage.WithLabelValues("default", "a", "id-1")); value != 1024 {
+		t.Errorf("expected memory usage 1024, got %v", value)
+	}
+
+	// A recreated server replaces the series of the old one.
+	m.SetVMStatus("default", "a", "id-3", vmctl.ServerStatus{CpuUtilization: 30})
+	expected = cpuHeader + `
+vm_cpu_utilization_percent{namespace="default",vm="a",vmid="id-3"} 30
+vm_cpu_utilization_percent{namespace="default",vm="b",vmid="id-2"} 20
+`
+	if err := testutil.CollectAndCompare(m.vmCPUUtilization, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDeleteVM(t *testing.T) {
+	m := New()
+	m.SetVMStatus("default", "a", "id-1", vmctl.ServerStatus{CpuUtilization: 10})
+	m.SetVMStatus("default", "b", "id-2", vmctl.ServerStatus{CpuUtilization: 20})
+
+	m.DeleteVM("default", "a")
+	// Deleting a VM never exported is harmless.
+	m.DeleteVM("default", "c")
+
+	expected := cpuHeader + `
+vm_cpu_utilization_percent{namespace="default",vm="b",vmid="id-2"} 20
+`
+	if err := testutil.CollectAndCompare(m.vmCPUUtilization, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CollectAndCompare(m.vmUptime, strings.NewReader(`
+# HELP vm_uptime_seconds The time since the cloud server of a VM booted
+# TYPE vm_uptime_seconds gauge
+vm_uptime_seconds{namespace="default",vm="b",vmid="id-2"} 0
+`)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEventsAndReconciles(t *testing.T) {
+	m := New()
+	m.EventReceived(EventAdd)
+	m.EventReceived(EventUpdate)
+	m.EventReceived(EventUpdate)
+	m.ObserveReconcile(OutcomeSuccess, 10*time.Millisecond)
+	m.ObserveReconcile(OutcomeError, time.Second)
+
+	if err := testutil.CollectAndCompare(m.events, strings.NewReader(`
+# HELP vm_events_total The total number of VM events received from the informer, by type
+# TYPE vm_events_total counter
+vm_events_total{type="add"} 1
+vm_events_total{type="update"} 2
+`)); err != nil {
+		t.Error(err)
+	}
+	if value := testutil.ToFloat64(m.reconciles.WithLabelValues(OutcomeError)); value != 1 {
+		t.Errorf("expected 1 failed reconcile, got %v", value)
+	}
+}
+
+func TestCountVMsByPhase(t *testing.T) {
+	m := New()
+	m.CountVMsByPhase(func() map[string]int {
+		return map[string]int{"Running": 2, "Pending": 0}
+	})
+
+	if err := testutil.CollectAndCompare(m.phases, strings.NewReader(`
+# HELP vm_phase_count The number of VMs in each phase
+# TYPE vm_phase_count gauge
+vm_phase_count{phase="Pending"} 0
+vm_phase_count{phase="Running"} 2
+`)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	// Each instance has its own registry, so having two is fine.
+	New()
+	m := New()
+	m.ObserveReconcile(OutcomeSuccess, 10*time.Millisecond)
+
+	w := httptest.NewRecorder()
+	m.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := ioutil.ReadAll(w.Body)
+	for _, expected := range []string{
+		`vm_reconcile_duration_seconds_bucket{outcome="success",le="0.01"} 1`,
+		`vm_reconciles_total{outcome="success"} 1`,
+		"go_goroutines",
+	} {
+		if !strings.Contains(string(body), expected) {
+			t.Errorf("expected %q in the metrics, got:\n%s", expected, body)
+		}
+	}
+}
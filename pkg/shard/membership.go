@@ -0,0 +1,341 @@
+package shard
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+
+	"k8s.io/sample-controller/pkg/config"
+	"k8s.io/sample-controller/pkg/leader"
+)
+
+// GroupLabel is set on the Leases of the members of a group to the name of
+// the group.
+const GroupLabel = "samplecontroller.k8s.io/shard-group"
+
+// Config configures the membership of a replica in a group.
+type Config struct {
+	// Group names the replicas sharing the VMs.
+	Group     string
+	Namespace string
+	// Identity tells the members apart, it must be unique among them.
+	Identity string
+
+	// LeaseDuration is how long a member that stopped renewing its Lease
+	// keeps its share.
+	LeaseDuration time.Duration
+	// RenewPeriod is how often members renew their Lease and look for
+	// others joining or leaving.
+	RenewPeriod time.Duration
+}
+
+// DefaultConfig returns the configuration used unless told otherwise, that
+// of the default controller configuration.
+func DefaultConfig() Config {
+	return NewConfig(config.Default().Sharding)
+}
+
+// NewConfig returns the configuration of the membership described in the
+// controller configuration.
+func NewConfig(c config.ShardingConfiguration) Config {
+	return Config{
+		Group:         c.Group,
+		Namespace:     c.Namespace,
+		Identity:      c.Identity,
+		LeaseDuration: c.LeaseDuration.Duration,
+		RenewPeriod:   c.RenewPeriod.Duration,
+	}
+}
+
+// Validate checks the configuration makes a working group, by the rules of
+// the controller configuration.
+func (c *Config) Validate() error {
+	configuration := config.ShardingConfiguration{
+		Group:         c.Group,
+		Namespace:     c.Namespace,
+		LeaseDuration: metav1.Duration{Duration: c.LeaseDuration},
+		RenewPeriod:   metav1.Duration{Duration: c.RenewPeriod},
+	}
+	return configuration.Validate()
+}
+
+// Membership keeps a replica in a group and tracks the other members. Each
+// member holds a Lease of its own, labeled with the group, and members whose
+// Lease expired are dropped from the ring.
+//
+// Members see others join and leave at different times, up to a renew
+// period apart. So that a key is never owned by two replicas meanwhile, a
+// replica gaining keys from a member still in the group only owns them a
+// lease duration later, by when that member has seen the change and given
+// them up. While the group changes a key may thus briefly be owned by none.
+type Membership struct {
+	client kubernetes.Interface
+	config Config
+
+	lock sync.Mutex
+	ring *Ring
+	// previous is the ring the other members may still act on until
+	// settled, and pending is set until a change that settled is notified.
+	previous *Ring
+	settled  time.Time
+	pending  bool
+	// synced is when the members were last listed. A member that cannot
+	// reach the API server for a lease duration gives up its share, as the
+	// others will have taken it over.
+	synced time.Time
+
+	// observed is the renew time last seen on the Lease of each member,
+	// by identity, and when it was seen on the local clock.
+	observed map[string]observedLease
+
+	changed chan struct{}
+	now     func() time.Time
+}
+
+// New returns the membership of this replica in the group described by
+// config. An empty identity is replaced by leader.DefaultIdentity.
+func New(client kubernetes.Interface, config Config) (*Membership, error) {
+	if config.Identity == "" {
+		config.Identity = leader.DefaultIdentity()
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return &Membership{
+		client:   client,
+		config:   config,
+		ring:     NewRing(nil),
+		previous: NewRing(nil),
+		observed: map[string]observedLease{},
+		changed:  make(chan struct{}, 1),
+		now:      time.Now,
+	}, nil
+}
+
+// Run keeps this replica in the group until stopCh is closed, then leaves
+// it, so the others take over its share right away.
+func (m *Membership) Run(stopCh <-chan struct{}) {
+	defer utilruntime.HandleCrash()
+
+	klog.Infof("Joining shard group %s as %s", m.config.Group, m.config.Identity)
+	wait.Until(m.sync, m.config.RenewPeriod, stopCh)
+	m.leave()
+}
+
+// Owns reports whether this replica owns key. Nothing is owned before the
+// replica joined the group, and keys gained from another member only once
+// the change settled.
+func (m *Membership) Owns(key string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	now := m.now()
+	if now.Sub(m.synced) > m.config.LeaseDuration {
+		return false
+	}
+	if m.ring.Owner(key) != m.config.Identity {
+		return false
+	}
+	if !now.Before(m.settled) {
+		return true
+	}
+	// Keys of members that left are taken over right away, as they gave
+	// them up when leaving, or when their Lease expired.
+	previous := m.previous.Owner(key)
+	return previous == "" || previous == m.config.Identity || !m.ring.Has(previous)
+}
+
+// Check fails while this replica is not a member of the group, whether it
+// did not join yet or lost touch with the API server.
+func (m *Membership) Check() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.now().Sub(m.synced) > m.config.LeaseDuration {
+		return fmt.Errorf("members not listed for over %v", m.config.LeaseDuration)
+	}
+	for _, member := range m.ring.Members() {
+		if member == m.config.Identity {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is not a member of shard group %s", m.config.Identity, m.config.Group)
+}
+
+// Members returns the identities of the members of the group, sorted.
+func (m *Membership) Members() []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.ring.Members()
+}
+
+// Changed returns a channel receiving whenever members join or leave, and
+// once the change settled, so the keys this replica gained can be queued.
+// Changes coming faster than they are received are merged.
+func (m *Membership) Changed() <-chan struct{} {
+	return m.changed
+}
+
+// sync renews the Lease of this replica and updates the ring with the
+// members whose Lease is current.
+func (m *Membership) sync() {
+	if err := m.renew(); err != nil {
+		utilruntime.HandleError(fmt.Errorf("error renewing shard lease: %v", err))
+	}
+
+	leases, err := m.client.CoordinationV1().Leases(m.config.Namespace).List(metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(labels.Set{GroupLabel: m.config.Group}).String(),
+	})
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("error listing shard leases: %v", err))
+		return
+	}
+
+	now := m.now()
+	var members, others []string
+	listed := map[string]bool{}
+	for _, lease := range leases.Items {
+		if !m.isCurrent(&lease, now) {
+			continue
+		}
+		identity := *lease.Spec.HolderIdentity
+		listed[identity] = true
+		members = append(members, identity)
+		if identity != m.config.Identity {
+			others = append(others, identity)
+		}
+	}
+	for identity := range m.observed {
+		if !listed[identity] {
+			delete(m.observed, identity)
+		}
+	}
+	ring := NewRing(members)
+
+	m.lock.Lock()
+	changed := !reflect.DeepEqual(ring.Members(), m.ring.Members())
+	if changed {
+		// While a change has not settled, the members may still act on
+		// the ring from before it.
+		if !now.Before(m.settled) {
+			m.previous = m.ring
+			if !m.ring.Has(m.config.Identity) {
+				// Joining, the others shared all the keys.
+				m.previous = NewRing(others)
+			}
+		}
+		m.ring = ring
+		m.settled = now.Add(m.config.LeaseDuration)
+		m.pending = true
+	}
+	settled := m.pending && !now.Before(m.settled)
+	if settled {
+		m.pending = false
+	}
+	m.synced = now
+	m.lock.Unlock()
+
+	if changed {
+		klog.Infof("Shard group %s has members %v", m.config.Group, ring.Members())
+		m.notify()
+	}
+	if settled {
+		klog.V(2).Infof("Shard group %s settled", m.config.Group)
+		m.notify()
+	}
+}
+
+// renew creates or renews the Lease of this replica.
+func (m *Membership) renew() error {
+	leases := m.client.CoordinationV1().Leases(m.config.Namespace)
+	now := metav1.NewMicroTime(m.now())
+	identity := m.config.Identity
+	// Rounded up, a lease of less than a second must not be written as 0.
+	duration := int32((m.config.LeaseDuration + time.Second - 1) / time.Second)
+
+	lease, err := leases.Get(m.leaseName(), metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		_, err = leases.Create(&coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      m.leaseName(),
+				Namespace: m.config.Namespace,
+				Labels:    map[string]string{GroupLabel: m.config.Group},
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &identity,
+				LeaseDurationSeconds: &duration,
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	lease = lease.DeepCopy()
+	lease.Spec.HolderIdentity = &identity
+	lease.Spec.LeaseDurationSeconds = &duration
+	lease.Spec.RenewTime = &now
+	_, err = leases.Update(lease)
+	return err
+}
+
+// leave deletes the Lease of this replica and gives up its share.
+func (m *Membership) leave() {
+	m.lock.Lock()
+	m.ring = NewRing(nil)
+	m.lock.Unlock()
+
+	err := m.client.CoordinationV1().Leases(m.config.Namespace).Delete(m.leaseName(), &metav1.DeleteOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		utilruntime.HandleError(fmt.Errorf("error deleting shard lease: %v", err))
+		return
+	}
+	klog.Infof("Left shard group %s", m.config.Group)
+}
+
+func (m *Membership) notify() {
+	select {
+	case m.changed <- struct{}{}:
+	default:
+	}
+}
+
+func (m *Membership) leaseName() string {
+	return m.config.Group + "-" + m.config.Identity
+}
+
+// observedLease is the renew time seen on a Lease, and when it was seen.
+type observedLease struct {
+	renewTime metav1.MicroTime
+	at        time.Time
+}
+
+// isCurrent reports whether lease was renewed within its duration. As in
+// the leader election, the duration runs from when the renew time was seen
+// to change on the local clock, not from the renew time itself, which was
+// written on the clock of another replica.
+func (m *Membership) isCurrent(lease *coordinationv1.Lease, now time.Time) bool {
+	spec := lease.Spec
+	if spec.HolderIdentity == nil || *spec.HolderIdentity == "" || spec.RenewTime == nil || spec.LeaseDurationSeconds == nil {
+		return false
+	}
+	identity := *spec.HolderIdentity
+	observed, ok := m.observed[identity]
+	if !ok || !observed.renewTime.Equal(spec.RenewTime) {
+		observed = observedLease{renewTime: *spec.RenewTime, at: now}
+		m.observed[identity] = observed
+	}
+	expiry := observed.at.Add(time.Duration(*spec.LeaseDurationSeconds) * time.Second)
+	return now.Before(expiry)
+}
@@ -0,0 +1,221 @@
+package shard
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newMembership(t *testing.T, client kubernetes.Interface, identity string, now *time.Time) *Membership {
+	config := DefaultConfig()
+	config.Namespace = "default"
+	config.Identity = identity
+	m, err := New(client, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.now = func() time.Time { return *now }
+	return m
+}
+
+func expectChanged(t *testing.T, m *Membership, expected bool) {
+	select {
+	case <-m.Changed():
+		if !expected {
+			t.Errorf("%s: expected no change", m.config.Identity)
+		}
+	default:
+		if expected {
+			t.Errorf("%s: expected a change", m.config.Identity)
+		}
+	}
+}
+
+func TestMembership(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	now := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	first := newMembership(t, client, "replica-1", &now)
+	second := newMembership(t, client, "replica-2", &now)
+
+	// Nothing is owned before joining.
+	if first.Owns("default/vm-0") {
+		t.Errorf("expected nothing to be owned before joining")
+	}
+
+	if err := first.Check(); err == nil {
+		t.Errorf("expected the check to fail before joining")
+	}
+
+	first.sync()
+	expectChanged(t, first, true)
+	for _, key := range keys(100) {
+		if !first.Owns(key) {
+			t.Fatalf("expected the only member to own %s", key)
+		}
+	}
+	if err := first.Check(); err != nil {
+		t.Errorf("expected the check to pass once joined, got %v", err)
+	}
+
+	second.sync()
+	first.sync()
+	expectChanged(t, first, true)
+	expectChanged(t, second, true)
+	for _, m := range []*Membership{first, second} {
+		if members := m.Members(); !reflect.DeepEqual(members, []string{"replica-1", "replica-2"}) {
+			t.Errorf("%s: expected both members, got %v", m.config.Identity, members)
+		}
+	}
+	// The keys replica-2 gained are only owned once replica-1 surely gave
+	// them up.
+	for _, key := range keys(100) {
+		if second.Owns(key) {
+			t.Fatalf("expected %s not to be owned before the change settled", key)
+		}
+	}
+	for elapsed := time.Duration(0); elapsed < first.config.LeaseDuration; elapsed += first.config.RenewPeriod {
+		now = now.Add(first.config.RenewPeriod)
+		second.sync()
+		first.sync()
+	}
+	expectChanged(t, first, true)
+	expectChanged(t, second, true)
+	owned := map[string]int{}
+	for _, key := range keys(100) {
+		if first.Owns(key) == second.Owns(key) {
+			t.Errorf("expected %s to be owned by exactly one member", key)
+		}
+		if first.Owns(key) {
+			owned["replica-1"]++
+		} else {
+			owned["replica-2"]++
+		}
+	}
+	if owned["replica-1"] == 0 || owned["replica-2"] == 0 {
+		t.Errorf("expected both members to own keys, got %v", owned)
+	}
+
+	// Renewing without changes notifies nobody.
+	first.sync()
+	expectChanged(t, first, false)
+
+	// A member leaving deletes its Lease, the others take over its keys.
+	second.leave()
+	first.sync()
+	expectChanged(t, first, true)
+	if second.Owns("default/vm-0") {
+		t.Errorf("expected a member that left to own nothing")
+	}
+	if err := second.Check(); err == nil {
+		t.Errorf("expected the check to fail once left")
+	}
+	if _, err := client.CoordinationV1().Leases("default").Get("sample-controller-replica-2", metav1.GetOptions{}); err == nil {
+		t.Errorf("expected the lease of replica-2 to be deleted")
+	}
+	for _, key := range keys(100) {
+		if !first.Owns(key) {
+			t.Fatalf("expected the remaining member to own %s", key)
+		}
+	}
+}
+
+func TestMembershipExpires(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	now := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	first := newMembership(t, client, "replica-1", &now)
+	second := newMembership(t, client, "replica-2", &now)
+	first.sync()
+	second.sync()
+	first.sync()
+
+	// A member that stopped renewing is dropped once its Lease expires.
+	now = now.Add(10 * time.Second)
+	first.sync()
+	if members := first.Members(); len(members) != 2 {
+		t.Errorf("expected replica-2 to still be a member, got %v", members)
+	}
+	now = now.Add(10 * time.Second)
+	first.sync()
+	if members := first.Members(); !reflect.DeepEqual(members, []string{"replica-1"}) {
+		t.Errorf("expected replica-2 to be dropped, got %v", members)
+	}
+
+	// A member that cannot reach the API server gives up its share, as
+	// the others drop it.
+	for _, key := range keys(100) {
+		if second.Owns(key) {
+			t.Fatalf("expected a member out of touch for the lease duration to own nothing, it owns %s", key)
+		}
+	}
+}
+
+func TestMembershipIgnoresClockSkew(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	now := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	skewed := now.Add(-time.Hour)
+	first := newMembership(t, client, "replica-1", &now)
+	second := newMembership(t, client, "replica-2", &skewed)
+
+	// The renewals of replica-2 look an hour old on the clock of
+	// replica-1, they still count as long as they keep coming.
+	for i := 0; i < 5; i++ {
+		second.sync()
+		first.sync()
+		if members := first.Members(); len(members) != 2 {
+			t.Fatalf("expected replica-2 to be a member despite its clock, got %v", members)
+		}
+		now = now.Add(first.config.RenewPeriod)
+		skewed = skewed.Add(first.config.RenewPeriod)
+	}
+
+	// Once they stop, it is dropped a lease duration later.
+	now = now.Add(first.config.LeaseDuration)
+	first.sync()
+	if members := first.Members(); !reflect.DeepEqual(members, []string{"replica-1"}) {
+		t.Errorf("expected replica-2 to be dropped, got %v", members)
+	}
+}
+
+func TestSubSecondLeaseDuration(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	now := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	config := DefaultConfig()
+	config.Namespace = "default"
+	config.Identity = "replica-1"
+	config.LeaseDuration, config.RenewPeriod = 500*time.Millisecond, 100*time.Millisecond
+	m, err := New(client, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.now = func() time.Time { return now }
+	m.sync()
+
+	lease, err := client.CoordinationV1().Leases("default").Get("sample-controller-replica-1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *lease.Spec.LeaseDurationSeconds != 1 {
+		t.Errorf("expected the lease duration to be rounded up to 1s, got %ds", *lease.Spec.LeaseDurationSeconds)
+	}
+	if members := m.Members(); len(members) != 1 {
+		t.Errorf("expected the replica to be a member, got %v", members)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for name, mutate := range map[string]func(*Config){
+		"no group":                   func(c *Config) { c.Group = "" },
+		"renew period not positive":  func(c *Config) { c.RenewPeriod = 0 },
+		"lease shorter than renewal": func(c *Config) { c.LeaseDuration = c.RenewPeriod },
+	} {
+		config := DefaultConfig()
+		mutate(&config)
+		if err := config.Validate(); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+// Package shard splits the VMs among replicas of the controller, so that
+// they all reconcile at once, each its own share. Replicas find each other
+// through Leases, and every VM key is owned by one of them, chosen on a
+// consistent hash ring so that few keys move when replicas come and go.
+package shard
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+	"strconv"
+)
+
+// virtualNodes is how many points each member has on the ring. More points
+// spread the keys more evenly.
+const virtualNodes = 100
+
+// Ring maps keys to members by consistent hashing.
+type Ring struct {
+	members []string
+	// points are the hashes of the virtual nodes, sorted, and owners the
+	// member each belongs to.
+	points []uint64
+	owners map[uint64]string
+}
+
+// NewRing returns a ring of members. Every replica computes the same ring
+// from the same members, whatever their order.
+func NewRing(members []string) *Ring {
+	r := &Ring{owners: map[uint64]string{}}
+	r.members = append(r.members, members...)
+	sort.Strings(r.members)
+	for _, member := range r.members {
+		for i := 0; i < virtualNodes; i++ {
+			point := hash(member + "#" + strconv.Itoa(i))
+			// On the rare collision the first member in order wins, on
+			// every replica.
+			if _, ok := r.owners[point]; ok {
+				continue
+			}
+			r.owners[point] = member
+			r.points = append(r.points, point)
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+	return r
+}
+
+// Members returns the members of the ring, sorted.
+func (r *Ring) Members() []string {
+	return r.members
+}
+
+// Has reports whether member is a member of the ring.
+func (r *Ring) Has(member string) bool {
+	i := sort.SearchStrings(r.members, member)
+	return i < len(r.members) && r.members[i] == member
+}
+
+// Owner returns the member owning key, empty if the ring has no members.
+func (r *Ring) Owner(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := hash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i]]
+}
+
+// hash spreads keys over the ring. Keys and member names differ in few
+// characters, which fast hashes like FNV do not spread evenly.
+func hash(s string) uint64 {
+	sum := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
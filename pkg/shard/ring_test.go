@@ -0,0 +1,65 @@
+package shard
+
+import (
+	"fmt"
+	"testing"
+)
+
+func keys(n int) []string {
+	var keys []string
+	for i := 0; i < n; i++ {
+		keys = append(keys, fmt.Sprintf("default/vm-%d", i))
+	}
+	return keys
+}
+
+func TestRingSpreadsKeys(t *testing.T) {
+	ring := NewRing([]string{"replica-1", "replica-2", "replica-3"})
+
+	counts := map[string]int{}
+	for _, key := range keys(3000) {
+		counts[ring.Owner(key)]++
+	}
+	if len(counts) != 3 {
+		t.Fatalf("expected keys on 3 members, got %v", counts)
+	}
+	for member, n := range counts {
+		if n < 700 || n > 1300 {
+			t.Errorf("expected about 1000 keys on %s, got %d", member, n)
+		}
+	}
+
+	if owner := NewRing(nil).Owner("default/vm-0"); owner != "" {
+		t.Errorf("expected no owner on an empty ring, got %s", owner)
+	}
+}
+
+func TestRingIsConsistent(t *testing.T) {
+	ring := NewRing([]string{"replica-1", "replica-2", "replica-3"})
+	// The order members are found in does not matter.
+	same := NewRing([]string{"replica-3", "replica-1", "replica-2"})
+	// Only the keys of a member leaving move.
+	smaller := NewRing([]string{"replica-1", "replica-3"})
+	// Only keys moving to a member joining move.
+	larger := NewRing([]string{"replica-1", "replica-2", "replica-3", "replica-4"})
+
+	moved := 0
+	for _, key := range keys(3000) {
+		owner := ring.Owner(key)
+		if same.Owner(key) != owner {
+			t.Fatalf("expected %s to be owned by %s on both rings, got %s", key, owner, same.Owner(key))
+		}
+		if owner != "replica-2" && smaller.Owner(key) != owner {
+			t.Errorf("expected %s to stay on %s, it moved to %s", key, owner, smaller.Owner(key))
+		}
+		if newOwner := larger.Owner(key); newOwner != owner {
+			if newOwner != "replica-4" {
+				t.Errorf("expected %s to stay on %s or move to replica-4, it moved to %s", key, owner, newOwner)
+			}
+			moved++
+		}
+	}
+	if moved < 450 || moved > 1050 {
+		t.Errorf("expected about a quarter of the keys to move to a new member, %d did", moved)
+	}
+}
@@ -41,3 +41,24 @@ func SetupSignalHandler() (stopCh <-chan struct{}) {
 
 	return stop
 }
+
+// SetupReloadHandler returns a channel receiving whenever SIGHUP is caught,
+// to reload the configuration. It never receives on platforms without
+// SIGHUP.
+func SetupReloadHandler() <-chan struct{} {
+	reload := make(chan struct{}, 1)
+	if len(reloadSignals) == 0 {
+		return reload
+	}
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, reloadSignals...)
+	go func() {
+		for range c {
+			select {
+			case reload <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return reload
+}
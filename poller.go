@@ -0,0 +1,228 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/klog"
+
+	samplev1alpha1 "k8s.io/sample-controller/pkg/apis/samplecontroller/v1alpha1"
+	vmctl "k8s.io/sample-controller/pkg/cloud"
+)
+
+const (
+	// statusBatchSize is the largest number of servers asked for in a
+	// single bulk status request.
+	statusBatchSize = 100
+
+	// metricsRefreshInterval is the longest the metrics in the status of a
+	// VM go without a write while its CPU utilization holds steady.
+	metricsRefreshInterval = 5 * time.Minute
+
+	// metricsHistoryLength is how long samples are kept for the rolling
+	// averages. It is the longest of the windows.
+	metricsHistoryLength = 15 * time.Minute
+)
+
+// metricsSample is a sample of the metrics the rolling averages are computed
+// for.
+type metricsSample struct {
+	timestamp        time.Time
+	cpuUtilization   int64
+	memoryUsageBytes int64
+}
+
+// pollStatus refreshes the guest metrics of every VM with a server. It is
+// run periodically, apart from the workers, so keeping the status current
+// does not need a full sync of each VM.
+func (c *Controller) pollStatus() {
+	vms, err := c.vmsLister.List(labels.Everything())
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("error listing VMs: %v", err))
+		return
+	}
+
+	var polled []*samplev1alpha1.VM
+	serverIDs := map[string]bool{}
+	for _, vm := range vms {
+		// VMs owned by other replicas are polled and exported by them.
+		if !c.ownsKey(vm.Namespace + "/" + vm.Name) {
+			c.metrics.DeleteVM(vm.Namespace, vm.Name)
+			continue
+		}
+		if vm.Status.VMID != "" && vm.DeletionTimestamp == nil {
+			polled = append(polled, vm)
+			serverIDs[vm.Status.VMID] = true
+		}
+	}
+
+	for start := 0; start < len(polled); start += statusBatchSize {
+		end := start + statusBatchSize
+		if end > len(polled) {
+			end = len(polled)
+		}
+		batch := polled[start:end]
+
+		statuses, err := c.fetchStatuses(batch)
+		if err != nil {
+			utilruntime.HandleError(fmt.Errorf("error polling VM status: %v", err))
+			continue
+		}
+
+		now := c.now()
+		for _, vm := range batch {
+			serverStatus, ok := statuses[vm.Status.VMID]
+			if !ok {
+				continue
+			}
+			c.metrics.SetVMStatus(vm.Namespace, vm.Name, vm.Status.VMID, serverStatus)
+			metrics := c.recordMetrics(vm.Status.VMID, now, serverStatus)
+			if !c.metricsChanged(&vm.Status, metrics) {
+				continue
+			}
+			status := vm.Status.DeepCopy()
+			status.CpuUtilization = metrics.CpuUtilization
+			status.Metrics = metrics
+			if err := c.writeVMStatus(vm, *status); err != nil {
+				utilruntime.HandleError(fmt.Errorf("error updating status of VM '%s/%s': %v", vm.Namespace, vm.Name, err))
+			}
+		}
+	}
+
+	// Forget the servers of deleted VMs.
+	for id := range c.metricsHistory {
+		if !serverIDs[id] {
+			delete(c.metricsHistory, id)
+		}
+	}
+}
+
+// fetchStatuses returns the guest metrics of the servers of vms, by server
+// ID. The bulk endpoint is used unless the cloud turned it down before, in
+// which case every server is asked for on its own.
+func (c *Controller) fetchStatuses(vms []*samplev1alpha1.VM) (map[string]vmctl.ServerStatus, error) {
+	if !c.bulkStatusUnsupported {
+		ids := make([]string, 0, len(vms))
+		for _, vm := range vms {
+			ids = append(ids, vm.Status.VMID)
+		}
+		statuses, err := c.cloud.GetStatuses(ids)
+		if err != vmctl.ErrNotSupported {
+			return statuses, err
+		}
+		klog.Info("Cloud does not support bulk status requests, polling servers one by one")
+		c.bulkStatusUnsupported = true
+	}
+
+	statuses := map[string]vmctl.ServerStatus{}
+	for _, vm := range vms {
+		status, err := c.cloud.GetServerStatusByID(vm.Status.VMID)
+		if err == vmctl.ErrServerNotFound {
+			// Drift detection takes care of it on the next sync.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		statuses[vm.Status.VMID] = *status
+	}
+	return statuses, nil
+}
+
+// recordMetrics adds a sample taken at now to the history of the server and
+// returns it as VM metrics, with the rolling averages over the history.
+func (c *Controller) recordMetrics(id string, now time.Time, status vmctl.ServerStatus) *samplev1alpha1.VMMetrics {
+	history := append(c.metricsHistory[id], metricsSample{
+		timestamp:        now,
+		cpuUtilization:   int64(status.CpuUtilization),
+		memoryUsageBytes: status.MemoryUsageBytes,
+	})
+	for len(history) > 0 && now.Sub(history[0].timestamp) >= metricsHistoryLength {
+		history = history[1:]
+	}
+	c.metricsHistory[id] = history
+
+	return &samplev1alpha1.VMMetrics{
+		Timestamp:        metav1.NewTime(now).Rfc3339Copy(),
+		CpuUtilization:   status.CpuUtilization,
+		MemoryUsageBytes: status.MemoryUsageBytes,
+		DiskReadBytes:    status.DiskReadBytes,
+		DiskWriteBytes:   status.DiskWriteBytes,
+		NetworkRxBytes:   status.NetworkRxBytes,
+		NetworkTxBytes:   status.NetworkTxBytes,
+		UptimeSeconds:    status.UptimeSeconds,
+		CpuUtilizationAverage: averages(history, now, func(s metricsSample) int64 {
+			return s.cpuUtilization
+		}),
+		MemoryUsageBytesAverage: averages(history, now, func(s metricsSample) int64 {
+			return s.memoryUsageBytes
+		}),
+	}
+}
+
+// averages returns the 1, 5 and 15 minute averages of the value picked from
+// history. Each window holds the samples taken less than its length before
+// now.
+func averages(history []metricsSample, now time.Time, value func(metricsSample) int64) samplev1alpha1.MetricAverages {
+	average := func(window time.Duration) int64 {
+		var sum, count int64
+		for _, s := range history {
+			if now.Sub(s.timestamp) < window {
+				sum += value(s)
+				count++
+			}
+		}
+		if count == 0 {
+			return 0
+		}
+		return (sum + count/2) / count
+	}
+	return samplev1alpha1.MetricAverages{
+		OneMinute:      average(time.Minute),
+		FiveMinutes:    average(5 * time.Minute),
+		FifteenMinutes: average(15 * time.Minute),
+	}
+}
+
+// metricsChanged reports whether metrics are worth a status write. Most of
+// the figures change on every sample, so besides a move of the CPU
+// utilization past the threshold only metrics older than
+// metricsRefreshInterval are replaced.
+func (c *Controller) metricsChanged(status *samplev1alpha1.VMStatus, metrics *samplev1alpha1.VMMetrics) bool {
+	if status.Metrics == nil {
+		return true
+	}
+	if c.cpuUtilizationChanged(status.CpuUtilization, metrics.CpuUtilization) {
+		return true
+	}
+	return metrics.Timestamp.Sub(status.Metrics.Timestamp.Time) >= metricsRefreshInterval
+}
+
+// cpuUtilizationChanged reports whether the CPU utilization moved far enough
+// to be worth a status write.
+func (c *Controller) cpuUtilizationChanged(old, new int) bool {
+	diff := new - old
+	if diff < 0 {
+		diff = -diff
+	}
+	return diff > 0 && diff >= c.currentSettings().cpuUtilizationThreshold
+}
@@ -0,0 +1,92 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/cache"
+
+	samplev1alpha1 "k8s.io/sample-controller/pkg/apis/samplecontroller/v1alpha1"
+	"k8s.io/sample-controller/pkg/config"
+	listers "k8s.io/sample-controller/pkg/generated/listers/samplecontroller/v1alpha1"
+)
+
+// scopeStamp identifies the VMs watched with scope, whatever the order they
+// are given in. It is recorded on the servers created, so that only a
+// controller watching the same VMs collects them, and is empty when all VMs
+// are watched.
+func scopeStamp(scope config.ScopeConfiguration) string {
+	if len(scope.Namespaces) == 0 && scope.LabelSelector == "" {
+		return ""
+	}
+	namespaces := append([]string(nil), scope.Namespaces...)
+	sort.Strings(namespaces)
+	// Validated with the configuration, and printed in a canonical order.
+	selector, _ := labels.Parse(scope.LabelSelector)
+	sum := sha256.Sum256([]byte(strings.Join(namespaces, ",") + ";" + selector.String()))
+	return hex.EncodeToString(sum[:8])
+}
+
+// scopedVMLister lists the VMs of the informers watching one namespace
+// each, by namespace. VMs of other namespaces are never found.
+type scopedVMLister map[string]listers.VMLister
+
+// newScopedVMLister returns a lister over the listers of each namespace
+// watched, or the lister of all namespaces if that is what is watched.
+func newScopedVMLister(byNamespace map[string]listers.VMLister) listers.VMLister {
+	if lister, ok := byNamespace[metav1.NamespaceAll]; ok && len(byNamespace) == 1 {
+		return lister
+	}
+	return scopedVMLister(byNamespace)
+}
+
+func (l scopedVMLister) List(selector labels.Selector) ([]*samplev1alpha1.VM, error) {
+	var vms []*samplev1alpha1.VM
+	for _, lister := range l {
+		list, err := lister.List(selector)
+		if err != nil {
+			return nil, err
+		}
+		vms = append(vms, list...)
+	}
+	return vms, nil
+}
+
+func (l scopedVMLister) VMs(namespace string) listers.VMNamespaceLister {
+	if lister, ok := l[namespace]; ok {
+		return lister.VMs(namespace)
+	}
+	return listers.NewVMLister(cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})).VMs(namespace)
+}
+
+// allSynced returns whether all the informers behind synced are synced.
+func allSynced(synced []cache.InformerSynced) cache.InformerSynced {
+	return func() bool {
+		for _, s := range synced {
+			if !s() {
+				return false
+			}
+		}
+		return true
+	}
+}